@@ -1,26 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/expfmt"
 
 	"github.com/adjust/postgresql_exporter/pkg/config"
+	"github.com/adjust/postgresql_exporter/pkg/openmetrics"
 	"github.com/adjust/postgresql_exporter/pkg/pgcollector"
+	"github.com/adjust/postgresql_exporter/pkg/remotewrite"
 )
 
 const (
-	shutdownTimeout = 10 * time.Second
-	indexHTML       = `
+	indexHTML = `
 <html>
 	<head>
 		<title>Postgresql Exporter</title>
@@ -38,33 +48,176 @@ const (
 var (
 	version string
 
-	showVersion   = flag.Bool("version", false, "output version information, then exit")
-	configFile    = flag.String("config", "config.yaml", "path to the config file")
-	metricsPath   = flag.String("web.telemetry-path", "/metrics", "path under which to expose metrics")
-	listenAddress = flag.String("web.listen-address", ":9187", "address to listen on for web interface and telemetry")
+	configFiles        stringsFlag
+	pushGrouping       stringsFlag
+	remoteWriteHeaders stringsFlag
+	remoteWriteLabels  stringsFlag
+
+	showVersion       = flag.Bool("version", false, "output version information, then exit")
+	once              = flag.Bool("once", false, "scrape the metrics once, print them to stdout, then exit")
+	startupProbe      = flag.Bool("startup.probe", false, "connect to each database at startup, exit if any is unreachable")
+	checkQueries      = flag.Bool("check-queries", false, "prepare the queries on each database without executing them, report the failed ones, then exit")
+	printQuery        = flag.String("print-query", "", "print the variant of the named query chosen for --pg-version on each database, without connecting, then exit")
+	printPgVersion    = flag.String("pg-version", "", "postgresql version to choose the query variant for with --print-query, e.g. 14.2")
+	configDir         = flag.String("config.dir", "", "path to the directory of the config files, all its *.yaml and *.toml files are merged")
+	continueOnError   = flag.Bool("config.continue-on-error", false, "skip the query files which could not be loaded instead of failing the config load")
+	maxDefaultWorkers = flag.Int("workers.max-default", 4, "cap of the workers number derived from the number of CPUs for the databases leaving it unset, 0 to use a single worker")
+	includeDbs        = flag.String("db.include", "", "regexp of the names of the databases to scrape, matching the whole name (default all)")
+	excludeDbs        = flag.String("db.exclude", "", "regexp of the names of the databases not to scrape, matching the whole name")
+	configBaseDir     = flag.String("config.base-dir", "", "directory the query files of the config read from stdin are resolved relative to (default working directory)")
+	metricsPath       = flag.String("web.telemetry-path", "/metrics", "path under which to expose metrics")
+	listenAddress     = flag.String("web.listen-address", ":9187", "address to listen on for web interface and telemetry")
+	readTimeout       = flag.Duration("web.read-timeout", 10*time.Second, "maximum duration of reading the request")
+	writeTimeout      = flag.Duration("web.write-timeout", 2*time.Minute, "maximum duration of serving the request, keep it above the scrape duration")
+	shutdownTimeout   = flag.Duration("web.shutdown-timeout", 10*time.Second, "maximum duration of waiting for the in-flight requests on shutdown")
+	enableLifecycle   = flag.Bool("web.enable-lifecycle", false, "enable config reload via HTTP request")
+	disableDefaults   = flag.Bool("web.disable-default-collectors", false, "expose the postgresql metrics only, without the go runtime and process metrics of the exporter")
+	enableConfig      = flag.Bool("web.enable-config", false, "serve the loaded config with the passwords redacted on /-/config")
+	enableOpenMetrics = flag.Bool("web.enable-openmetrics", false, "serve metrics in the OpenMetrics format to the clients accepting it")
+	disableGzip       = flag.Bool("web.disable-compression", false, "never gzip the metrics response, even if the client accepts it")
+
+	pushGateway  = flag.String("push.gateway", "", "url of the pushgateway to push the metrics to")
+	pushInterval = flag.Duration("push.interval", time.Minute, "interval of pushing the metrics to the pushgateway")
+	pushJob      = flag.String("push.job", "postgresql_exporter", "job name of the pushed metrics")
+
+	remoteWriteURL      = flag.String("remote-write.url", "", "url of the prometheus remote write endpoint to push the metrics to")
+	remoteWriteInterval = flag.Duration("remote-write.interval", time.Minute, "interval of pushing the metrics to the remote write endpoint")
+	remoteWriteTimeout  = flag.Duration("remote-write.timeout", 30*time.Second, "maximum duration of the request to the remote write endpoint, keep it below the interval")
+
+	disableInternalMetrics   = flag.Bool("disable-internal-metrics", false, "do not export the internal metrics of the exporter")
+	scrapeTimeout            = flag.Duration("scrape.timeout", 0, "maximum duration of the scrape, the queries running longer are canceled (0 - unlimited)")
+	maxConnections           = flag.Int("max-connections", 0, "maximum number of the open connections to all the databases, the queries wait for a free one (0 - unlimited)")
+	scrapeConcurrency        = flag.Int("scrape.max-concurrency", 0, "maximum number of the queries running at once across all the databases, the rest wait for a free slot (0 - unlimited)")
+	scrapeRetainFailed       = flag.Duration("scrape.retain-failed", 0, "how long to serve the last metrics of the database which could not be connected to, flagged by pg_exporter_stale (0 - drop them)")
+	scrapeSpread             = flag.Duration("scrape.spread", 0, "maximum random delay of the start of each database scrape, capped at half of the scrape timeout (0 - start at once)")
+	counterSuffix            = flag.Bool("counters.add-total-suffix", false, "append _total to the names of the counters lacking it")
+	clampCounters            = flag.Bool("counters.clamp-decreasing", false, "report the previous value of the counters which decreased since the previous scrape")
+	internalMetricsNamespace = flag.String("internal-metrics-namespace", "pg_exporter", "namespace of the internal metrics of the exporter")
+	maxLabelValueLength      = flag.Int("labels.max-value-length", 0, "maximum length of the label values, the longer values are truncated (0 - unlimited)")
+	abortOnConversionError   = flag.Bool("scrape.abort-on-conversion-error", false, "stop the query on the value which could not be converted instead of skipping the metric or the row")
+	omitQueryPrefix          = flag.Bool("metrics.omit-query-prefix", false, "name the metrics without the query name prefix, keep the metric names unique across the queries then")
+	strictColumns            = flag.Bool("scrape.strict-columns", false, "fail the query whose first row lacks a column named in its config, e.g. a misspelled LABEL or DISCARD column")
+	autoLabels               = flag.Bool("labels.auto", false, "label the metrics with the host, port, dbname and pg_version of the connection, unless the config labels set them")
+	maxLabelSets             = flag.Int("labels.max-sets-per-metric", 0, "maximum number of the distinct label sets per metric of the query, the rest are dropped (0 - unlimited)")
+	debug                    = flag.Bool("log.debug", false, "log the skipped values too noisy for the default log, e.g. NaN")
 )
 
+// stdinConfig keeps the config read from stdin, so that it can be reloaded
+var stdinConfig []byte
+
+// stringsFlag describes a repeatable string flag
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+
+	return nil
+}
+
 func init() {
-	flag.Parse()
+	flag.Var(&configFiles, "config", "path to the config file, can be repeated to merge several files, - reads it from stdin (default config.yaml)")
+	flag.Var(&pushGrouping, "push.grouping", "grouping label of the pushed metrics as name=value, can be repeated")
+	flag.Var(&remoteWriteHeaders, "remote-write.header", "header of the remote write requests as \"Name: value\", e.g. the Authorization, can be repeated")
+	flag.Var(&remoteWriteLabels, "remote-write.label", "label added to the series pushed to the remote write endpoint as name=value, can be repeated")
 }
 
 func main() {
+	flag.Parse()
+	if len(configFiles) == 0 && *configDir == "" {
+		configFiles = stringsFlag{"config.yaml"}
+	}
+
 	if *showVersion {
 		fmt.Printf("postgresql prometheus exporter %s", version)
 		os.Exit(0)
 	}
 
-	cfg := config.New(*configFile)
-	if err := cfg.Load(); err != nil {
+	for _, filename := range configFiles {
+		if filename != config.Stdin {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("could not read config from stdin: %v", err)
+		}
+		stdinConfig = data
+		break
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
 		log.Fatalf("could not load config: %v", err)
 	}
+
+	if *printQuery != "" {
+		if err := printQueryVariants(os.Stdout, cfg, *printQuery, *printPgVersion); err != nil {
+			log.Fatalf("could not print query: %v", err)
+		}
+		os.Exit(0)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
-	collector := pgcollector.New(ctx)
+	collector := pgcollector.New(ctx, pgcollector.Options{
+		DisableInternalMetrics:   *disableInternalMetrics,
+		InternalMetricsNamespace: *internalMetricsNamespace,
+		ClampCounters:            *clampCounters,
+		CounterSuffix:            *counterSuffix,
+		ScrapeTimeout:            *scrapeTimeout,
+		ScrapeSpread:             *scrapeSpread,
+		MaxConnections:           *maxConnections,
+		MaxConcurrency:           *scrapeConcurrency,
+		RetainFailed:             *scrapeRetainFailed,
+		MaxLabelValueLength:      *maxLabelValueLength,
+		MaxLabelSets:             *maxLabelSets,
+		AbortOnConversionError:   *abortOnConversionError,
+		AutoLabels:               *autoLabels,
+		StrictColumns:            *strictColumns,
+		OmitQueryPrefix:          *omitQueryPrefix,
+		Debug:                    *debug,
+	})
 	collector.LoadConfig(cfg)
 
-	if err := prometheus.Register(collector); err != nil {
-		log.Fatalf("could not register collector: %v", err)
+	if *checkQueries {
+		failed := collector.CheckQueries()
+		cancel()
+		for _, f := range failed {
+			fmt.Printf("%s\t%s\t%v\n", f.DbName, f.Query, f.Err)
+		}
+		if len(failed) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *once {
+		err := scrapeOnce(os.Stdout, collector)
+		cancel()
+		if err != nil {
+			log.Fatalf("could not scrape metrics: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if *startupProbe {
+		failed := collector.Probe()
+		for _, f := range failed {
+			log.Printf("could not connect to %q: %v", f.DbName, f.Err)
+		}
+		if len(failed) > 0 {
+			cancel()
+			log.Fatalf("startup probe failed: %d of %d databases are unreachable", len(failed), len(cfg.DbList()))
+		}
+	}
+
+	_, metricsHandler, err := newMetricsHandler(collector, *disableDefaults, *disableGzip, *enableOpenMetrics)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	mux := http.NewServeMux()
@@ -72,16 +225,57 @@ func main() {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.Write([]byte(fmt.Sprintf(indexHTML, *metricsPath)))
 	})
-	mux.Handle(*metricsPath, promhttp.Handler())
+	mux.Handle(*metricsPath, metricsHandler)
+	if *enableLifecycle {
+		mux.HandleFunc("/-/reload", reloadHandler(func() error { return reload(collector) }))
+	}
 
-	srv := http.Server{
-		Addr:    *listenAddress,
-		Handler: mux,
+	if *enableConfig {
+		mux.HandleFunc("/-/config", configHandler(collector.Config))
 	}
 
+	srv := newServer(*listenAddress, mux, *readTimeout, *writeTimeout)
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT)
 
+	if *pushGateway != "" {
+		pusher, err := newPusher(*pushGateway, *pushJob, pushGrouping, collector)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("pushing metrics to %s every %v", *pushGateway, *pushInterval)
+		go pushMetrics(ctx, pusher.Push, *pushInterval)
+	}
+
+	if *remoteWriteURL != "" {
+		// only the postgresql metrics are pushed, as to the pushgateway
+		registry := prometheus.NewRegistry()
+		if err := registry.Register(collector); err != nil {
+			log.Fatalf("could not register collector: %v", err)
+		}
+
+		client := remotewrite.New(*remoteWriteURL, *remoteWriteTimeout)
+		for _, header := range remoteWriteHeaders {
+			parts := strings.SplitN(header, ":", 2)
+			if len(parts) != 2 {
+				log.Fatalf("invalid remote write header %q, \"Name: value\" expected", header)
+			}
+			client = client.Header(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		}
+		for _, label := range remoteWriteLabels {
+			parts := strings.SplitN(label, "=", 2)
+			if len(parts) != 2 {
+				log.Fatalf("invalid remote write label %q, name=value expected", label)
+			}
+			client = client.Label(parts[0], parts[1])
+		}
+
+		log.Printf("pushing metrics to %s every %v", *remoteWriteURL, *remoteWriteInterval)
+		go pushMetrics(ctx, func() error { return client.Push(registry) }, *remoteWriteInterval)
+	}
+
 	log.Printf("starting postgresql exporter: %s", srv.Addr)
 	go func() {
 		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
@@ -97,17 +291,272 @@ loop:
 		case syscall.SIGTERM:
 			break loop
 		case syscall.SIGHUP:
-			//TODO: reload config
+			if err := reload(collector); err != nil {
+				log.Printf("could not reload config: %v", err)
+			} else {
+				log.Printf("config reloaded")
+			}
 		default:
 			log.Printf("received signal: %v", sig)
 		}
 	}
 	cancel()
 
-	shutdownCtx, _ := context.WithTimeout(context.Background(), shutdownTimeout)
+	shutdown(srv, collector.Wait, *shutdownTimeout)
+
+	close(sigs)
+}
+
+// shutdown stops the http server and waits for the running scrape to close its connections, the in-flight requests
+// are closed forcibly once the timeout expires
+func shutdown(srv *http.Server, waitScrape func(), timeout time.Duration) {
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), timeout)
+	defer shutdownCancel()
 	if err := srv.Shutdown(shutdownCtx); err != nil {
 		log.Printf("could not shutdown http server: %v", err)
+		srv.Close()
 	}
 
-	close(sigs)
+	// the running scrape is canceled along with the context, wait for it to close its connections
+	scrapeDone := make(chan struct{})
+	go func() {
+		waitScrape()
+		close(scrapeDone)
+	}()
+	select {
+	case <-scrapeDone:
+	case <-shutdownCtx.Done():
+		log.Printf("could not wait for the running scrape to finish: %v", shutdownCtx.Err())
+	}
+}
+
+// loadConfig loads the config files along with the files of the config dir in sorted order
+func loadConfig() (*config.Config, error) {
+	filenames := append([]string{}, configFiles...)
+	if *configDir != "" {
+		dirFiles, err := configDirFiles(*configDir)
+		if err != nil {
+			return nil, err
+		}
+		filenames = append(filenames, dirFiles...)
+	}
+
+	include, err := dbFilter(*includeDbs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --db.include: %v", err)
+	}
+	exclude, err := dbFilter(*excludeDbs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --db.exclude: %v", err)
+	}
+
+	cfg := config.New(filenames...)
+	cfg.SetStdin(bytes.NewReader(stdinConfig), *configBaseDir)
+	cfg.SetContinueOnError(*continueOnError)
+	cfg.SetMaxDefaultWorkers(*maxDefaultWorkers)
+	cfg.SetDbFilter(include, exclude)
+	cfg.SetMaxConnections(*maxConnections)
+	if err := cfg.Load(); err != nil {
+		return nil, err
+	}
+	// the metric names not following the conventions are reported on each load, including the reloads
+	for _, warning := range cfg.Lint(*counterSuffix) {
+		log.Printf("warning: %s", warning)
+	}
+
+	return cfg, nil
+}
+
+// configDirFiles returns the sorted *.yaml and *.toml files of the config dir
+func configDirFiles(dir string) ([]string, error) {
+	var dirFiles []string
+	for _, pattern := range []string{"*.yaml", "*.toml"} {
+		files, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("could not list config dir: %v", err)
+		}
+		dirFiles = append(dirFiles, files...)
+	}
+	sort.Strings(dirFiles)
+	if len(dirFiles) == 0 {
+		return nil, fmt.Errorf("no config files found in %q", dir)
+	}
+
+	return dirFiles, nil
+}
+
+// dbFilter compiles the regexp of the database names matching the whole name, nil if expr is empty
+func dbFilter(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// newServer creates the http server of the handler, the slow clients are disconnected after the timeouts
+func newServer(addr string, handler http.Handler, readTimeout, writeTimeout time.Duration) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+	}
+}
+
+// newMetricsHandler registers the collector and returns the gatherer and the handler of its metrics: the default
+// registry along with the go runtime and process metrics, or a registry of the collector only with disableDefaults.
+// With openMetrics the clients accepting the OpenMetrics format are served in it
+func newMetricsHandler(collector prometheus.Collector, disableDefaults, disableGzip, openMetrics bool) (prometheus.Gatherer, http.Handler, error) {
+	handlerOpts := promhttp.HandlerOpts{DisableCompression: disableGzip}
+	withOpenMetrics := func(gatherer prometheus.Gatherer, handler http.Handler) http.Handler {
+		if !openMetrics {
+			return handler
+		}
+		return openmetrics.Handler(gatherer, handler, !disableGzip)
+	}
+
+	if disableDefaults {
+		registry := prometheus.NewRegistry()
+		if err := registry.Register(collector); err != nil {
+			return nil, nil, fmt.Errorf("could not register collector: %v", err)
+		}
+		return registry, withOpenMetrics(registry, promhttp.HandlerFor(registry, handlerOpts)), nil
+	}
+
+	if err := prometheus.Register(collector); err != nil {
+		return nil, nil, fmt.Errorf("could not register collector: %v", err)
+	}
+	// the requests of both formats are counted by the promhttp_metric_handler_* metrics
+	metricsHandler := promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		withOpenMetrics(prometheus.DefaultGatherer, promhttp.HandlerFor(prometheus.DefaultGatherer, handlerOpts)),
+	)
+
+	return prometheus.DefaultGatherer, metricsHandler, nil
+}
+
+// newPusher creates the pusher of the collector metrics to the pushgateway, grouped by the name=value labels
+func newPusher(url, job string, grouping []string, collector prometheus.Collector) (*push.Pusher, error) {
+	pusher := push.New(url, job).Collector(collector)
+	for _, label := range grouping {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid push grouping %q, name=value expected", label)
+		}
+		pusher = pusher.Grouping(parts[0], parts[1])
+	}
+
+	return pusher, nil
+}
+
+// pushMetrics periodically pushes the metrics with pushFn until the context is done
+func pushMetrics(ctx context.Context, pushFn func() error, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := pushFn(); err != nil {
+			log.Printf("could not push metrics: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scrapeOnce collects the metrics and writes them in the text exposition format
+func scrapeOnce(w io.Writer, collector prometheus.Collector) error {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		return fmt.Errorf("could not register collector: %v", err)
+	}
+
+	metricFamilies, gatherErr := registry.Gather()
+	for _, mf := range metricFamilies {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return fmt.Errorf("could not write metrics: %v", err)
+		}
+	}
+
+	return gatherErr
+}
+
+// printQueryVariants writes the variant of the query chosen for the version on each database defining the query
+func printQueryVariants(w io.Writer, cfg *config.Config, queryName, pgVersion string) error {
+	version := config.ParseVersion(pgVersion)
+	if version == config.NoVersion {
+		return fmt.Errorf("could not parse version %q", pgVersion)
+	}
+
+	dbNames := cfg.DbList()
+	sort.Strings(dbNames)
+
+	found := false
+	for _, dbName := range dbNames {
+		dbConf := cfg.Db(dbName)
+		for _, query := range dbConf.Queries() {
+			if query.Name != queryName {
+				continue
+			}
+			found = true
+
+			variant := query.VerSQL.Variant(version)
+			if variant.SQL == "" {
+				fmt.Fprintf(w, "-- %s: no variant for version %s\n", dbName, version)
+				continue
+			}
+			fmt.Fprintf(w, "-- %s: variant %s-%s\n%s\n", dbName, variant.MinVer.Bound(), variant.MaxVer.Bound(), variant.SQL)
+		}
+	}
+	if !found {
+		return fmt.Errorf("query %q is not defined for any database", queryName)
+	}
+
+	return nil
+}
+
+// reloadHandler reloads the config with reloadFn on the POST requests, the error is returned with status 500
+func reloadHandler(reloadFn func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := reloadFn(); err != nil {
+			log.Printf("could not reload config: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// configHandler serves the config dump returned by dumpFn in yaml, the error is returned with status 500
+func configHandler(dumpFn func() ([]byte, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg, err := dumpFn()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/yaml; charset=utf-8")
+		w.Write(cfg)
+	}
+}
+
+func reload(collector *pgcollector.PgCollector) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		collector.ReloadFailed()
+		return fmt.Errorf("could not load config: %v", err)
+	}
+	collector.LoadConfig(cfg)
+
+	return nil
 }
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/adjust/postgresql_exporter/pkg/config"
+	"github.com/adjust/postgresql_exporter/pkg/db"
+	"github.com/adjust/postgresql_exporter/pkg/db/dbtest"
+	"github.com/adjust/postgresql_exporter/pkg/pgcollector"
+)
+
+func TestReloadHandler(t *testing.T) {
+	tests := []struct {
+		method     string
+		reloadErr  error
+		wantStatus int
+		wantBody   string
+		wantReload bool
+	}{
+		{http.MethodPost, nil, http.StatusOK, "", true},
+		{http.MethodPost, errors.New("could not load config: broken"), http.StatusInternalServerError, "could not load config: broken", true},
+		{http.MethodGet, nil, http.StatusMethodNotAllowed, "only POST requests allowed", false},
+	}
+
+	for _, tt := range tests {
+		reloaded := false
+		handler := reloadHandler(func() error {
+			reloaded = true
+			return tt.reloadErr
+		})
+
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(tt.method, "/-/reload", nil))
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s, error %v: expected status %d, got %d", tt.method, tt.reloadErr, tt.wantStatus, w.Code)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != tt.wantBody {
+			t.Errorf("%s, error %v: expected body %q, got %q", tt.method, tt.reloadErr, tt.wantBody, body)
+		}
+		if reloaded != tt.wantReload {
+			t.Errorf("%s, error %v: expected reload %v, got %v", tt.method, tt.reloadErr, tt.wantReload, reloaded)
+		}
+	}
+}
+
+func TestConfigDirFiles(t *testing.T) {
+	tests := []struct {
+		files   []string
+		want    []string
+		wantErr bool
+	}{
+		{[]string{"b.yaml", "a.yaml", "c.toml"}, []string{"a.yaml", "b.yaml", "c.toml"}, false},
+		{[]string{"b.toml", "a.yml", "notes.txt", "c.yaml"}, []string{"b.toml", "c.yaml"}, false},
+		{[]string{"notes.txt"}, nil, true},
+		{nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		for _, name := range tt.files {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+				t.Fatalf("could not write file: %v", err)
+			}
+		}
+
+		files, err := configDirFiles(dir)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: expected error %v, got %v", tt.files, tt.wantErr, err)
+			continue
+		}
+		var got []string
+		for _, file := range files {
+			got = append(got, filepath.Base(file))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: expected %v, got %v", tt.files, tt.want, got)
+		}
+	}
+}
+
+func TestConfigDirDuplicateDbs(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"a.yaml": "a: {host: a}\n",
+		"b.yaml": "a: {host: b}\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("could not write file: %v", err)
+		}
+	}
+
+	files, err := configDirFiles(dir)
+	if err != nil {
+		t.Fatalf("could not list config dir: %v", err)
+	}
+	if err := config.New(files...).Load(); err == nil || !strings.Contains(err.Error(), "already defined") {
+		t.Errorf("expected the duplicate database error, got %v", err)
+	}
+}
+
+// newTestCollector creates the collector of the config read from the string, the query files are resolved
+// relative to testdata and the connections return the rows of the query
+func newTestCollector(t *testing.T, cfgYAML, query string, rows ...map[string]interface{}) *pgcollector.PgCollector {
+	cfg := config.New(config.Stdin)
+	cfg.SetStdin(strings.NewReader(cfgYAML), "testdata")
+	if err := cfg.Load(); err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+
+	collector := pgcollector.New(context.Background(), pgcollector.Options{
+		Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+			return dbtest.New(110000).SetRows(query, rows...), nil
+		},
+	})
+	collector.LoadConfig(cfg)
+
+	return collector
+}
+
+func TestScrapeOnce(t *testing.T) {
+	tests := []struct {
+		cfgYAML string
+		rows    []map[string]interface{}
+		want    []string
+		wantErr bool
+	}{
+		{
+			`a: {host: a, queryFiles: [queries.yaml]}`,
+			[]map[string]interface{}{{"value": 42.0}},
+			[]string{"# TYPE pg_test_value gauge", "pg_test_value 42", `pg_exporter_up{instance="a"} 1`},
+			false,
+		},
+		{
+			`{a: {host: a, labels: {db: a}, queryFiles: [queries.yaml]}, b: {host: b, labels: {db: b}, queryFiles: [queries.yaml]}}`,
+			[]map[string]interface{}{{"value": 1.5}},
+			[]string{`pg_test_value{db="a"} 1.5`, `pg_test_value{db="b"} 1.5`},
+			false,
+		},
+		{
+			`{a: {host: a, queryFiles: [queries.yaml]}, b: {host: b, queryFiles: [queries.yaml]}}`,
+			[]map[string]interface{}{{"value": 1.5}},
+			[]string{`pg_exporter_up{instance="a"} 1`, `pg_exporter_up{instance="b"} 1`},
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		err := scrapeOnce(&buf, newTestCollector(t, tt.cfgYAML, "select value", tt.rows...))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.cfgYAML, tt.wantErr, err)
+		}
+		for _, line := range tt.want {
+			if !strings.Contains(buf.String(), line+"\n") {
+				t.Errorf("%s: expected the line %q in the output:\n%s", tt.cfgYAML, line, buf.String())
+			}
+		}
+	}
+}
+
+// pushLabels returns the job and the grouping labels of the pushgateway url path,
+// the order of the grouping labels in the path is not defined
+func pushLabels(path string) map[string]string {
+	parts := strings.Split(strings.TrimPrefix(path, "/metrics/"), "/")
+	labels := make(map[string]string)
+	for i := 0; i+1 < len(parts); i += 2 {
+		labels[parts[i]] = parts[i+1]
+	}
+
+	return labels
+}
+
+func TestPushMetrics(t *testing.T) {
+	tests := []struct {
+		job        string
+		grouping   []string
+		wantLabels map[string]string
+		wantErr    bool
+	}{
+		{"postgresql_exporter", nil, map[string]string{"job": "postgresql_exporter"}, false},
+		{"batch", []string{"cluster=main", "env=prod"}, map[string]string{"job": "batch", "cluster": "main", "env": "prod"}, false},
+		{"batch", []string{"cluster"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		requests := make(chan *http.Request, 10)
+		bodies := make(chan string, 10)
+		gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			requests <- r
+			bodies <- string(body)
+			w.WriteHeader(http.StatusAccepted)
+		}))
+
+		pusher, err := newPusher(gateway.URL, tt.job, tt.grouping,
+			newTestCollector(t, `a: {host: a, queryFiles: [queries.yaml]}`, "select value", map[string]interface{}{"value": 7.0}))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: expected error %v, got %v", tt.grouping, tt.wantErr, err)
+		}
+		if err != nil {
+			gateway.Close()
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			pushMetrics(ctx, pusher.Push, time.Millisecond)
+			close(done)
+		}()
+		for i := 0; i < 2; i++ {
+			select {
+			case r := <-requests:
+				if r.Method != http.MethodPut || !reflect.DeepEqual(pushLabels(r.URL.Path), tt.wantLabels) {
+					t.Errorf("%s %v: expected PUT of %v, got %s %s", tt.job, tt.grouping, tt.wantLabels, r.Method, r.URL.Path)
+				}
+				if body := <-bodies; !strings.Contains(body, "pg_test_value") {
+					t.Errorf("%s %v: expected the collector metrics pushed", tt.job, tt.grouping)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s %v: expected push %d", tt.job, tt.grouping, i+1)
+			}
+		}
+		cancel()
+		<-done
+		gateway.Close()
+	}
+}
+
+func TestReloadFailure(t *testing.T) {
+	collector := newTestCollector(t, `a: {host: a, queryFiles: [queries.yaml]}`, "select value", map[string]interface{}{"value": 1.0})
+	defer func(files stringsFlag) { configFiles = files }(configFiles)
+
+	tests := []struct {
+		files       stringsFlag
+		wantErr     bool
+		wantSuccess string
+	}{
+		{stringsFlag{"testdata/missing.yaml"}, true, "pg_exporter_config_last_reload_success 0\n"},
+		{stringsFlag{"testdata/config.yaml"}, false, "pg_exporter_config_last_reload_success 1\n"},
+	}
+
+	for _, tt := range tests {
+		configFiles = tt.files
+		if err := reload(collector); (err != nil) != tt.wantErr {
+			t.Errorf("%v: expected error %v, got %v", tt.files, tt.wantErr, err)
+		}
+
+		var buf bytes.Buffer
+		if err := scrapeOnce(&buf, collector); err != nil {
+			t.Fatalf("could not scrape: %v", err)
+		}
+		if !strings.Contains(buf.String(), tt.wantSuccess) {
+			t.Errorf("%v: expected %q in the output:\n%s", tt.files, tt.wantSuccess, buf.String())
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	tests := []struct {
+		disableDefaults bool
+		wantDefaults    bool
+	}{
+		{true, false},
+		{false, true},
+	}
+
+	// the collector without the descriptions can not be unregistered, so the default registry is replaced
+	defaultRegisterer, defaultGatherer := prometheus.DefaultRegisterer, prometheus.DefaultGatherer
+	defer func() {
+		prometheus.DefaultRegisterer, prometheus.DefaultGatherer = defaultRegisterer, defaultGatherer
+	}()
+
+	for _, tt := range tests {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(prometheus.NewGoCollector())
+		prometheus.DefaultRegisterer, prometheus.DefaultGatherer = registry, registry
+
+		collector := newTestCollector(t, `a: {host: a, queryFiles: [queries.yaml]}`, "select value", map[string]interface{}{"value": 42.0})
+		gatherer, handler, err := newMetricsHandler(collector, tt.disableDefaults, true, false)
+		if err != nil {
+			t.Fatalf("disable defaults %v: could not create handler: %v", tt.disableDefaults, err)
+		}
+
+		mfs, err := gatherer.Gather()
+		if err != nil {
+			t.Errorf("disable defaults %v: could not gather metrics: %v", tt.disableDefaults, err)
+		}
+		names := make(map[string]bool)
+		for _, mf := range mfs {
+			names[mf.GetName()] = true
+		}
+		if !names["pg_test_value"] {
+			t.Errorf("disable defaults %v: expected the pg_test_value metric", tt.disableDefaults)
+		}
+		if names["go_goroutines"] != tt.wantDefaults {
+			t.Errorf("disable defaults %v: expected go_goroutines %v, got %v", tt.disableDefaults, tt.wantDefaults, names["go_goroutines"])
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		body := w.Body.String()
+		if !strings.Contains(body, "pg_test_value 42\n") {
+			t.Errorf("disable defaults %v: expected pg_test_value in the response:\n%s", tt.disableDefaults, body)
+		}
+		if strings.Contains(body, "\ngo_goroutines ") != tt.wantDefaults {
+			t.Errorf("disable defaults %v: expected go_goroutines in the response %v", tt.disableDefaults, tt.wantDefaults)
+		}
+	}
+}
+
+func TestOpenMetricsHandlerInstrumented(t *testing.T) {
+	defaultRegisterer, defaultGatherer := prometheus.DefaultRegisterer, prometheus.DefaultGatherer
+	defer func() {
+		prometheus.DefaultRegisterer, prometheus.DefaultGatherer = defaultRegisterer, defaultGatherer
+	}()
+	registry := prometheus.NewRegistry()
+	prometheus.DefaultRegisterer, prometheus.DefaultGatherer = registry, registry
+
+	collector := newTestCollector(t, `a: {host: a, queryFiles: [queries.yaml]}`, "select value", map[string]interface{}{"value": 42.0})
+	_, handler, err := newMetricsHandler(collector, false, true, true)
+	if err != nil {
+		t.Fatalf("could not create handler: %v", err)
+	}
+
+	for _, accept := range []string{"application/openmetrics-text; version=1.0.0", "text/plain"} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%q: expected status %d, got %d", accept, http.StatusOK, w.Code)
+		}
+	}
+
+	// both the OpenMetrics and the text format requests are counted
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if body := w.Body.String(); !strings.Contains(body, `promhttp_metric_handler_requests_total{code="200"} 2`+"\n") {
+		t.Errorf("expected 2 counted requests in the response:\n%s", body)
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	tests := []struct {
+		readTimeout  time.Duration
+		writeTimeout time.Duration
+	}{
+		{10 * time.Second, 2 * time.Minute},
+		{100 * time.Millisecond, time.Second},
+	}
+
+	for _, tt := range tests {
+		srv := newServer("127.0.0.1:0", http.NotFoundHandler(), tt.readTimeout, tt.writeTimeout)
+		if srv.ReadTimeout != tt.readTimeout || srv.WriteTimeout != tt.writeTimeout {
+			t.Errorf("expected read timeout %v and write timeout %v, got %v and %v",
+				tt.readTimeout, tt.writeTimeout, srv.ReadTimeout, srv.WriteTimeout)
+		}
+	}
+}
+
+func TestServerReadTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	srv := newServer(ln.Addr().String(), http.NotFoundHandler(), 100*time.Millisecond, time.Second)
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer conn.Close()
+
+	// the client never finishes the request headers
+	if _, err := conn.Write([]byte("GET /metrics HTTP/1.1\r\nHost: localhost\r\n")); err != nil {
+		t.Fatalf("could not write request: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	ioutil.ReadAll(conn)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the slow client to be disconnected after the read timeout, took %v", elapsed)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name        string
+		request     time.Duration
+		scrape      time.Duration
+		wantWaited  bool
+		wantMaxTime time.Duration
+	}{
+		{"idle", 0, 0, true, 100 * time.Millisecond},
+		// the timeout is shared by the requests and the scrape
+		{"slow request", 5 * time.Second, 0, false, time.Second},
+		{"slow scrape", 0, 5 * time.Second, false, time.Second},
+	}
+
+	for _, tt := range tests {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("could not listen: %v", err)
+		}
+		started := make(chan struct{})
+		srv := newServer(ln.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(tt.request)
+		}), time.Second, 10*time.Second)
+		go srv.Serve(ln)
+
+		go http.Get("http://" + ln.Addr().String() + "/metrics")
+		<-started
+
+		waited := make(chan struct{})
+		start := time.Now()
+		shutdown(srv, func() {
+			time.Sleep(tt.scrape)
+			close(waited)
+		}, 200*time.Millisecond)
+		if elapsed := time.Since(start); elapsed > tt.wantMaxTime {
+			t.Errorf("%s: expected shutdown within %v, took %v", tt.name, tt.wantMaxTime, elapsed)
+		}
+		if tt.wantWaited {
+			select {
+			case <-waited:
+			default:
+				t.Errorf("%s: expected to wait for the scrape", tt.name)
+			}
+		}
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	tests := []struct {
+		cfgYAML     string
+		want        []string
+		wantMissing []string
+	}{
+		{
+			`a: {host: a, user: monitoring, password: secret, queryFiles: [queries.yaml]}`,
+			[]string{"password: <redacted>", "user: monitoring", "- pg_test"},
+			[]string{"secret"},
+		},
+		{
+			`a: {host: a, queryFiles: [queries.yaml]}`,
+			[]string{"host: a", "- pg_test"},
+			[]string{"<redacted>"},
+		},
+	}
+
+	for _, tt := range tests {
+		collector := newTestCollector(t, tt.cfgYAML, "select value")
+
+		w := httptest.NewRecorder()
+		configHandler(collector.Config)(w, httptest.NewRequest(http.MethodGet, "/-/config", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status %d, got %d", tt.cfgYAML, http.StatusOK, w.Code)
+		}
+		body := w.Body.String()
+		for _, s := range tt.want {
+			if !strings.Contains(body, s) {
+				t.Errorf("%s: expected %q in the config:\n%s", tt.cfgYAML, s, body)
+			}
+		}
+		for _, s := range tt.wantMissing {
+			if strings.Contains(body, s) {
+				t.Errorf("%s: unexpected %q in the config:\n%s", tt.cfgYAML, s, body)
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	configHandler(func() ([]byte, error) {
+		return nil, errors.New("could not marshal config")
+	})(w, httptest.NewRequest(http.MethodGet, "/-/config", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d on the error, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestMetricsGzip(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		disableGzip    bool
+		wantGzip       bool
+	}{
+		{"gzip", false, true},
+		{"gzip, deflate", false, true},
+		{"", false, false},
+		{"gzip", true, false},
+	}
+
+	for _, tt := range tests {
+		collector := newTestCollector(t, `a: {host: a, queryFiles: [queries.yaml]}`, "select value", map[string]interface{}{"value": 42.0})
+		_, handler, err := newMetricsHandler(collector, true, tt.disableGzip, false)
+		if err != nil {
+			t.Fatalf("could not create handler: %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tt.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		body := io.Reader(w.Body)
+		if gotGzip := w.Header().Get("Content-Encoding") == "gzip"; gotGzip != tt.wantGzip {
+			t.Errorf("%q, disable gzip %v: expected gzip %v, got %v", tt.acceptEncoding, tt.disableGzip, tt.wantGzip, gotGzip)
+			continue
+		}
+		if tt.wantGzip {
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Errorf("%q: could not decompress the response: %v", tt.acceptEncoding, err)
+				continue
+			}
+			body = gz
+		}
+		metrics, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Errorf("%q: could not read the response: %v", tt.acceptEncoding, err)
+		}
+		if !strings.Contains(string(metrics), "pg_test_value 42\n") {
+			t.Errorf("%q, disable gzip %v: expected pg_test_value in the response:\n%s", tt.acceptEncoding, tt.disableGzip, metrics)
+		}
+	}
+}
+
+func TestDbFilter(t *testing.T) {
+	tests := []struct {
+		expr      string
+		name      string
+		wantMatch bool
+		wantErr   bool
+	}{
+		{"orders", "orders", true, false},
+		{"orders", "orders-1", false, false},
+		{"orders-.*", "orders-1", true, false},
+		{"a|b", "b", true, false},
+		{"a|b", "ab", false, false},
+		{"orders-(", "", false, true},
+	}
+
+	for _, tt := range tests {
+		re, err := dbFilter(tt.expr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: expected error %v, got %v", tt.expr, tt.wantErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		if got := re.MatchString(tt.name); got != tt.wantMatch {
+			t.Errorf("%q: expected match of %q %v, got %v", tt.expr, tt.name, tt.wantMatch, got)
+		}
+	}
+
+	if re, err := dbFilter(""); re != nil || err != nil {
+		t.Errorf("empty: expected no filter, got %v, %v", re, err)
+	}
+}
@@ -2,33 +2,56 @@ package config
 
 import (
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"path"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 
 	"gopkg.in/yaml.v2"
 )
 
 // Column usage types
 const (
-	Discard ColumnUsage = iota // Ignore this column
-	Label                      // Use this column as a label
-	Counter                    // Use this column as a counter
-	Gauge                      // Use this column as a gauge
+	Discard   ColumnUsage = iota // Ignore this column
+	Label                        // Use this column as a label
+	Counter                      // Use this column as a counter
+	Gauge                        // Use this column as a gauge
+	Summary                      // Observe values of this column with a summary
+	Info                         // Not a column: gauge of 1 per row, carrying the row labels
+	Histogram                    // Use this column as the count of the histogram of the precomputed bucket columns
 
 	NoVersion PgVersion = -1
+
+	globalLabelsKey = "labels"   // Top level key of the global labels
+	defaultsKey     = "defaults" // Top level key of the defaults of the database settings
+
+	// Stdin is the config filename which reads the config from the standard input
+	Stdin = "-"
+
+	redacted = "<redacted>" // Replacement of the secrets in the config dump
 )
 
 var (
-	pgVerRegex = regexp.MustCompile(`^(\d+)(?:\.(\d+))?(?:\.(\d+))?$`)
+	millisecondSuffixes = []string{"_ms", "_msec", "_millis", "_milliseconds"}
+
+	pgVerRegex        = regexp.MustCompile(`^(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:(?:alpha|beta|rc|devel)\d*)?(?:\s.*)?$`) // e.g. "16beta1", "14.2 (Ubuntu 14.2-1)"
+	cockroachVerRegex = regexp.MustCompile(`^CockroachDB \S+ v(\d+(?:\.\d+)?(?:\.\d+)?)`)
 
 	columnUsageMapping = map[string]ColumnUsage{
-		"DISCARD": Discard,
-		"LABEL":   Label,
-		"COUNTER": Counter,
-		"GAUGE":   Gauge,
+		"DISCARD":   Discard,
+		"LABEL":     Label,
+		"COUNTER":   Counter,
+		"GAUGE":     Gauge,
+		"SUMMARY":   Summary,
+		"INFO":      Info,
+		"HISTOGRAM": Histogram,
 	}
 )
 
@@ -37,12 +60,63 @@ type Interface interface {
 	Load() error
 	DbList() []string
 	Db(string) DbConfig
+	Labels() map[string]string
+	Files() []string
+	Dump() ([]byte, error)
 }
 
 // Config describes exporter config
 type Config struct {
-	configFile string
-	dbs        map[string]DbConfig
+	configFiles []string
+	stdin       io.Reader      // Source of the "-" config file
+	baseDir     string         // Directory the query files of the "-" config file are resolved relative to
+	skipBroken  bool           // Skip the query files which could not be loaded
+	maxWorkers  int            // Cap of the workers number derived from the number of CPUs
+	includeDbs  *regexp.Regexp // Names of the databases to keep, all if nil
+	excludeDbs  *regexp.Regexp // Names of the databases to leave out, none if nil
+	maxConns    int            // Limit of the connections the idle ones of all the databases stay below, unlimited if 0
+	dbs         map[string]DbConfig
+	labels      map[string]string
+}
+
+// Defaults describes the database settings applied to the databases leaving them unset
+type Defaults struct {
+	Port          uint16 `yaml:"port"`
+	Sslmode       string `yaml:"sslmode"`
+	WorkersNumber int    `yaml:"workers"`
+}
+
+// fileConfig describes the decoded config file
+type fileConfig struct {
+	labels   map[string]string
+	defaults Defaults
+	dbs      map[string]DbConfig
+}
+
+// merge overrides the defaults with the ones set in other
+func (d *Defaults) merge(other Defaults) {
+	if other.Port != 0 {
+		d.Port = other.Port
+	}
+	if other.Sslmode != "" {
+		d.Sslmode = other.Sslmode
+	}
+	if other.WorkersNumber > 0 {
+		d.WorkersNumber = other.WorkersNumber
+	}
+}
+
+// apply sets the defaults to the unset settings of the database
+func (d Defaults) apply(db *DbConfig) {
+	if db.Port == 0 {
+		db.Port = d.Port
+	}
+	if db.Sslmode == "" {
+		db.Sslmode = d.Sslmode
+	}
+	if db.WorkersNumber <= 0 {
+		db.WorkersNumber = d.WorkersNumber
+	}
 }
 
 // ColumnUsage describes column usage
@@ -59,8 +133,24 @@ type VerSQLs []VerSQL
 
 // Metric describes metric
 type Metric struct {
-	Usage       ColumnUsage `yaml:"usage"`
-	Description string      `yaml:"description"`
+	Usage       ColumnUsage         `yaml:"usage"`
+	Description string              `yaml:"description"`
+	Quantiles   map[float64]float64 `yaml:"quantiles"` // Summary objectives: quantile to the absolute error
+	Separator   string              `yaml:"separator"` // Separator of the array elements joined into the label value
+	Buckets     map[float64]string  `yaml:"buckets"`   // Histogram buckets: upper bound to the column of the cumulative count
+	SumColumn   string              `yaml:"sumColumn"` // Column of the sum of the histogram observations
+}
+
+// defaultSeparator describes the separator of the array elements joined into the label value
+const defaultSeparator = ","
+
+// LabelSeparator returns the separator of the array elements joined into the label value, "," by default
+func (m Metric) LabelSeparator() string {
+	if m.Separator == "" {
+		return defaultSeparator
+	}
+
+	return m.Separator
 }
 
 // VerSQL describes PostgreSQL version specific SQL
@@ -72,11 +162,119 @@ type VerSQL struct {
 
 // Query describes query
 type Query struct {
-	Name        string
-	Metrics     Metrics `yaml:"metrics"`
-	VerSQL      VerSQLs `yaml:"query"`
-	NameColumn  string  `yaml:"nameColumn"`
-	ValueColumn string  `yaml:"valueColumn"`
+	Name            string
+	Metrics         Metrics           `yaml:"metrics"`
+	VerSQL          VerSQLs           `yaml:"query"`
+	NameColumn      string            `yaml:"nameColumn"`
+	ValueColumn     string            `yaml:"valueColumn"`
+	ValueColumns    []string          `yaml:"valueColumns"`
+	Enabled         *bool             `yaml:"enabled"`         // Enabled unless explicitly set to false
+	TimestampColumn string            `yaml:"timestampColumn"` // Column with the time of the measurement
+	Args            []interface{}     `yaml:"args"`            // Values of the query parameters: $1, $2, ...
+	MaxRows         int               `yaml:"maxRows"`         // Maximum number of rows to process, unlimited if 0
+	DivisorColumn   string            `yaml:"divisorColumn"`   // Column the metric values are divided by
+	NameTemplate    string            `yaml:"nameTemplate"`    // Template of the metric name over the row columns
+	Critical        bool              `yaml:"critical"`        // Failure of the query fails the scrape of the database
+	Transaction     string            `yaml:"transaction"`     // Name of the transaction the query shares with the others, seeing the same snapshot
+	Labels          map[string]string `yaml:"labels"`          // Labels added to the metrics of the query
+
+	sqlCache *sqlCache
+	nameTmpl *template.Template
+}
+
+// MetricName executes the name template over the row columns
+func (q *Query) MetricName(columns map[string]string) (string, error) {
+	var buf strings.Builder
+	if err := q.nameTmpl.Execute(&buf, columns); err != nil {
+		return "", fmt.Errorf("could not execute name template: %v", err)
+	}
+
+	return buf.String(), nil
+}
+
+// sqlCache keeps the query variants chosen per postgresql version
+type sqlCache struct {
+	sync.RWMutex
+	sqls map[PgVersion]VerSQL
+}
+
+// SQL returns query for the requested postgresql version, the choice is memoized
+func (q *Query) SQL(version PgVersion) string {
+	return q.Variant(version).SQL
+}
+
+// Variant returns the query variant for the requested postgresql version, the choice is memoized.
+// SQL of the variant is empty if there is no variant for the version
+func (q *Query) Variant(version PgVersion) VerSQL {
+	if q.sqlCache == nil {
+		return q.VerSQL.Variant(version)
+	}
+
+	q.sqlCache.RLock()
+	variant, ok := q.sqlCache.sqls[version]
+	q.sqlCache.RUnlock()
+	if ok {
+		return variant
+	}
+
+	variant = q.VerSQL.Variant(version)
+	q.sqlCache.Lock()
+	q.sqlCache.sqls[version] = variant
+	q.sqlCache.Unlock()
+
+	return variant
+}
+
+// Columns returns the sorted result columns the query refers to: the metric columns or, with the nameColumn or
+// nameTemplate, the label and value columns, along with the name, divisor, timestamp and histogram columns.
+// The "INFO" metrics are not columns
+func (q *Query) Columns() []string {
+	seen := make(map[string]struct{})
+	add := func(columns ...string) {
+		for _, column := range columns {
+			if column != "" {
+				seen[column] = struct{}{}
+			}
+		}
+	}
+
+	byName := q.NameColumn != "" || q.NameTemplate != ""
+	for name, metric := range q.Metrics {
+		if metric.Usage == Label || (!byName && metric.Usage != Info) {
+			add(name)
+		}
+		if metric.Usage == Histogram {
+			add(metric.SumColumn)
+			for _, column := range metric.Buckets {
+				add(column)
+			}
+		}
+	}
+	if byName {
+		add(q.NameColumn, q.ValueColumn)
+		add(q.ValueColumns...)
+	}
+	add(q.DivisorColumn, q.TimestampColumn)
+
+	columns := make([]string, 0, len(seen))
+	for column := range seen {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	return columns
+}
+
+// rawYAML keeps the yaml node to be unmarshalled later
+type rawYAML struct {
+	unmarshal func(interface{}) error
+}
+
+// UnmarshalYAML unmarshals the yaml
+func (r *rawYAML) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	r.unmarshal = unmarshal
+
+	return nil
 }
 
 // UnmarshalYAML unmarshals the yaml
@@ -91,12 +289,18 @@ func (v *VerSQLs) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 	switch val := val.(type) {
 	case map[interface{}]interface{}:
-		for k, v := range val {
-			minPg, maxPg := parseVersionRange(fmt.Sprintf("%v", k))
+		// keep the variants in the order of definition
+		variants := make(yaml.MapSlice, 0, len(val))
+		if err := unmarshal(&variants); err != nil {
+			return fmt.Errorf("could not unmarshal: %v", err)
+		}
+
+		for _, variant := range variants {
+			minPg, maxPg := parseVersionRange(fmt.Sprintf("%v", variant.Key))
 			res = append(res, VerSQL{
 				MinVer: minPg,
 				MaxVer: maxPg,
-				SQL:    v.(string),
+				SQL:    variant.Value.(string),
 			})
 		}
 	case interface{}:
@@ -117,9 +321,15 @@ func (c *ColumnUsage) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
-	cu, ok := columnUsageMapping[value]
+	cu, ok := columnUsageMapping[strings.ToUpper(strings.TrimSpace(value))]
 	if !ok {
-		return fmt.Errorf("unknown usage: %v", value)
+		usages := make([]string, 0, len(columnUsageMapping))
+		for usage := range columnUsageMapping {
+			usages = append(usages, usage)
+		}
+		sort.Strings(usages)
+
+		return fmt.Errorf("unknown usage: %q, valid usages are: %s", value, strings.Join(usages, ", "))
 	}
 
 	*c = cu
@@ -168,20 +378,48 @@ func (v PgVersion) String() string {
 	return fmt.Sprintf("%d.%d.%d", v/10000, (v/100)%100, v%100)
 }
 
-// Query returns query for the requested postgresql version
+// Bound returns string representation of the bound of the query variant version range, empty if unlimited
+func (v PgVersion) Bound() string {
+	if v == 0 {
+		return ""
+	}
+
+	return v.String()
+}
+
+// Query returns query for the requested postgresql version.
+// If the version is unknown, the variant without upper bound or the first defined one is returned
 func (v VerSQLs) Query(version PgVersion) string {
-	if version == NoVersion ||
-		(len(v) == 1 && v[0].MaxVer == PgVersion(0) && v[0].MinVer == PgVersion(0)) {
-		return v[0].SQL
+	return v.Variant(version).SQL
+}
+
+// Variant returns the query variant for the requested postgresql version, chosen as by Query
+func (v VerSQLs) Variant(version PgVersion) VerSQL {
+	if len(v) == 0 {
+		return VerSQL{}
+	}
+
+	if len(v) == 1 && v[0].MaxVer == PgVersion(0) && v[0].MinVer == PgVersion(0) {
+		return v[0]
+	}
+
+	if version == NoVersion {
+		for _, query := range v {
+			if query.MaxVer == 0 {
+				return query
+			}
+		}
+
+		return v[0]
 	}
 
 	for _, query := range v {
 		if (version >= query.MinVer || query.MinVer == 0) && (version < query.MaxVer || query.MaxVer == 0) {
-			return query.SQL
+			return query
 		}
 	}
 
-	return ""
+	return VerSQL{}
 }
 
 func ParseVersion(str string) PgVersion {
@@ -210,6 +448,16 @@ func ParseVersion(str string) PgVersion {
 	return PgVersion(ver)
 }
 
+// ParseCockroachVersion parses the CockroachDB version() string, e.g. "CockroachDB CCL v23.1.2 (...)"
+func ParseCockroachVersion(str string) PgVersion {
+	matches := cockroachVerRegex.FindStringSubmatch(str)
+	if matches == nil {
+		return NoVersion
+	}
+
+	return ParseVersion(matches[1])
+}
+
 func parseVersionRange(str string) (PgVersion, PgVersion) {
 	var min, max PgVersion
 	if str == "" {
@@ -232,57 +480,318 @@ func parseVersionRange(str string) (PgVersion, PgVersion) {
 	return min, max
 }
 
-// New creates new config
-func New(filename string) *Config {
+// New creates new config out of one or several config files
+func New(filenames ...string) *Config {
 	cfg := Config{
-		configFile: filename,
-		dbs:        make(map[string]DbConfig, 0),
+		configFiles: filenames,
+		stdin:       os.Stdin,
+		dbs:         make(map[string]DbConfig, 0),
 	}
 
 	return &cfg
 }
 
-// Load loads the config
-func (c *Config) Load() error {
-	dbs := make(map[string]DbConfig)
-	configDir, _ := path.Split(c.configFile)
+// SetStdin sets the source of the "-" config file and the directory its query files are resolved relative to,
+// the working directory is used if baseDir is empty
+func (c *Config) SetStdin(r io.Reader, baseDir string) {
+	c.stdin = r
+	c.baseDir = baseDir
+}
+
+// SetContinueOnError makes Load skip the query files which could not be loaded, logging a warning
+func (c *Config) SetContinueOnError(skipBroken bool) {
+	c.skipBroken = skipBroken
+}
+
+// SetMaxDefaultWorkers makes Load derive the workers number of the databases leaving it unset from the
+// number of CPUs, capped by maxWorkers; with maxWorkers below 1 such databases use a single worker
+func (c *Config) SetMaxDefaultWorkers(maxWorkers int) {
+	c.maxWorkers = maxWorkers
+}
+
+// SetDbFilter makes Load keep only the databases whose names match include and do not match exclude,
+// e.g. to split the databases of a shared config between several exporters. Nil regexps are not applied
+func (c *Config) SetDbFilter(include, exclude *regexp.Regexp) {
+	c.includeDbs = include
+	c.excludeDbs = exclude
+}
 
-	fp, err := os.Open(c.configFile)
+// SetMaxConnections makes Load check that the connections kept open between the scrapes of all the
+// databases stay below maxConns, the limit of the connections to all the databases; 0 means unlimited
+func (c *Config) SetMaxConnections(maxConns int) {
+	c.maxConns = maxConns
+}
+
+// defaultWorkers returns the workers number of the databases leaving it unset
+func (c *Config) defaultWorkers() int {
+	if c.maxWorkers < 1 {
+		return 1
+	}
+	if n := runtime.NumCPU(); n < c.maxWorkers {
+		return n
+	}
+
+	return c.maxWorkers
+}
+
+// loadFile decodes the config file, query files are resolved relative to its directory
+func (c *Config) loadFile(filename string) (*fileConfig, error) {
+	if filename == Stdin {
+		return decodeConfig(c.stdin, "stdin", c.baseDir)
+	}
+
+	fp, err := os.Open(filename)
 	if err != nil {
-		return fmt.Errorf("could not open file: %v", err)
+		return nil, fmt.Errorf("could not open file: %v", err)
 	}
 	defer fp.Close()
 
-	decoder := yaml.NewDecoder(fp)
-	if err := decoder.Decode(&dbs); err != nil {
-		return fmt.Errorf("could not decode: %v", err)
+	configDir, _ := path.Split(filename)
+
+	return decodeConfig(fp, filename, configDir)
+}
+
+// decodeConfig decodes the config, query files are resolved relative to the configDir
+func decodeConfig(r io.Reader, filename, configDir string) (*fileConfig, error) {
+	res := &fileConfig{dbs: make(map[string]DbConfig)}
+
+	if isTOML(filename) {
+		var err error
+		if r, err = tomlToYAML(r); err != nil {
+			return nil, fmt.Errorf("could not decode %q: %v", filename, err)
+		}
+	}
+
+	values := make(map[string]rawYAML)
+	decoder := yaml.NewDecoder(r)
+	if err := decoder.Decode(&values); err != nil {
+		return nil, fmt.Errorf("could not decode %q: %v", filename, err)
 	}
 
-	for dbName, db := range dbs {
-		if len(db.QueryFiles) == 0 {
+	for key, value := range values {
+		switch key {
+		case globalLabelsKey:
+			if err := value.unmarshal(&res.labels); err != nil {
+				return nil, fmt.Errorf("could not decode global labels of %q: %v", filename, err)
+			}
 			continue
+		case defaultsKey:
+			if err := value.unmarshal(&res.defaults); err != nil {
+				return nil, fmt.Errorf("could not decode defaults of %q: %v", filename, err)
+			}
+			continue
+		}
+
+		var db DbConfig
+		if err := value.unmarshal(&db); err != nil {
+			return nil, fmt.Errorf("could not decode %q of %q: %v", key, filename, err)
 		}
 
 		for i, query := range db.QueryFiles {
-			dbs[dbName].QueryFiles[i] = path.Join(configDir, query)
+			if isURL(query) || path.IsAbs(query) {
+				continue
+			}
+			db.QueryFiles[i] = path.Join(configDir, query)
 		}
+		res.dbs[key] = db
+	}
 
+	return res, nil
+}
+
+// Load loads the config files, merging their databases, global labels and defaults
+func (c *Config) Load() error {
+	labels := make(map[string]string)
+	dbs := make(map[string]DbConfig)
+	var defaults Defaults
+
+	for _, configFile := range c.configFiles {
+		file, err := c.loadFile(configFile)
+		if err != nil {
+			return err
+		}
+
+		for name, value := range file.labels {
+			labels[name] = value
+		}
+		defaults.merge(file.defaults)
+
+		for dbName, db := range file.dbs {
+			if _, ok := dbs[dbName]; ok {
+				return fmt.Errorf("database %q of %q is already defined in another config file", dbName, configFile)
+			}
+			dbs[dbName] = db
+		}
+	}
+
+	for dbName := range dbs {
+		if (c.includeDbs != nil && !c.includeDbs.MatchString(dbName)) || (c.excludeDbs != nil && c.excludeDbs.MatchString(dbName)) {
+			delete(dbs, dbName)
+		}
+	}
+
+	// the databases without the query files are set up as well, as they are still connected to, e.g. by the probe
+	for dbName := range dbs {
 		d := dbs[dbName]
-		if err := d.LoadQueries(); err != nil {
+		defaults.apply(&d)
+		switch d.Engine {
+		case "", EnginePostgres, EngineCockroach:
+		default:
+			return fmt.Errorf("unknown engine %q of %q", d.Engine, dbName)
+		}
+		switch d.TargetSession {
+		case "", SessionAny, SessionReadWrite, SessionReadOnly, SessionPrimary, SessionStandby:
+		default:
+			return fmt.Errorf("unknown targetSessionAttrs %q of %q", d.TargetSession, dbName)
+		}
+		for name := range d.RuntimeParams {
+			for _, owned := range ownedRuntimeParams {
+				if strings.EqualFold(name, owned) {
+					return fmt.Errorf("runtimeParams of %q can not set %s, it is set by the exporter", dbName, owned)
+				}
+			}
+		}
+		if d.Version != "" {
+			if !d.IsNotPg {
+				return fmt.Errorf("version of %q can be set on the isNotPg destination only", dbName)
+			}
+			if ParseVersion(d.Version) == NoVersion {
+				return fmt.Errorf("invalid version %q of %q", d.Version, dbName)
+			}
+		}
+		if d.Role != "" && d.IsNotPg {
+			return fmt.Errorf("role of %q can not be set on the isNotPg destination", dbName)
+		}
+		switch d.PoolMode {
+		case "", PoolModeSession, PoolModeTransaction:
+		default:
+			return fmt.Errorf("unknown poolMode %q of %q", d.PoolMode, dbName)
+		}
+		if d.Tunnel != "" {
+			if _, _, err := d.TunnelAddr(); err != nil {
+				return fmt.Errorf("%v of %q", err, dbName)
+			}
+		}
+
+		if err := d.LoadQueries(c.skipBroken); err != nil {
 			return fmt.Errorf("could not load db queries: %v", err)
 		}
 		if d.WorkersNumber <= 0 {
-			d.WorkersNumber = 1
+			d.WorkersNumber = c.defaultWorkers()
+		}
+		if d.MinIdleConns < 0 || d.MaxConns < 0 {
+			return fmt.Errorf("negative minIdleConns or maxConns of %q", dbName)
+		}
+		if d.MaxConns > 0 {
+			if d.MinIdleConns > d.MaxConns {
+				return fmt.Errorf("minIdleConns %d of %q exceeds maxConns %d", d.MinIdleConns, dbName, d.MaxConns)
+			}
+			if d.WorkersNumber > d.MaxConns {
+				d.WorkersNumber = d.MaxConns
+			}
 		}
 
 		dbs[dbName] = d
 	}
 
+	if c.maxConns > 0 {
+		idle := 0
+		for _, d := range dbs {
+			idle += d.MinIdleConns
+		}
+		if idle >= c.maxConns {
+			return fmt.Errorf("total minIdleConns %d of the databases must be below the connections limit %d", idle, c.maxConns)
+		}
+	}
+
 	c.dbs = dbs
+	c.labels = labels
 
 	return nil
 }
 
+// Lint checks the metric names of the queries against the prometheus naming conventions,
+// returning the warnings. The counters lacking "_total" are not reported if counterSuffix appends it
+func (c *Config) Lint(counterSuffix bool) []string {
+	warnings := make([]string, 0)
+	seen := make(map[string]struct{})
+	for _, db := range c.dbs {
+		for _, query := range db.queries {
+			if _, ok := seen[query.Name]; ok {
+				continue
+			}
+			seen[query.Name] = struct{}{}
+
+			for name, metric := range query.Metrics {
+				if metric.Usage == Counter && !counterSuffix && !strings.HasSuffix(name, "_total") {
+					warnings = append(warnings, fmt.Sprintf("%q of %q: counter name should end with \"_total\"", name, query.Name))
+				}
+				for _, suffix := range millisecondSuffixes {
+					if strings.HasSuffix(name, suffix) {
+						warnings = append(warnings, fmt.Sprintf("%q of %q: use seconds as the time unit", name, query.Name))
+						break
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(warnings)
+
+	return warnings
+}
+
+// dumpedDb describes the database in the config dump
+type dumpedDb struct {
+	DbConfig `yaml:",inline"`
+	Queries  []string `yaml:"queries"`
+}
+
+// Dump returns the loaded config in yaml with the passwords and the credentials of the query file URLs redacted,
+// the databases carry the defaults applied and the names of their queries
+func (c *Config) Dump() ([]byte, error) {
+	dbs := make(map[string]dumpedDb, len(c.dbs))
+	for dbName, db := range c.dbs {
+		if db.Password != "" {
+			db.Password = redacted
+		}
+		queryFiles := make([]string, 0, len(db.QueryFiles))
+		for _, queryFile := range db.QueryFiles {
+			queryFiles = append(queryFiles, redactURL(queryFile))
+		}
+		db.QueryFiles = queryFiles
+
+		queries := make([]string, 0, len(db.queries))
+		for _, query := range db.queries {
+			queries = append(queries, query.Name)
+		}
+		sort.Strings(queries)
+
+		dbs[dbName] = dumpedDb{DbConfig: db, Queries: queries}
+	}
+
+	return yaml.Marshal(struct {
+		Labels    map[string]string   `yaml:"labels,omitempty"`
+		Databases map[string]dumpedDb `yaml:"databases"`
+	}{
+		Labels:    c.labels,
+		Databases: dbs,
+	})
+}
+
+// redactURL strips the user info from the query file URL, the local paths are returned as is
+func redactURL(queryFile string) string {
+	if !isURL(queryFile) {
+		return queryFile
+	}
+	u, err := url.Parse(queryFile)
+	if err != nil {
+		return redacted
+	}
+	u.User = nil
+
+	return u.String()
+}
+
 // DbList returns list of the databases
 func (c *Config) DbList() []string {
 	dbs := make([]string, 0)
@@ -297,3 +806,20 @@ func (c *Config) DbList() []string {
 func (c *Config) Db(dbName string) DbConfig {
 	return c.dbs[dbName]
 }
+
+// Labels returns global labels, added to the metrics of all the databases
+func (c *Config) Labels() map[string]string {
+	return c.labels
+}
+
+// Files returns the paths of the config files, leaving out the one read from stdin
+func (c *Config) Files() []string {
+	files := make([]string, 0, len(c.configFiles))
+	for _, filename := range c.configFiles {
+		if filename != Stdin {
+			files = append(files, filename)
+		}
+	}
+
+	return files
+}
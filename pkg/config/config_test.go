@@ -0,0 +1,1042 @@
+package config
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// loadString loads the config read from the string, the query files are resolved relative to testdata
+func loadString(cfgYAML string, setup ...func(*Config)) (*Config, error) {
+	cfg := New(Stdin)
+	cfg.SetStdin(strings.NewReader(cfgYAML), "testdata")
+	for _, fn := range setup {
+		fn(cfg)
+	}
+
+	return cfg, cfg.Load()
+}
+
+func TestMaxConnectionsCapsIdleConns(t *testing.T) {
+	cfgYAML := `
+a: {host: a, minIdleConns: 2}
+b: {host: b, minIdleConns: 1}
+`
+	tests := []struct {
+		maxConns int
+		wantErr  bool
+	}{
+		{0, false},
+		{4, false},
+		{3, true},
+		{1, true},
+	}
+
+	for _, tt := range tests {
+		_, err := loadString(cfgYAML, func(c *Config) { c.SetMaxConnections(tt.maxConns) })
+		if (err != nil) != tt.wantErr {
+			t.Errorf("max connections %d: expected error %v, got %v", tt.maxConns, tt.wantErr, err)
+		}
+	}
+}
+
+func TestPgVersionBound(t *testing.T) {
+	tests := []struct {
+		version PgVersion
+		want    string
+	}{
+		{0, ""},
+		{90600, "9.6.0"},
+		{140002, "14.0.2"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.version.Bound(); got != tt.want {
+			t.Errorf("PgVersion(%d).Bound() = %q, want %q", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestTunnelAddr(t *testing.T) {
+	tests := []struct {
+		tunnel   string
+		wantUser string
+		wantAddr string
+		wantErr  bool
+	}{
+		{"monitoring@bastion", "monitoring", "bastion:22", false},
+		{"monitoring@bastion:2222", "monitoring", "bastion:2222", false},
+		{"monitoring@[::1]:2222", "monitoring", "[::1]:2222", false},
+		{"user@corp@bastion", "user@corp", "bastion:22", false},
+		{"bastion", "", "", true},
+		{"@bastion", "", "", true},
+		{"monitoring@", "", "", true},
+	}
+
+	for _, tt := range tests {
+		d := DbConfig{Tunnel: tt.tunnel}
+		user, addr, err := d.TunnelAddr()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: expected error %v, got %v", tt.tunnel, tt.wantErr, err)
+			continue
+		}
+		if user != tt.wantUser || addr != tt.wantAddr {
+			t.Errorf("%q: expected %q, %q, got %q, %q", tt.tunnel, tt.wantUser, tt.wantAddr, user, addr)
+		}
+	}
+}
+
+func TestTunnelValidation(t *testing.T) {
+	tests := []struct {
+		cfgYAML string
+		wantErr bool
+	}{
+		{`a: {host: a, queryFiles: [queries.yaml], tunnel: monitoring@bastion}`, false},
+		{`a: {host: a, queryFiles: [queries.yaml], tunnel: bastion}`, true},
+	}
+
+	for _, tt := range tests {
+		if _, err := loadString(tt.cfgYAML); (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.cfgYAML, tt.wantErr, err)
+		}
+	}
+}
+
+func TestRuntimeParamsValidation(t *testing.T) {
+	tests := []struct {
+		cfgYAML string
+		wantErr bool
+	}{
+		{`a: {host: a, queryFiles: [queries.yaml], runtimeParams: {search_path: public, lock_timeout: 1s}}`, false},
+		{`a: {host: a, queryFiles: [queries.yaml], runtimeParams: {application_name: exporter}}`, true},
+		{`a: {host: a, queryFiles: [queries.yaml], runtimeParams: {client_encoding: LATIN1}}`, true},
+		{`a: {host: a, queryFiles: [queries.yaml], runtimeParams: {Client_Encoding: UTF8}}`, true},
+	}
+
+	for _, tt := range tests {
+		if _, err := loadString(tt.cfgYAML); (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.cfgYAML, tt.wantErr, err)
+		}
+	}
+}
+
+func TestTargetSessionValidation(t *testing.T) {
+	tests := []struct {
+		cfgYAML string
+		wantErr bool
+	}{
+		{`a: {host: a, queryFiles: [queries.yaml]}`, false},
+		{`a: {host: a, queryFiles: [queries.yaml], targetSessionAttrs: standby}`, false},
+		{`a: {host: a, queryFiles: [queries.yaml], targetSessionAttrs: read-write}`, false},
+		{`a: {host: a, queryFiles: [queries.yaml], targetSessionAttrs: replica}`, true},
+	}
+
+	for _, tt := range tests {
+		if _, err := loadString(tt.cfgYAML); (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.cfgYAML, tt.wantErr, err)
+		}
+	}
+}
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		cfgYAML       string
+		counterSuffix bool
+		want          []string
+	}{
+		{`a: {host: a, queryFiles: [queries.yaml]}`, false, []string{}},
+		{
+			`a: {host: a, queryFiles: [lint.yaml]}
+b: {host: b, queryFiles: [lint.yaml]}`,
+			false,
+			[]string{
+				`"duration_ms" of "pg_lint": use seconds as the time unit`,
+				`"rollbacks" of "pg_lint": counter name should end with "_total"`,
+			},
+		},
+		// the suffix is appended to the counter names
+		{
+			`a: {host: a, queryFiles: [lint.yaml]}`,
+			true,
+			[]string{`"duration_ms" of "pg_lint": use seconds as the time unit`},
+		},
+	}
+
+	for _, tt := range tests {
+		cfg, err := loadString(tt.cfgYAML)
+		if err != nil {
+			t.Fatalf("could not load config: %v", err)
+		}
+		if got := cfg.Lint(tt.counterSuffix); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s, counter suffix %v: got %q, want %q", tt.cfgYAML, tt.counterSuffix, got, tt.want)
+		}
+	}
+}
+
+func TestGlobalLabels(t *testing.T) {
+	tests := []struct {
+		cfgYAML string
+		want    map[string]string
+		wantErr bool
+	}{
+		{`a: {host: a}`, map[string]string{}, false},
+		{"labels: {dc: eu, env: prod}\na: {host: a}", map[string]string{"dc": "eu", "env": "prod"}, false},
+		{"labels: [dc, eu]\na: {host: a}", nil, true},
+	}
+
+	for _, tt := range tests {
+		cfg, err := loadString(tt.cfgYAML)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: expected error %v, got %v", tt.cfgYAML, tt.wantErr, err)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if got := cfg.Labels(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: expected labels %v, got %v", tt.cfgYAML, tt.want, got)
+		}
+		if _, ok := cfg.dbs[globalLabelsKey]; ok {
+			t.Errorf("%q: expected the labels not to be taken for a database", tt.cfgYAML)
+		}
+	}
+}
+
+func TestColumnUsageUnmarshal(t *testing.T) {
+	tests := []struct {
+		usage   string
+		want    ColumnUsage
+		wantErr bool
+	}{
+		{"GAUGE", Gauge, false},
+		{"gauge", Gauge, false},
+		{"' Counter '", Counter, false},
+		{"label", Label, false},
+		{"Summary", Summary, false},
+		{"info", Info, false},
+		{"histogram", Histogram, false},
+		{"discard", Discard, false},
+		{"gauges", 0, true},
+		{"''", 0, true},
+	}
+
+	for _, tt := range tests {
+		var got ColumnUsage
+		err := yaml.Unmarshal([]byte(tt.usage), &got)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.usage, tt.wantErr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected usage %v, got %v", tt.usage, tt.want, got)
+		}
+	}
+}
+
+func TestVerSQLsVariant(t *testing.T) {
+	single := VerSQLs{{SQL: "select 1"}}
+	ranged := VerSQLs{
+		{SQL: "select old", MaxVer: 100000},
+		{SQL: "select new", MinVer: 100000},
+	}
+	bounded := VerSQLs{
+		{SQL: "select 9.6", MinVer: 90600, MaxVer: 100000},
+		{SQL: "select 10", MinVer: 100000, MaxVer: 110000},
+	}
+
+	tests := []struct {
+		name    string
+		sqls    VerSQLs
+		version PgVersion
+		want    string
+	}{
+		{"empty", nil, 110000, ""},
+		{"single", single, 110000, "select 1"},
+		{"single without version", single, NoVersion, "select 1"},
+		{"below the bound", ranged, 90600, "select old"},
+		{"at the bound", ranged, 100000, "select new"},
+		{"above the bound", ranged, 140000, "select new"},
+		{"unbounded without version", ranged, NoVersion, "select new"},
+		{"bounded without version", bounded, NoVersion, "select 9.6"},
+		{"out of the ranges", bounded, 90500, ""},
+	}
+
+	for _, tt := range tests {
+		if got := tt.sqls.Variant(tt.version).SQL; got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+		if got := tt.sqls.Query(tt.version); got != tt.want {
+			t.Errorf("%s: expected the query %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		str  string
+		want PgVersion
+	}{
+		{"9.6.3", 90603},
+		{"9.6", 90600},
+		{"10.1", 100001},
+		{"14.2 (Ubuntu 14.2-1.pgdg20.04+1)", 140002},
+		{"16beta1", 160000},
+		{"15rc2", 150000},
+		{"17devel", 170000},
+		{"9.6beta3", 90600},
+		{"9.6.1rc1", 90601},
+		{"14.2 (Ubuntu 14.2-1)", 140002},
+		{"15.1 (Debian 15.1-1.pgdg110+1)", 150001},
+		{"16beta1 (Debian 16~beta1-2.pgdg120+1)", 160000},
+		{"1.21", 12100},
+		{"1.18.0", 11800},
+		{"", NoVersion},
+		{"latest", NoVersion},
+		{"16gamma1", NoVersion},
+		{"v16", NoVersion},
+	}
+
+	for _, tt := range tests {
+		if got := ParseVersion(tt.str); got != tt.want {
+			t.Errorf("ParseVersion(%q) = %d, want %d", tt.str, got, tt.want)
+		}
+	}
+}
+
+func TestNotPgVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+	}{
+		{"1.17", "show pools"},
+		{"1.18", "show pools with the wait time"},
+		{"1.21.0", "show pools with the wait time"},
+		{"", "show pools with the wait time"},
+	}
+
+	for _, tt := range tests {
+		cfg, err := loadString(`a: {host: a, isNotPg: true, version: "` + tt.version + `", queryFiles: [pgbouncer.yaml]}`)
+		if err != nil {
+			t.Fatalf("could not load config: %v", err)
+		}
+		dbConf := cfg.Db("a")
+		version := NoVersion
+		if dbConf.Version != "" {
+			version = ParseVersion(dbConf.Version)
+		}
+		if got := dbConf.Queries()[0].SQL(version); got != tt.want {
+			t.Errorf("version %q: expected %q, got %q", tt.version, tt.want, got)
+		}
+	}
+}
+
+func TestNotPgVersionValidation(t *testing.T) {
+	tests := []struct {
+		cfgYAML string
+		wantErr bool
+	}{
+		{`a: {host: a, isNotPg: true, version: "1.18.0", queryFiles: [pgbouncer.yaml]}`, false},
+		{`a: {host: a, isNotPg: true, queryFiles: [pgbouncer.yaml]}`, false},
+		{`a: {host: a, isNotPg: true, version: "v1.18", queryFiles: [pgbouncer.yaml]}`, true},
+		{`a: {host: a, version: "1.18", queryFiles: [queries.yaml]}`, true},
+	}
+
+	for _, tt := range tests {
+		if _, err := loadString(tt.cfgYAML); (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.cfgYAML, tt.wantErr, err)
+		}
+	}
+}
+
+func TestParseCockroachVersion(t *testing.T) {
+	tests := []struct {
+		str  string
+		want PgVersion
+	}{
+		{"CockroachDB CCL v23.1.2 (x86_64-pc-linux-gnu, built 2023/05/25 16:58:19, go1.19.4)", 230001},
+		{"CockroachDB OSS v21.2", 210002},
+		{"CockroachDB CCL v22.2.0-beta.1 (aarch64-unknown-linux-gnu)", 220002},
+		{"PostgreSQL 14.2 on x86_64-pc-linux-gnu", NoVersion},
+		{"CockroachDB CCL", NoVersion},
+	}
+
+	for _, tt := range tests {
+		if got := ParseCockroachVersion(tt.str); got != tt.want {
+			t.Errorf("ParseCockroachVersion(%q) = %d, want %d", tt.str, got, tt.want)
+		}
+	}
+
+	// the variants are keyed by the cockroachdb versions
+	sqls := VerSQLs{
+		{SQL: "select old", MaxVer: ParseVersion("23.1")},
+		{SQL: "select new", MinVer: ParseVersion("23.1")},
+	}
+	for str, want := range map[string]string{
+		"CockroachDB CCL v22.2.0": "select old",
+		"CockroachDB CCL v23.1.2": "select new",
+	} {
+		if got := sqls.Query(ParseCockroachVersion(str)); got != want {
+			t.Errorf("%q: expected %q, got %q", str, want, got)
+		}
+	}
+}
+
+func TestEngine(t *testing.T) {
+	tests := []struct {
+		engine  string
+		wantErr bool
+	}{
+		{"", false},
+		{EnginePostgres, false},
+		{EngineCockroach, false},
+		{"mysql", true},
+	}
+
+	for _, tt := range tests {
+		_, err := loadString(`a: {host: a, engine: "` + tt.engine + `", queryFiles: [queries.yaml]}`)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("engine %q: expected error %v, got %v", tt.engine, tt.wantErr, err)
+		}
+	}
+}
+
+// writeConfigs writes the config files into the temp dir along with the query file, returning their paths
+func writeConfigs(t *testing.T, files map[string]string) map[string]string {
+	dir := t.TempDir()
+	queries, err := ioutil.ReadFile("testdata/queries.yaml")
+	if err != nil {
+		t.Fatalf("could not read query file: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "queries.yaml"), queries, 0644); err != nil {
+		t.Fatalf("could not write query file: %v", err)
+	}
+
+	paths := make(map[string]string)
+	for name, content := range files {
+		paths[name] = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(paths[name], []byte(content), 0644); err != nil {
+			t.Fatalf("could not write config file: %v", err)
+		}
+	}
+
+	return paths
+}
+
+func TestMergeConfigFiles(t *testing.T) {
+	paths := writeConfigs(t, map[string]string{
+		"a.yaml":   "labels: {team: a, env: prod}\na: {host: a, queryFiles: [queries.yaml]}\n",
+		"b.yaml":   "labels: {team: b}\nb: {host: b, queryFiles: [queries.yaml]}\n",
+		"dup.yaml": "a: {host: other, queryFiles: [queries.yaml]}\n",
+	})
+
+	tests := []struct {
+		files      []string
+		wantDbs    []string
+		wantLabels map[string]string
+		wantErr    bool
+	}{
+		{[]string{"a.yaml"}, []string{"a"}, map[string]string{"team": "a", "env": "prod"}, false},
+		{[]string{"a.yaml", "b.yaml"}, []string{"a", "b"}, map[string]string{"team": "b", "env": "prod"}, false},
+		{[]string{"a.yaml", "dup.yaml"}, nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		var files []string
+		for _, name := range tt.files {
+			files = append(files, paths[name])
+		}
+		cfg := New(files...)
+		err := cfg.Load()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: expected error %v, got %v", tt.files, tt.wantErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		dbs := cfg.DbList()
+		sort.Strings(dbs)
+		if !reflect.DeepEqual(dbs, tt.wantDbs) {
+			t.Errorf("%v: expected databases %v, got %v", tt.files, tt.wantDbs, dbs)
+		}
+		if !reflect.DeepEqual(cfg.Labels(), tt.wantLabels) {
+			t.Errorf("%v: expected labels %v, got %v", tt.files, tt.wantLabels, cfg.Labels())
+		}
+		if query := cfg.Db("a").QueryFiles[0]; query != filepath.Join(filepath.Dir(paths["a.yaml"]), "queries.yaml") {
+			t.Errorf("%v: expected the query file resolved relative to the config file, got %q", tt.files, query)
+		}
+	}
+}
+
+// rangedQuery returns the query of n variants of adjacent version ranges, memoizing the choice if cached
+func rangedQuery(n int, cached bool) *Query {
+	q := &Query{Name: "pg_ranged"}
+	for i := 0; i < n; i++ {
+		q.VerSQL = append(q.VerSQL, VerSQL{
+			SQL:    "select " + strconv.Itoa(i),
+			MinVer: PgVersion(90000 + i*100),
+			MaxVer: PgVersion(90000 + (i+1)*100),
+		})
+	}
+	if cached {
+		q.sqlCache = &sqlCache{sqls: make(map[PgVersion]VerSQL)}
+	}
+
+	return q
+}
+
+func TestQuerySQLCache(t *testing.T) {
+	versions := []PgVersion{NoVersion, 80400, 90000, 90150, 91950, 92000, 140000}
+	cached, uncached := rangedQuery(20, true), rangedQuery(20, false)
+
+	for _, version := range versions {
+		for i := 0; i < 2; i++ {
+			if got, want := cached.SQL(version), uncached.SQL(version); got != want {
+				t.Errorf("version %d, call %d: expected %q, got %q", version, i, want, got)
+			}
+		}
+	}
+	if len(cached.sqlCache.sqls) != len(versions) {
+		t.Errorf("expected the choice of each version memoized, got %d of %d", len(cached.sqlCache.sqls), len(versions))
+	}
+}
+
+func BenchmarkQuerySQL(b *testing.B) {
+	for _, bm := range []struct {
+		name   string
+		cached bool
+	}{
+		{"uncached", false},
+		{"cached", true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			q := rangedQuery(20, bm.cached)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				q.SQL(91950)
+			}
+		})
+	}
+}
+
+func TestLoadStdin(t *testing.T) {
+	tests := []struct {
+		cfgYAML   string
+		baseDir   string
+		wantQuery string
+		wantErr   bool
+	}{
+		{`a: {host: a, queryFiles: [queries.yaml]}`, "testdata", "testdata/queries.yaml", false},
+		{`a: {host: a, queryFiles: [testdata/queries.yaml]}`, "", "testdata/queries.yaml", false},
+		{`a: {host: a, queryFiles: [queries.yaml]}`, "", "", true},
+		{`a: [not a database]`, "testdata", "", true},
+	}
+
+	for _, tt := range tests {
+		cfg := New(Stdin)
+		cfg.SetStdin(strings.NewReader(tt.cfgYAML), tt.baseDir)
+		err := cfg.Load()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s in %q: expected error %v, got %v", tt.cfgYAML, tt.baseDir, tt.wantErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := cfg.Db("a").QueryFiles; !reflect.DeepEqual(got, []string{tt.wantQuery}) {
+			t.Errorf("%s in %q: expected query files %q, got %q", tt.cfgYAML, tt.baseDir, tt.wantQuery, got)
+		}
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	cfgYAML := `
+defaults: {port: 6432, sslmode: require, workers: 3}
+a: {host: a, queryFiles: [queries.yaml]}
+b: {host: b, port: 5433, sslmode: disable, workers: 2, queryFiles: [queries.yaml]}
+c: {host: c}
+`
+	cfg, err := loadString(cfgYAML)
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+
+	tests := []struct {
+		dbName      string
+		wantPort    uint16
+		wantSslmode string
+		wantWorkers int
+	}{
+		{"a", 6432, "require", 3},
+		{"b", 5433, "disable", 2},
+		// the database without the query files gets the defaults too
+		{"c", 6432, "require", 3},
+	}
+
+	for _, tt := range tests {
+		dbConf := cfg.Db(tt.dbName)
+		if dbConf.Port != tt.wantPort || dbConf.Sslmode != tt.wantSslmode || dbConf.Workers() != tt.wantWorkers {
+			t.Errorf("%s: expected port %d, sslmode %q, %d workers, got %d, %q, %d", tt.dbName,
+				tt.wantPort, tt.wantSslmode, tt.wantWorkers, dbConf.Port, dbConf.Sslmode, dbConf.Workers())
+		}
+	}
+
+	// the database without the query files is validated too
+	if _, err := loadString(`a: {host: a, engine: mysql}`); err == nil {
+		t.Error("expected the error of the unknown engine of the database without the query files")
+	}
+}
+
+func TestDefaultWorkers(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfgYAML    string
+		maxWorkers int
+		want       map[string]int
+	}{
+		{
+			"global default",
+			"defaults: {workers: 3}\na: {host: a, queryFiles: [queries.yaml]}\nb: {host: b, workers: 5, queryFiles: [queries.yaml]}\n",
+			4,
+			map[string]int{"a": 3, "b": 5},
+		},
+		{
+			"single worker without the cap",
+			"a: {host: a, queryFiles: [queries.yaml]}\n",
+			0,
+			map[string]int{"a": 1},
+		},
+		{
+			"capped by the connections",
+			"defaults: {workers: 8}\na: {host: a, maxConns: 2, queryFiles: [queries.yaml]}\n",
+			4,
+			map[string]int{"a": 2},
+		},
+	}
+
+	for _, tt := range tests {
+		cfg, err := loadString(tt.cfgYAML, func(c *Config) { c.SetMaxDefaultWorkers(tt.maxWorkers) })
+		if err != nil {
+			t.Fatalf("%s: could not load config: %v", tt.name, err)
+		}
+		for dbName, want := range tt.want {
+			dbConf := cfg.Db(dbName)
+			if got := dbConf.Workers(); got != want {
+				t.Errorf("%s: expected %d workers of %q, got %d", tt.name, want, dbName, got)
+			}
+		}
+	}
+}
+
+func TestDefaultWorkersFromCPUs(t *testing.T) {
+	cpus := runtime.NumCPU()
+	two := 2
+	if cpus < two {
+		two = cpus
+	}
+	tests := []struct {
+		maxWorkers int
+		want       int
+	}{
+		{-1, 1},
+		{0, 1},
+		{1, 1},
+		{2, two},
+		{cpus, cpus},
+		{cpus + 4, cpus},
+	}
+
+	for _, tt := range tests {
+		cfg, err := loadString(`a: {host: a, queryFiles: [queries.yaml]}`, func(c *Config) { c.SetMaxDefaultWorkers(tt.maxWorkers) })
+		if err != nil {
+			t.Fatalf("cap %d: could not load config: %v", tt.maxWorkers, err)
+		}
+		dbConf := cfg.Db("a")
+		if got := dbConf.Workers(); got != tt.want {
+			t.Errorf("cap %d of %d CPUs: expected %d workers, got %d", tt.maxWorkers, cpus, tt.want, got)
+		}
+	}
+}
+
+func TestContinueOnError(t *testing.T) {
+	tests := []struct {
+		queryFiles  string
+		skipBroken  bool
+		wantQueries []string
+		wantErr     bool
+	}{
+		{"[queries.yaml, missing.yaml]", false, nil, true},
+		{"[queries.yaml, missing.yaml]", true, []string{"pg_test"}, false},
+		{"[broken.yaml, queries.yaml, pgbouncer.yaml]", true, []string{"pg_test", "pgbouncer_pools"}, false},
+		{"[missing.yaml, broken.yaml]", true, nil, false},
+	}
+
+	for _, tt := range tests {
+		cfg, err := loadString(`a: {host: a, queryFiles: `+tt.queryFiles+`}`, func(c *Config) { c.SetContinueOnError(tt.skipBroken) })
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s, skip %v: expected error %v, got %v", tt.queryFiles, tt.skipBroken, tt.wantErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		dbConf := cfg.Db("a")
+		var got []string
+		for _, query := range dbConf.Queries() {
+			got = append(got, query.Name)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.wantQueries) {
+			t.Errorf("%s, skip %v: expected queries %v, got %v", tt.queryFiles, tt.skipBroken, tt.wantQueries, got)
+		}
+	}
+}
+
+func TestPoolModeValidation(t *testing.T) {
+	tests := []struct {
+		cfgYAML string
+		wantErr bool
+	}{
+		{`a: {host: a, queryFiles: [queries.yaml]}`, false},
+		{`a: {host: a, queryFiles: [queries.yaml], poolMode: session}`, false},
+		{`a: {host: a, queryFiles: [queries.yaml], poolMode: transaction}`, false},
+		{`a: {host: a, queryFiles: [queries.yaml], poolMode: statement}`, true},
+	}
+
+	for _, tt := range tests {
+		if _, err := loadString(tt.cfgYAML); (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.cfgYAML, tt.wantErr, err)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	tests := []struct {
+		filenames []string
+		want      []string
+	}{
+		{[]string{"a.yaml"}, []string{"a.yaml"}},
+		{[]string{"a.yaml", "conf.d/b.yaml"}, []string{"a.yaml", "conf.d/b.yaml"}},
+		// stdin has no modification time to report
+		{[]string{Stdin, "a.yaml"}, []string{"a.yaml"}},
+		{[]string{Stdin}, []string{}},
+	}
+
+	for _, tt := range tests {
+		if got := New(tt.filenames...).Files(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: expected %v, got %v", tt.filenames, tt.want, got)
+		}
+	}
+}
+
+func TestQueryColumns(t *testing.T) {
+	tests := []struct {
+		name  string
+		query Query
+		want  []string
+	}{
+		{
+			"metrics",
+			Query{Metrics: Metrics{"datname": {Usage: Label}, "size": {Usage: Gauge}, "oid": {Usage: Discard}}},
+			[]string{"datname", "oid", "size"},
+		},
+		{
+			"info",
+			Query{Metrics: Metrics{"version": {Usage: Label}, "pg_build": {Usage: Info}}},
+			[]string{"version"},
+		},
+		{
+			"histogram",
+			Query{Metrics: Metrics{"count": {Usage: Histogram, SumColumn: "sum", Buckets: map[float64]string{0.1: "le_100ms", 1: "le_1s"}}}},
+			[]string{"count", "le_100ms", "le_1s", "sum"},
+		},
+		{
+			// the metrics named by the name column are not columns, the labels still are
+			"name column",
+			Query{
+				NameColumn:   "name",
+				ValueColumns: []string{"calls", "total_time"},
+				Metrics:      Metrics{"calls": {Usage: Counter}, "insert_calls": {Usage: Counter}, "queryid": {Usage: Label}},
+			},
+			[]string{"calls", "name", "queryid", "total_time"},
+		},
+		{
+			"name template",
+			Query{NameTemplate: "{{.schema}}_size", ValueColumn: "size", Metrics: Metrics{"public_size": {Usage: Gauge}}},
+			[]string{"size"},
+		},
+		{
+			"divisor and timestamp",
+			Query{DivisorColumn: "total", TimestampColumn: "ts", Metrics: Metrics{"part": {Usage: Gauge}}},
+			[]string{"part", "total", "ts"},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.query.Columns(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestRoleValidation(t *testing.T) {
+	tests := []struct {
+		cfgYAML string
+		wantErr bool
+	}{
+		{`a: {host: a, queryFiles: [queries.yaml], role: pg_monitor}`, false},
+		{`a: {host: a, queryFiles: [queries.yaml], isNotPg: true}`, false},
+		{`a: {host: a, queryFiles: [queries.yaml], role: pg_monitor, isNotPg: true}`, true},
+	}
+
+	for _, tt := range tests {
+		if _, err := loadString(tt.cfgYAML); (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.cfgYAML, tt.wantErr, err)
+		}
+	}
+}
+
+func TestDbFilter(t *testing.T) {
+	const cfgYAML = `
+orders-1: {host: a, queryFiles: [queries.yaml]}
+orders-2: {host: b, queryFiles: [queries.yaml]}
+users: {host: c, queryFiles: [queries.yaml]}
+`
+	tests := []struct {
+		name    string
+		include string
+		exclude string
+		want    []string
+	}{
+		{"no filter", "", "", []string{"orders-1", "orders-2", "users"}},
+		{"include", "orders-.*", "", []string{"orders-1", "orders-2"}},
+		{"exclude", "", "orders-2", []string{"orders-1", "users"}},
+		{"include and exclude", "orders-.*", "orders-1", []string{"orders-2"}},
+		// the regexps match the whole name
+		{"partial name", "orders", "", []string{}},
+		{"nothing left", "", ".*", []string{}},
+	}
+
+	for _, tt := range tests {
+		cfg, err := loadString(cfgYAML, func(c *Config) {
+			var include, exclude *regexp.Regexp
+			if tt.include != "" {
+				include = regexp.MustCompile("^(?:" + tt.include + ")$")
+			}
+			if tt.exclude != "" {
+				exclude = regexp.MustCompile("^(?:" + tt.exclude + ")$")
+			}
+			c.SetDbFilter(include, exclude)
+		})
+		if err != nil {
+			t.Errorf("%s: could not load config: %v", tt.name, err)
+			continue
+		}
+
+		got := cfg.DbList()
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected databases %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestDumpQueryFileURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "testdata/queries.yaml")
+	}))
+	defer srv.Close()
+
+	queryURL := strings.Replace(srv.URL, "://", "://monitoring:secret@", 1) + "/queries.yaml"
+	cfg, err := loadString(`a: {host: a, queryFiles: [queries.yaml, "` + queryURL + `"]}`)
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+	dump, err := cfg.Dump()
+	if err != nil {
+		t.Fatalf("could not dump config: %v", err)
+	}
+
+	if strings.Contains(string(dump), "secret") || strings.Contains(string(dump), "monitoring@") {
+		t.Errorf("expected the URL credentials redacted:\n%s", dump)
+	}
+	for _, want := range []string{"- testdata/queries.yaml", "- " + srv.URL + "/queries.yaml"} {
+		if !strings.Contains(string(dump), want) {
+			t.Errorf("expected %q in the dump:\n%s", want, dump)
+		}
+	}
+	// the loaded config keeps the credentials
+	if got := cfg.Db("a").QueryFiles[1]; got != queryURL {
+		t.Errorf("expected query file %q kept, got %q", queryURL, got)
+	}
+}
+
+func TestQueryFileURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/queries.yaml":
+			http.ServeFile(w, r, "testdata/queries.yaml")
+		case "/broken.yaml":
+			w.Write([]byte("pg_test: ["))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		path        string
+		wantQueries []string
+		wantErr     bool
+	}{
+		{"/queries.yaml", []string{"pg_test"}, false},
+		{"/missing.yaml", nil, true},
+		{"/broken.yaml", nil, true},
+	}
+
+	for _, tt := range tests {
+		url := srv.URL + tt.path
+		cfg, err := loadString(`a: {host: a, queryFiles: ["` + url + `"]}`)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.path, tt.wantErr, err)
+		}
+		if err != nil {
+			if !strings.Contains(err.Error(), url) {
+				t.Errorf("%s: expected the URL in the error, got %v", tt.path, err)
+			}
+			continue
+		}
+
+		var names []string
+		dbConf := cfg.Db("a")
+		for _, query := range dbConf.Queries() {
+			names = append(names, query.Name)
+		}
+		if !reflect.DeepEqual(names, tt.wantQueries) {
+			t.Errorf("%s: expected queries %v, got %v", tt.path, tt.wantQueries, names)
+		}
+	}
+}
+
+func TestTimestampColumnSummary(t *testing.T) {
+	tests := []struct {
+		name    string
+		usage   string
+		wantErr bool
+	}{
+		{"gauge", "GAUGE", false},
+		{"counter", "COUNTER", false},
+		{"summary", "SUMMARY", true},
+	}
+
+	for _, tt := range tests {
+		paths := writeConfigs(t, map[string]string{"timestamp.yaml": `
+pg_archiver:
+    query: select archived_count, last_archived_time from pg_stat_archiver
+    timestampColumn: last_archived_time
+    metrics:
+      - archived_count: {usage: ` + tt.usage + `, description: archived files}
+`})
+		_, err := loadQueryFile(paths["timestamp.yaml"])
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
+
+func TestMultiDocumentQueryFile(t *testing.T) {
+	const first = `
+# activity of the connections
+pg_a:
+    query: select a
+    metrics:
+      - a: {usage: GAUGE, description: a}
+`
+	tests := []struct {
+		name        string
+		content     string
+		wantQueries []string
+		wantErr     bool
+	}{
+		{"single", first, []string{"pg_a"}, false},
+		{"two documents", first + `---
+# size of the databases
+pg_b:
+    query: select b
+    metrics:
+      - b: {usage: GAUGE, description: b}
+`, []string{"pg_a", "pg_b"}, false},
+		{"empty document", first + "---\n", []string{"pg_a"}, false},
+		{"duplicate", first + "---\n" + first, nil, true},
+	}
+
+	for _, tt := range tests {
+		paths := writeConfigs(t, map[string]string{"multi.yaml": tt.content})
+		queries, err := loadQueryFile(paths["multi.yaml"])
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+
+		var names []string
+		for _, query := range queries {
+			names = append(names, query.Name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, tt.wantQueries) {
+			t.Errorf("%s: expected queries %v, got %v", tt.name, tt.wantQueries, names)
+		}
+	}
+}
+
+func TestNameTemplate(t *testing.T) {
+	tests := []struct {
+		template    string
+		columns     map[string]string
+		want        string
+		wantErr     bool
+		wantLoadErr bool
+	}{
+		{"{{.schema}}_{{.table}}", map[string]string{"schema": "public", "table": "users"}, "public_users", false, false},
+		{"{{.schema}}_{{.table}}", map[string]string{"schema": "public"}, "", true, false},
+		{"{{.schema", nil, "", false, true},
+	}
+
+	for _, tt := range tests {
+		paths := writeConfigs(t, map[string]string{"template.yaml": `
+pg_tables:
+    query: select tables
+    nameTemplate: "` + tt.template + `"
+    valueColumns: [size]
+    metrics:
+      - size: {usage: GAUGE, description: size of the table}
+`})
+		queries, err := loadQueryFile(paths["template.yaml"])
+		if (err != nil) != tt.wantLoadErr {
+			t.Errorf("%q: expected load error %v, got %v", tt.template, tt.wantLoadErr, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		got, err := queries[0].MetricName(tt.columns)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q over %v: expected error %v, got %v", tt.template, tt.columns, tt.wantErr, err)
+		}
+		if got != tt.want {
+			t.Errorf("%q over %v: expected %q, got %q", tt.template, tt.columns, tt.want, got)
+		}
+	}
+}
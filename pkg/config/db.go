@@ -2,7 +2,13 @@ package config
 
 import (
 	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
 	"os"
+	"strings"
+	"text/template"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -11,6 +17,38 @@ import (
 // applicationName describes postgresql application name
 const applicationName = "pg_prometheus_exporter"
 
+// queryFileTimeout describes the timeout of fetching the query file by URL
+const queryFileTimeout = 10 * time.Second
+
+var queryFileClient = &http.Client{Timeout: queryFileTimeout}
+
+// ownedRuntimeParams describes the session parameters set by the exporter which can not be set in runtimeParams
+var ownedRuntimeParams = []string{"application_name", "client_encoding"}
+
+// Database engines
+const (
+	EnginePostgres  = "postgresql"
+	EngineCockroach = "cockroach" // Version is taken from version() instead of server_version
+)
+
+// Session attributes required from the server, as of the libpq target_session_attrs
+const (
+	SessionAny       = "any"
+	SessionReadWrite = "read-write"
+	SessionReadOnly  = "read-only"
+	SessionPrimary   = "primary"
+	SessionStandby   = "standby"
+)
+
+// Pool modes of the pooler the database is connected through
+const (
+	PoolModeSession     = "session"
+	PoolModeTransaction = "transaction"
+)
+
+// defaultTunnelPort describes the port of the SSH tunnel host if the tunnel leaves it unset
+const defaultTunnelPort = "22"
+
 // DbConfigInterface describes DbConfig methods
 type DbConfigInterface interface {
 	Workers() int
@@ -31,38 +69,138 @@ type DbConfig struct {
 	QueryFiles       []string          `yaml:"queryFiles"`
 	LabelsMap        map[string]string `yaml:"labels"`
 	WorkersNumber    int               `yaml:"workers"`
+	MinIdleConns     int               `yaml:"minIdleConns"` // Number of the connections kept open between the scrapes
+	MaxConns         int               `yaml:"maxConns"`     // Maximum number of the connections of the scrape, caps the workers
 	StatementTimeout time.Duration     `yaml:"statementTimeout"`
 	IsNotPg          bool              `yaml:"isNotPg"`
+	Version          string            `yaml:"version"` // Version of the isNotPg destination, used to pick query variants
+	Engine           string            `yaml:"engine"`
+	TargetSession    string            `yaml:"targetSessionAttrs"` // Connect only to the server of the kind, e.g. "standby"
+	HealthQuery      string            `yaml:"healthQuery"`        // Query checking the isNotPg destination on connect, e.g. "show version"
+	Tunnel           string            `yaml:"tunnel"`             // SSH host to tunnel the connection through, e.g. "user@bastion:22"
+	TunnelKeyFile    string            `yaml:"tunnelKeyFile"`      // Private key of the SSH tunnel, the keys of the ssh client, e.g. of ssh-agent, are used if empty
+	TunnelKnownHosts string            `yaml:"tunnelKnownHosts"`   // known_hosts file checking the tunnel host key, the ones of the ssh client if empty
+	Role             string            `yaml:"role"`               // Role set after connecting, e.g. the one granted pg_monitor
+	PoolMode         string            `yaml:"poolMode"`           // Pool mode of the pooler in between, "transaction" sets the statement timeout per query
+	RuntimeParams    map[string]string `yaml:"runtimeParams"`      // Session parameters set on connect, e.g. search_path
 
 	queries []Query
 }
 
-// LoadQueries loads the queries from the QueryFiles
-func (d *DbConfig) LoadQueries() error {
+// LoadQueries loads the queries from the QueryFiles,
+// with skipBroken the files which could not be loaded are skipped with a warning
+func (d *DbConfig) LoadQueries(skipBroken bool) error {
 	queries := make([]Query, 0)
 
 	for _, queryFile := range d.QueryFiles {
+		fileQueries, err := loadQueryFile(queryFile)
+		if err != nil {
+			if skipBroken {
+				log.Printf("skipping query file %q: %v", queryFile, err)
+				continue
+			}
+			return err
+		}
+
+		queries = append(queries, fileQueries...)
+	}
+	d.queries = queries
+
+	return nil
+}
+
+// isURL checks if the query file is to be fetched over http(s)
+func isURL(queryFile string) bool {
+	return strings.HasPrefix(queryFile, "http://") || strings.HasPrefix(queryFile, "https://")
+}
+
+// openQueryFile opens the query file, either local or fetched by URL
+func openQueryFile(queryFile string) (io.ReadCloser, error) {
+	if !isURL(queryFile) {
 		fp, err := os.Open(queryFile)
 		if err != nil {
-			return fmt.Errorf("could not open file: %v", err)
+			return nil, fmt.Errorf("could not open file: %v", err)
+		}
+		return fp, nil
+	}
+
+	resp, err := queryFileClient.Get(queryFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch %q: %v", queryFile, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("could not fetch %q: unexpected status %q", queryFile, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// loadQueryFile loads the enabled queries of the file, which can consist of several yaml documents
+func loadQueryFile(queryFile string) ([]Query, error) {
+	fp, err := openQueryFile(queryFile)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var r io.Reader = fp
+	if isTOML(queryFile) {
+		if r, err = tomlToYAML(fp); err != nil {
+			return nil, fmt.Errorf("could not decode %q: %v", queryFile, err)
 		}
+	}
 
-		fileQueries := make(map[string]Query)
-		decoder := yaml.NewDecoder(fp)
-		if err := decoder.Decode(&fileQueries); err != nil {
-			fp.Close()
-			return fmt.Errorf("could not decode %q: %v", queryFile, err)
+	fileQueries := make(map[string]Query)
+	decoder := yaml.NewDecoder(r)
+	for {
+		docQueries := make(map[string]Query)
+		if err := decoder.Decode(&docQueries); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("could not decode %q: %v", queryFile, err)
 		}
 
-		for name, query := range fileQueries {
-			query.Name = name
-			queries = append(queries, query)
+		for name, query := range docQueries {
+			if _, ok := fileQueries[name]; ok {
+				return nil, fmt.Errorf("query %q is defined more than once in %q", name, queryFile)
+			}
+			fileQueries[name] = query
 		}
-		fp.Close()
 	}
-	d.queries = queries
 
-	return nil
+	queries := make([]Query, 0, len(fileQueries))
+	for name, query := range fileQueries {
+		if query.Enabled != nil && !*query.Enabled {
+			continue
+		}
+		for metricName, metric := range query.Metrics {
+			for quantile := range metric.Quantiles {
+				if quantile < 0 || quantile > 1 {
+					return nil, fmt.Errorf("invalid quantile %v of %q in %q of %q", quantile, metricName, name, queryFile)
+				}
+			}
+			if metric.Usage == Histogram && (len(metric.Buckets) == 0 || metric.SumColumn == "") {
+				return nil, fmt.Errorf("histogram %q in %q of %q requires buckets and sumColumn", metricName, name, queryFile)
+			}
+			// the summary observes the values of several rows, which can carry different timestamps
+			if metric.Usage == Summary && query.TimestampColumn != "" {
+				return nil, fmt.Errorf("summary %q in %q of %q can not be used with timestampColumn", metricName, name, queryFile)
+			}
+		}
+		if query.NameTemplate != "" {
+			tmpl, err := template.New(name).Option("missingkey=error").Parse(query.NameTemplate)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse name template of %q in %q: %v", name, queryFile, err)
+			}
+			query.nameTmpl = tmpl
+		}
+		query.Name = name
+		query.sqlCache = &sqlCache{sqls: make(map[PgVersion]VerSQL)}
+		queries = append(queries, query)
+	}
+
+	return queries, nil
 }
 
 // InstanceName returns instance name
@@ -88,3 +226,17 @@ func (d *DbConfig) Labels() map[string]string {
 func (d *DbConfig) ApplicationName() string {
 	return applicationName
 }
+
+// TunnelAddr returns the user and the host:port of the SSH tunnel, the port is 22 if unset
+func (d *DbConfig) TunnelAddr() (string, string, error) {
+	i := strings.LastIndex(d.Tunnel, "@")
+	if i <= 0 || i == len(d.Tunnel)-1 {
+		return "", "", fmt.Errorf("invalid tunnel %q, expected user@host[:port]", d.Tunnel)
+	}
+	user, addr := d.Tunnel[:i], d.Tunnel[i+1:]
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultTunnelPort)
+	}
+
+	return user, addr, nil
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// tomlExt describes the extension of the config and query files in the TOML format
+const tomlExt = ".toml"
+
+// numericKeyRegex matches the TOML keys to be decoded as numbers
+var numericKeyRegex = regexp.MustCompile(`^-?\d+(?:\.\d+)?$`)
+
+// numericKeyTables describes the tables whose keys are numbers: the summary quantiles and the histogram buckets.
+// The other keys are kept as strings, e.g. the version "9.10" of the query variants, which is not 9.1
+var numericKeyTables = map[string]bool{"quantiles": true, "buckets": true}
+
+// isTOML reports whether the file is in the TOML format, judging by its extension
+func isTOML(filename string) bool {
+	return strings.EqualFold(path.Ext(filename), tomlExt)
+}
+
+// tomlToYAML converts the TOML document to YAML, so that it is decoded the same way as the YAML files.
+// The tables are not ordered in TOML, so the query variants are taken in the sorted order of their version ranges
+func tomlToYAML(r io.Reader) (io.Reader, error) {
+	var values map[string]interface{}
+	if _, err := toml.DecodeReader(r, &values); err != nil {
+		return nil, err
+	}
+
+	data, err := yaml.Marshal(convertTOMLValue(values, false))
+	if err != nil {
+		return nil, fmt.Errorf("could not convert to yaml: %v", err)
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// convertTOMLValue converts the TOML tables to the YAML maps, with numericKeys the numeric keys of the table
+// are converted to numbers
+func convertTOMLValue(value interface{}, numericKeys bool) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		res := make(map[interface{}]interface{}, len(value))
+		for key, val := range value {
+			if numericKeys && numericKeyRegex.MatchString(key) {
+				if num, err := strconv.ParseFloat(key, 64); err == nil {
+					res[num] = convertTOMLValue(val, false)
+					continue
+				}
+			}
+			res[key] = convertTOMLValue(val, numericKeyTables[key])
+		}
+		return res
+	case []map[string]interface{}:
+		res := make([]interface{}, 0, len(value))
+		for _, val := range value {
+			res = append(res, convertTOMLValue(val, false))
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, 0, len(value))
+		for _, val := range value {
+			res = append(res, convertTOMLValue(val, false))
+		}
+		return res
+	}
+
+	return value
+}
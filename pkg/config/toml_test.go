@@ -0,0 +1,82 @@
+package config
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadTOMLQueryFile(t *testing.T) {
+	queries, err := loadQueryFile(filepath.Join("testdata", "variants.toml"))
+	if err != nil {
+		t.Fatalf("could not load query file: %v", err)
+	}
+	if len(queries) != 1 {
+		t.Fatalf("expected 1 query, got %d", len(queries))
+	}
+	query := queries[0]
+
+	wantVariants := map[string]VerSQL{
+		"select 1": {SQL: "select 1", MinVer: 91000, MaxVer: 91000},
+		"select 2": {SQL: "select 2", MinVer: 110000},
+	}
+	for _, variant := range query.VerSQL {
+		if want, ok := wantVariants[variant.SQL]; !ok || variant != want {
+			t.Errorf("unexpected variant %+v, want %+v", variant, want)
+		}
+	}
+	if len(query.VerSQL) != len(wantVariants) {
+		t.Errorf("expected %d variants, got %d", len(wantVariants), len(query.VerSQL))
+	}
+
+	tests := []struct {
+		metric string
+		got    interface{}
+		want   interface{}
+	}{
+		{"value", query.Metrics["value"].Quantiles, map[float64]float64{0.5: 0.05, 0.9: 0.01}},
+		{"latency", query.Metrics["latency"].Buckets, map[float64]string{0.1: "le_0_1", 1: "le_1"}},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("metric %q: got %v, want %v", tt.metric, tt.got, tt.want)
+		}
+	}
+}
+
+func TestConvertTOMLValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{
+			name:  "version keys are kept",
+			value: map[string]interface{}{"9.10": "select 1", "10-": "select 2"},
+			want:  map[interface{}]interface{}{"9.10": "select 1", "10-": "select 2"},
+		},
+		{
+			name:  "quantile keys are numbers",
+			value: map[string]interface{}{"quantiles": map[string]interface{}{"0.5": 0.05}},
+			want:  map[interface{}]interface{}{"quantiles": map[interface{}]interface{}{0.5: 0.05}},
+		},
+		{
+			name:  "bucket keys are numbers",
+			value: map[string]interface{}{"buckets": map[string]interface{}{"1": "le_1", "+Inf": "le_inf"}},
+			want:  map[interface{}]interface{}{"buckets": map[interface{}]interface{}{1.0: "le_1", "+Inf": "le_inf"}},
+		},
+		{
+			name:  "nested tables of the arrays",
+			value: []map[string]interface{}{{"value": map[string]interface{}{"buckets": map[string]interface{}{"0.1": "b"}}}},
+			want: []interface{}{map[interface{}]interface{}{
+				"value": map[interface{}]interface{}{"buckets": map[interface{}]interface{}{0.1: "b"}},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := convertTOMLValue(tt.value, false); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"net"
 	"strconv"
 	"strings"
 	"time"
@@ -18,21 +19,37 @@ import (
 //Interface describes Db methods
 type Interface interface {
 	SetStatementTimeout(time.Duration) error
-	Exec(string) ([]map[string]interface{}, error)
+	StatementTimeout() (time.Duration, error)
+	Exec(string, ...interface{}) ([]map[string]interface{}, error)
+	ExecFunc(string, func(map[string]interface{}) error, ...interface{}) error
+	Prepare(string) error
+	Begin() error
+	Commit() error
 	PgVersion() config.PgVersion
+	IsAlive() bool
+	SetContext(context.Context)
 	Close() error
 }
 
 const queryCanceled = "57014"
 
-// ErrQueryTimeout describes statement timeout error
-var ErrQueryTimeout = errors.New("canceled due to statement timeout")
+var (
+	// ErrQueryTimeout describes statement timeout error
+	ErrQueryTimeout = errors.New("canceled due to statement timeout")
+	// ErrScrapeTimeout describes the error of the query canceled due to the scrape timeout
+	ErrScrapeTimeout = errors.New("canceled due to scrape timeout")
+)
 
 // Db describes database
 type Db struct {
 	ctx     context.Context
 	version config.PgVersion
 	db      *pgx.Conn
+
+	txPooling    bool          // Whether the connection goes through the pooler in the transaction mode
+	localTimeout time.Duration // Statement timeout set in each transaction in the transaction pooling mode
+	localRole    string        // Role set in each transaction in the transaction pooling mode
+	inTx         bool          // Whether the transaction started by Begin is running
 }
 
 // New creates new instance of database connection
@@ -45,21 +62,51 @@ func New(ctx context.Context, dbConfig config.DbConfig) (*Db, error) {
 		Database:             dbConfig.Dbname,
 		User:                 dbConfig.User,
 		Password:             dbConfig.Password,
-		RuntimeParams:        map[string]string{"application_name": dbConfig.ApplicationName(), "client_encoding": "UTF8"},
+		RuntimeParams:        make(map[string]string, len(dbConfig.RuntimeParams)+2),
 		PreferSimpleProtocol: true,
 	}
 
+	for name, value := range dbConfig.RuntimeParams {
+		cfg.RuntimeParams[name] = value
+	}
+	// the params owned by the exporter are not overridden, pgx runs the simple protocol queries with UTF8 only
+	cfg.RuntimeParams["application_name"] = dbConfig.ApplicationName()
+	cfg.RuntimeParams["client_encoding"] = "UTF8"
+
+	dial := directDialer()
+	if dbConfig.Tunnel != "" {
+		sshDial, err := sshDialer(dbConfig)
+		if err != nil {
+			return nil, fmt.Errorf("could not set up tunnel: %v", err)
+		}
+		dial = sshDial
+	}
+
+	// the connection and the session setup are bounded by the scrape timeout and connectTimeout
+	dialCtx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+	var netConn net.Conn
+	cfg.Dial = contextDialer(dialCtx, dial, &netConn)
+
 	if dbConfig.IsNotPg {
 		cfg.CustomConnInfo = func(_ *pgx.Conn) (*pgtype.ConnInfo, error) {
 			connInfo := pgtype.NewConnInfo()
+			// the types used in the SHOW commands output of pgbouncer and odyssey
 			connInfo.InitializeDataTypes(map[string]pgtype.OID{
-				"int2":    pgtype.Int2OID,
-				"int4":    pgtype.Int4OID,
-				"int8":    pgtype.Int8OID,
-				"name":    pgtype.NameOID,
-				"oid":     pgtype.OIDOID,
-				"text":    pgtype.TextOID,
-				"varchar": pgtype.VarcharOID,
+				"bool":        pgtype.BoolOID,
+				"bytea":       pgtype.ByteaOID,
+				"float4":      pgtype.Float4OID,
+				"float8":      pgtype.Float8OID,
+				"int2":        pgtype.Int2OID,
+				"int4":        pgtype.Int4OID,
+				"int8":        pgtype.Int8OID,
+				"name":        pgtype.NameOID,
+				"numeric":     pgtype.NumericOID,
+				"oid":         pgtype.OIDOID,
+				"text":        pgtype.TextOID,
+				"timestamp":   pgtype.TimestampOID,
+				"timestamptz": pgtype.TimestamptzOID,
+				"varchar":     pgtype.VarcharOID,
 			})
 
 			return connInfo, nil
@@ -70,40 +117,173 @@ func New(ctx context.Context, dbConfig config.DbConfig) (*Db, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not init db: %v", err)
 	}
+	dbConn.ConnInfo.RegisterDataType(pgtype.DataType{Value: &numeric{}, Name: "numeric", OID: pgtype.NumericOID})
+	dbConn.ConnInfo.RegisterDataType(pgtype.DataType{Value: &money{}, Name: "money", OID: moneyOID})
 
-	if ver, ok := dbConn.RuntimeParams["server_version"]; ok && !dbConfig.IsNotPg {
+	version = config.NoVersion
+	if dbConfig.IsNotPg {
+		if dbConfig.Version != "" {
+			version = config.ParseVersion(dbConfig.Version)
+		}
+	} else if dbConfig.Engine == config.EngineCockroach {
+		var ver string
+		if err := dbConn.QueryRow("select version()").Scan(&ver); err != nil {
+			dbConn.Close()
+			return nil, fmt.Errorf("could not get cockroachdb version: %v", err)
+		}
+		version = config.ParseCockroachVersion(ver)
+	} else if ver, err := serverVersionNum(dbConn); err == nil {
+		version = ver
+	} else if ver, ok := dbConn.RuntimeParams["server_version"]; ok {
 		version = config.ParseVersion(ver)
-	} else {
-		version = config.NoVersion
+	}
+
+	if dbConfig.IsNotPg && dbConfig.HealthQuery != "" {
+		if _, err := dbConn.Exec(dbConfig.HealthQuery); err != nil {
+			dbConn.Close()
+			return nil, fmt.Errorf("health query failed: %v", err)
+		}
 	}
 
 	if !dbConfig.IsNotPg {
 		if err := dbConn.Ping(context.Background()); err != nil {
+			dbConn.Close()
 			return nil, fmt.Errorf("could not ping db: %v", err)
 		}
+
+		if err := checkTargetSession(dbConn, dbConfig.TargetSession); err != nil {
+			dbConn.Close()
+			return nil, err
+		}
+	}
+
+	d := &Db{
+		ctx:       ctx,
+		db:        dbConn,
+		version:   version,
+		txPooling: dbConfig.PoolMode == config.PoolModeTransaction,
+	}
+
+	// the session role would leak to the other clients of the pooler in the transaction mode
+	if d.txPooling {
+		d.localRole = dbConfig.Role
+	} else if dbConfig.Role != "" {
+		if _, err := dbConn.Exec("set role " + pgx.Identifier{dbConfig.Role}.Sanitize()); err != nil {
+			dbConn.Close()
+			return nil, fmt.Errorf("could not set role %q: %v", dbConfig.Role, err)
+		}
+	}
+
+	// the queries are bounded by the context set with SetContext from now on
+	if err := netConn.SetDeadline(time.Time{}); err != nil {
+		dbConn.Close()
+		return nil, fmt.Errorf("could not reset connection deadline: %v", err)
+	}
+	if tunnel, ok := netConn.(*sshConn); ok {
+		tunnel.detach()
+	}
+
+	return d, nil
+}
+
+// checkTargetSession checks if the server is of the kind required by the target session attributes
+func checkTargetSession(dbConn *pgx.Conn, attrs string) error {
+	var query, expected string
+	switch attrs {
+	case "", config.SessionAny:
+		return nil
+	case config.SessionReadWrite:
+		query, expected = "show transaction_read_only", "off"
+	case config.SessionReadOnly:
+		query, expected = "show transaction_read_only", "on"
+	case config.SessionPrimary:
+		query, expected = "select pg_is_in_recovery()::text", "false"
+	case config.SessionStandby:
+		query, expected = "select pg_is_in_recovery()::text", "true"
+	default:
+		return fmt.Errorf("unknown target session attributes %q", attrs)
+	}
+
+	var value string
+	if err := dbConn.QueryRow(query).Scan(&value); err != nil {
+		return fmt.Errorf("could not check target session attributes: %v", err)
+	}
+	if value != expected {
+		return fmt.Errorf("server does not match target session attributes %q", attrs)
+	}
+
+	return nil
+}
+
+// serverVersionNum fetches the version of the server in the server_version_num format.
+// The simple protocol is used, so that it works through the proxies not supporting the prepared statements,
+// which are also the ones likely to strip the server_version parameter
+func serverVersionNum(dbConn *pgx.Conn) (config.PgVersion, error) {
+	var ver string
+	err := dbConn.QueryRowEx(context.Background(), "show server_version_num", &pgx.QueryExOptions{SimpleProtocol: true}).Scan(&ver)
+	if err != nil {
+		return config.NoVersion, fmt.Errorf("could not get server_version_num: %v", err)
 	}
 
-	return &Db{
-		ctx:     ctx,
-		db:      dbConn,
-		version: version,
-	}, nil
+	num, err := strconv.Atoi(ver)
+	if err != nil {
+		return config.NoVersion, fmt.Errorf("could not parse server_version_num %q: %v", ver, err)
+	}
+
+	return config.PgVersion(num), nil
 }
 
-// Exec executes the query
-func (d *Db) Exec(query string) ([]map[string]interface{}, error) {
+// Exec executes the query with the args bound to its parameters
+func (d *Db) Exec(query string, args ...interface{}) ([]map[string]interface{}, error) {
 	values := make([]map[string]interface{}, 0)
 
-	rows, err := d.db.QueryEx(d.ctx, query, nil)
+	err := d.ExecFunc(query, func(row map[string]interface{}) error {
+		values = append(values, copyRow(row))
+		return nil
+	}, args...)
 	if err != nil {
-		return nil, fmt.Errorf("query error: %v", err)
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// ExecFunc executes the query and calls fn for each row, the row map is reused between the calls.
+// Error returned by fn stops the query and is returned as is.
+// In the transaction pooling mode the query is run in its own transaction setting the statement timeout and the role
+func (d *Db) ExecFunc(query string, fn func(map[string]interface{}) error, args ...interface{}) error {
+	if (d.localTimeout == 0 && d.localRole == "") || d.inTx {
+		return d.execFunc(query, fn, args...)
+	}
+
+	if err := d.begin("begin"); err != nil {
+		return err
+	}
+	err := d.execFunc(query, fn, args...)
+	// commit of the failed transaction rolls it back
+	if cErr := d.end(); err == nil {
+		err = cErr
+	}
+
+	return err
+}
+
+// execFunc executes the query and calls fn for each row
+func (d *Db) execFunc(query string, fn func(map[string]interface{}) error, args ...interface{}) error {
+	rows, err := d.db.QueryEx(d.ctx, query, nil, args...)
+	if err != nil {
+		if d.ctx.Err() == context.DeadlineExceeded {
+			return ErrScrapeTimeout
+		}
+		return fmt.Errorf("query error: %v", err)
 	}
 	defer rows.Close()
 
 	var columnNames []pgx.FieldDescription
+	row := make(map[string]interface{})
 	for rows.Next() {
 		if rErr := rows.Err(); rErr != nil {
-			return nil, fmt.Errorf("query error: %v", rErr)
+			return fmt.Errorf("query error: %v", rErr)
 		}
 
 		if columnNames == nil {
@@ -111,45 +291,149 @@ func (d *Db) Exec(query string) ([]map[string]interface{}, error) {
 		}
 		rawData, err := rows.Values()
 		if err != nil {
-			return nil, fmt.Errorf("could not fetch values: %v", err)
+			return fmt.Errorf("could not fetch values: %v", err)
 		}
 
-		row := make(map[string]interface{})
 		for colId, column := range columnNames {
 			row[column.Name] = rawData[colId]
 		}
 
-		values = append(values, row)
+		if err := fn(row); err != nil {
+			return err
+		}
 	}
 
 	if rErr := rows.Err(); rErr != nil {
+		if d.ctx.Err() == context.DeadlineExceeded {
+			return ErrScrapeTimeout
+		}
+
 		pgErr, ok := rErr.(pgx.PgError)
 		if !ok {
-			return nil, fmt.Errorf("query error: %v", rErr)
+			return fmt.Errorf("query error: %v", rErr)
 		}
 
 		if pgErr.Code == queryCanceled && strings.Contains(pgErr.Message, "statement timeout") {
-			return nil, ErrQueryTimeout
+			return ErrQueryTimeout
 		}
 
-		return nil, fmt.Errorf("query error: %v - %T", rErr, rErr)
+		return fmt.Errorf("query error: %v - %T", rErr, rErr)
 	}
 
-	return values, nil
+	return nil
+}
+
+// Begin starts the read only transaction, the queries until Commit see the same snapshot
+func (d *Db) Begin() error {
+	if err := d.begin("begin transaction isolation level repeatable read read only"); err != nil {
+		return err
+	}
+	d.inTx = true
+
+	return nil
+}
+
+// Commit ends the transaction started by Begin
+func (d *Db) Commit() error {
+	d.inTx = false
+
+	return d.end()
 }
 
-// SetStatementTimeout sets statement timeout
+// begin starts the transaction, setting the statement timeout and the role in the transaction pooling mode
+func (d *Db) begin(sql string) error {
+	if _, err := d.db.ExecEx(d.ctx, sql, nil); err != nil {
+		return fmt.Errorf("could not begin transaction: %v", err)
+	}
+
+	if d.localRole != "" {
+		if _, err := d.db.ExecEx(d.ctx, "set local role "+pgx.Identifier{d.localRole}.Sanitize(), nil); err != nil {
+			d.end()
+			return fmt.Errorf("could not set role %q: %v", d.localRole, err)
+		}
+	}
+
+	if d.localTimeout > 0 {
+		if _, err := d.db.ExecEx(d.ctx, fmt.Sprintf("set local statement_timeout=%.0f", d.localTimeout.Seconds()*1000), nil); err != nil {
+			d.end()
+			return fmt.Errorf("could not set statement timeout: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// end commits the transaction
+func (d *Db) end() error {
+	if _, err := d.db.ExecEx(d.ctx, "commit", nil); err != nil {
+		return fmt.Errorf("could not commit transaction: %v", err)
+	}
+
+	return nil
+}
+
+// Prepare parses and plans the query without executing it
+func (d *Db) Prepare(query string) error {
+	if _, err := d.db.PrepareEx(d.ctx, "", query, nil); err != nil {
+		return fmt.Errorf("could not prepare query: %v", err)
+	}
+
+	return nil
+}
+
+func copyRow(row map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(row))
+	for column, value := range row {
+		res[column] = value
+	}
+
+	return res
+}
+
+// SetStatementTimeout sets statement timeout. In the transaction pooling mode the session settings
+// do not persist, so the timeout is set in the transaction of each query instead
 func (d *Db) SetStatementTimeout(duration time.Duration) error {
+	if d.txPooling {
+		d.localTimeout = duration
+		return nil
+	}
+
 	_, err := d.db.Exec(fmt.Sprintf("set statement_timeout=%.0f", duration.Seconds()*1000))
 
 	return err
 }
 
+// StatementTimeout returns the statement_timeout in effect on the server, 0 if disabled
+func (d *Db) StatementTimeout() (time.Duration, error) {
+	var ms float64
+	// run as a query, so that the timeout set in the transaction is seen in the transaction pooling mode
+	err := d.ExecFunc("select extract(epoch from current_setting('statement_timeout')::interval) * 1000 as ms", func(row map[string]interface{}) error {
+		val, err := ToFloat64(row["ms"])
+		ms = val
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not get statement timeout: %v", err)
+	}
+
+	return time.Duration(ms * float64(time.Millisecond)), nil
+}
+
 // PgVersion returns Postgresql version
 func (d *Db) PgVersion() config.PgVersion {
 	return d.version
 }
 
+// IsAlive reports whether the connection is usable, it is not after a network error
+func (d *Db) IsAlive() bool {
+	return d.db.IsAlive()
+}
+
+// SetContext sets the context the queries are canceled along with, e.g. of the scrape reusing the connection
+func (d *Db) SetContext(ctx context.Context) {
+	d.ctx = ctx
+}
+
 // Close closes connection to the database
 func (d *Db) Close() error {
 	return d.db.Close()
@@ -162,12 +446,31 @@ func ToFloat64(t interface{}) (float64, error) {
 	case *pgtype.Numeric:
 		err := v.AssignTo(&res)
 		return res, err
+	case *pgtype.Bool, *pgtype.Int2, *pgtype.Int4, *pgtype.Int8, *pgtype.Float4, *pgtype.Float8:
+		// Get returns the go value or nil if the value is null
+		return ToFloat64(v.(pgtype.Value).Get())
+	case pgtype.Bool:
+		return ToFloat64(&v)
+	case pgtype.Int2:
+		return ToFloat64(&v)
+	case pgtype.Int4:
+		return ToFloat64(&v)
+	case pgtype.Int8:
+		return ToFloat64(&v)
+	case pgtype.Float4:
+		return ToFloat64(&v)
+	case pgtype.Float8:
+		return ToFloat64(&v)
 	case int8:
 		return float64(v), nil
+	case int16:
+		return float64(v), nil
 	case int32:
 		return float64(v), nil
 	case int64:
 		return float64(v), nil
+	case float32:
+		return float64(v), nil
 	case float64:
 		return v, nil
 	case time.Time:
@@ -179,14 +482,13 @@ func ToFloat64(t interface{}) (float64, error) {
 		return 0, nil
 	case []byte:
 		// Try and convert to string and then parse to a float64
-		strV := string(v)
-		result, err := strconv.ParseFloat(strV, 64)
+		result, err := parseFloat(string(v))
 		if err != nil {
 			return math.NaN(), fmt.Errorf("could not parse []byte: %v", err)
 		}
 		return result, nil
 	case string:
-		result, err := strconv.ParseFloat(v, 64)
+		result, err := parseFloat(v)
 		if err != nil {
 			return math.NaN(), fmt.Errorf("could not parse string: %v", err)
 		}
@@ -198,10 +500,122 @@ func ToFloat64(t interface{}) (float64, error) {
 	}
 }
 
+// parseFloat parses the textual value: a number, padded as of the char(n) columns, or a boolean.
+// The money amounts are decoded by the money type
+func parseFloat(str string) (float64, error) {
+	result, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err == nil {
+		return result, nil
+	}
+	if b, ok := parseBool(str); ok {
+		return b, nil
+	}
+
+	return 0, err
+}
+
+// parseBool converts the boolean-like strings, e.g. "on"/"off" of the pg_settings, to 1/0
+func parseBool(str string) (float64, bool) {
+	switch strings.ToLower(strings.TrimSpace(str)) {
+	case "on", "yes", "true", "t":
+		return 1, true
+	case "off", "no", "false", "f":
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// ToLabels converts the hstore value to a map of labels, false is returned if the value is not a hstore
+func ToLabels(t interface{}) (map[string]string, bool) {
+	switch v := t.(type) {
+	case map[string]pgtype.Text:
+		res := make(map[string]string, len(v))
+		for key, val := range v {
+			res[key] = val.String
+		}
+		return res, true
+	case map[string]string:
+		return v, true
+	default:
+		return nil, false
+	}
+}
+
+// textString returns the string of the text value, NULL is an empty string
+func textString(v *pgtype.Text) (string, bool) {
+	if v == nil {
+		return "", true
+	}
+
+	switch v.Status {
+	case pgtype.Present:
+		return v.String, true
+	case pgtype.Null:
+		return "", true
+	default:
+		return "", false
+	}
+}
+
+// ToStrings converts the array value to the strings of its elements, false is returned if the value is not an array
+func ToStrings(t interface{}) ([]string, bool) {
+	var elements []pgtype.Value
+	switch v := t.(type) {
+	case []string:
+		return v, true
+	case *pgtype.TextArray:
+		for i := range v.Elements {
+			elements = append(elements, &v.Elements[i])
+		}
+	case *pgtype.VarcharArray:
+		for i := range v.Elements {
+			elements = append(elements, &v.Elements[i])
+		}
+	case *pgtype.BoolArray:
+		for i := range v.Elements {
+			elements = append(elements, &v.Elements[i])
+		}
+	case *pgtype.Int2Array:
+		for i := range v.Elements {
+			elements = append(elements, &v.Elements[i])
+		}
+	case *pgtype.Int4Array:
+		for i := range v.Elements {
+			elements = append(elements, &v.Elements[i])
+		}
+	case *pgtype.Int8Array:
+		for i := range v.Elements {
+			elements = append(elements, &v.Elements[i])
+		}
+	case *pgtype.Float4Array:
+		for i := range v.Elements {
+			elements = append(elements, &v.Elements[i])
+		}
+	case *pgtype.Float8Array:
+		for i := range v.Elements {
+			elements = append(elements, &v.Elements[i])
+		}
+	default:
+		return nil, false
+	}
+
+	res := make([]string, 0, len(elements))
+	for _, element := range elements {
+		str, ok := ToString(element.Get())
+		if !ok {
+			return nil, false
+		}
+		res = append(res, str)
+	}
+
+	return res, true
+}
+
 // ToString converts interface{} value to a string
 func ToString(t interface{}) (string, bool) {
 	switch v := t.(type) {
-	case int, int8, int16, int32, int64, float64, uint, uint8, uint16, uint32, uint64:
+	case int, int8, int16, int32, int64, float32, float64, uint, uint8, uint16, uint32, uint64:
 		return fmt.Sprintf("%v", v), true
 	case time.Time:
 		return fmt.Sprintf("%v", v.Unix()), true
@@ -214,6 +628,22 @@ func ToString(t interface{}) (string, bool) {
 		return string(v), true
 	case string:
 		return v, true
+	case pgtype.Text:
+		return textString(&v)
+	case *pgtype.Text:
+		return textString(v)
+	case pgtype.Varchar:
+		return textString((*pgtype.Text)(&v))
+	case *pgtype.Varchar:
+		return textString((*pgtype.Text)(v))
+	case pgtype.Name:
+		return textString((*pgtype.Text)(&v))
+	case *pgtype.Name:
+		return textString((*pgtype.Text)(v))
+	case pgtype.BPChar:
+		return textString((*pgtype.Text)(&v))
+	case *pgtype.BPChar:
+		return textString((*pgtype.Text)(v))
 	default:
 		if str, ok := v.(fmt.Stringer); ok {
 			return str.String(), true
@@ -0,0 +1,499 @@
+package db
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/jackc/pgx/pgtype"
+
+	"github.com/adjust/postgresql_exporter/pkg/config"
+)
+
+func TestServerVersionNum(t *testing.T) {
+	tests := []struct {
+		name    string
+		rows    [][][]byte
+		want    config.PgVersion
+		wantErr bool
+	}{
+		{"9.6", [][][]byte{{[]byte("90603")}}, 90603, false},
+		{"14", [][][]byte{{[]byte("140002")}}, 140002, false},
+		{"garbage", [][][]byte{{[]byte("14.2")}}, config.NoVersion, true},
+		{"no rows", nil, config.NoVersion, true},
+	}
+
+	for _, tt := range tests {
+		conn := connectPg(t, pgServer(t, map[string]pgResult{
+			"show server_version_num": {columns: []pgproto3.FieldDescription{column("server_version_num", pgtype.TextOID)}, rows: tt.rows},
+		}))
+
+		got, err := serverVersionNum(conn.db)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected version %d, got %d", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestVersionDetection(t *testing.T) {
+	tests := []struct {
+		name          string
+		versionNum    string
+		serverVersion string
+		want          config.PgVersion
+	}{
+		// some proxies strip the server_version parameter
+		{"server_version_num", "140002", "", 140002},
+		{"server_version fallback", "", "13.4", 130004},
+		{"server_version_num preferred", "120007", "13.4", 120007},
+		{"unknown", "", "", config.NoVersion},
+	}
+
+	for _, tt := range tests {
+		results := map[string]pgResult{";": {}}
+		if tt.versionNum != "" {
+			results["show server_version_num"] = pgResult{
+				columns: []pgproto3.FieldDescription{column("server_version_num", pgtype.TextOID)},
+				rows:    [][][]byte{{[]byte(tt.versionNum)}},
+			}
+		}
+		dbConf := pgServer(t, results)
+		dbConf.IsNotPg = false
+		if tt.serverVersion != "" {
+			// reported back by the fake server as the parameter status
+			dbConf.RuntimeParams = map[string]string{"server_version": tt.serverVersion}
+		}
+
+		if got := connectPg(t, dbConf).PgVersion(); got != tt.want {
+			t.Errorf("%s: expected version %d, got %d", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestCheckTargetSession(t *testing.T) {
+	tests := []struct {
+		attrs      string
+		readOnly   string
+		inRecovery string
+		wantErr    bool
+	}{
+		{"", "on", "true", false},
+		{config.SessionAny, "on", "true", false},
+		{config.SessionReadWrite, "off", "false", false},
+		{config.SessionReadWrite, "on", "true", true},
+		{config.SessionReadOnly, "on", "true", false},
+		{config.SessionReadOnly, "off", "false", true},
+		{config.SessionPrimary, "off", "false", false},
+		{config.SessionPrimary, "on", "true", true},
+		{config.SessionStandby, "on", "true", false},
+		{config.SessionStandby, "off", "false", true},
+		{"unknown", "off", "false", true},
+	}
+
+	for _, tt := range tests {
+		conn := connectPg(t, pgServer(t, map[string]pgResult{
+			"show transaction_read_only": {
+				columns: []pgproto3.FieldDescription{column("transaction_read_only", pgtype.TextOID)},
+				rows:    [][][]byte{{[]byte(tt.readOnly)}},
+			},
+			"select pg_is_in_recovery()::text": {
+				columns: []pgproto3.FieldDescription{column("pg_is_in_recovery", pgtype.TextOID)},
+				rows:    [][][]byte{{[]byte(tt.inRecovery)}},
+			},
+		}))
+
+		if err := checkTargetSession(conn.db, tt.attrs); (err != nil) != tt.wantErr {
+			t.Errorf("%q of read only %s, in recovery %s: expected error %v, got %v",
+				tt.attrs, tt.readOnly, tt.inRecovery, tt.wantErr, err)
+		}
+	}
+}
+
+func TestHealthQuery(t *testing.T) {
+	tests := []struct {
+		healthQuery string
+		wantErr     bool
+	}{
+		{"", false},
+		{"show version", false},
+		{"show nothing", true},
+	}
+
+	for _, tt := range tests {
+		dbConf := pgServer(t, map[string]pgResult{
+			"show version": {
+				columns: []pgproto3.FieldDescription{column("version", pgtype.TextOID)},
+				rows:    [][][]byte{{[]byte("PgBouncer 1.18.0")}},
+			},
+		})
+		dbConf.HealthQuery = tt.healthQuery
+
+		conn, err := New(context.Background(), dbConf)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: expected error %v, got %v", tt.healthQuery, tt.wantErr, err)
+		}
+		if err == nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestRuntimeParams(t *testing.T) {
+	tests := []struct {
+		params map[string]string
+		want   map[string]string
+	}{
+		{nil, map[string]string{"application_name": "pg_prometheus_exporter", "client_encoding": "UTF8"}},
+		{
+			map[string]string{"search_path": "monitoring,public", "lock_timeout": "1s"},
+			map[string]string{"search_path": "monitoring,public", "lock_timeout": "1s", "application_name": "pg_prometheus_exporter"},
+		},
+		// the params owned by the exporter are kept
+		{map[string]string{"application_name": "exporter"}, map[string]string{"application_name": "pg_prometheus_exporter"}},
+	}
+
+	for _, tt := range tests {
+		dbConf := pgServer(t, nil)
+		dbConf.RuntimeParams = tt.params
+
+		conn := connectPg(t, dbConf)
+		for name, want := range tt.want {
+			if got := conn.db.RuntimeParams[name]; got != want {
+				t.Errorf("%v: expected %s %q, got %q", tt.params, name, want, got)
+			}
+		}
+	}
+}
+
+func TestStatementTimeout(t *testing.T) {
+	const query = "select extract(epoch from current_setting('statement_timeout')::interval) * 1000 as ms"
+	tests := []struct {
+		ms      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"30000", 30 * time.Second, false},
+		{"1500.5", 1500*time.Millisecond + 500*time.Microsecond, false},
+		{"", 0, true},
+	}
+
+	for _, tt := range tests {
+		results := map[string]pgResult{}
+		if tt.ms != "" {
+			results[query] = pgResult{columns: []pgproto3.FieldDescription{column("ms", pgtype.Float8OID)}, rows: [][][]byte{{[]byte(tt.ms)}}}
+		}
+		conn := connectPg(t, pgServer(t, results))
+
+		got, err := conn.StatementTimeout()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: expected error %v, got %v", tt.ms, tt.wantErr, err)
+		}
+		if got != tt.want {
+			t.Errorf("%q: expected %v, got %v", tt.ms, tt.want, got)
+		}
+	}
+}
+
+func TestTransactionPooling(t *testing.T) {
+	const (
+		begin   = "begin transaction isolation level repeatable read read only"
+		timeout = "set local statement_timeout=1500"
+	)
+	tests := []struct {
+		name     string
+		poolMode string
+		inTx     bool
+		want     []string
+	}{
+		{"session", "", false, []string{"set statement_timeout=1500", "select 1"}},
+		{"explicit session", config.PoolModeSession, false, []string{"set statement_timeout=1500", "select 1"}},
+		{"transaction", config.PoolModeTransaction, false, []string{"begin", timeout, "select 1", "commit"}},
+		{"transaction in begin", config.PoolModeTransaction, true, []string{begin, timeout, "select 1", "select 1", "commit"}},
+	}
+
+	for _, tt := range tests {
+		log := &queryLog{}
+		dbConf := recordingPgServer(t, map[string]pgResult{
+			"select 1":                   {columns: []pgproto3.FieldDescription{column("value", pgtype.Int4OID)}, rows: [][][]byte{{[]byte("1")}}},
+			"set statement_timeout=1500": {},
+			"begin":                      {},
+			begin:                        {},
+			timeout:                      {},
+			"commit":                     {},
+		}, log)
+		dbConf.PoolMode = tt.poolMode
+		conn := connectPg(t, dbConf)
+		connected := len(log.get())
+
+		if err := conn.SetStatementTimeout(1500 * time.Millisecond); err != nil {
+			t.Fatalf("%s: could not set statement timeout: %v", tt.name, err)
+		}
+		// both queries in the transaction run after the single set local
+		queries := 1
+		if tt.inTx {
+			if err := conn.Begin(); err != nil {
+				t.Fatalf("%s: could not begin: %v", tt.name, err)
+			}
+			queries = 2
+		}
+		for i := 0; i < queries; i++ {
+			if _, err := conn.Exec("select 1"); err != nil {
+				t.Fatalf("%s: could not query: %v", tt.name, err)
+			}
+		}
+		if tt.inTx {
+			if err := conn.Commit(); err != nil {
+				t.Fatalf("%s: could not commit: %v", tt.name, err)
+			}
+		}
+
+		if got := log.get()[connected:]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected queries %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestRole(t *testing.T) {
+	const query = "select 1"
+	tests := []struct {
+		name     string
+		role     string
+		poolMode string
+		results  []string
+		want     []string
+		wantErr  string
+	}{
+		{"no role", "", "", nil, []string{query}, ""},
+		{"role", "pg_monitor", "", []string{`set role "pg_monitor"`}, []string{`set role "pg_monitor"`, query}, ""},
+		{"quoted role", `Monitoring"s`, "", []string{`set role "Monitoring""s"`}, []string{`set role "Monitoring""s"`, query}, ""},
+		{"denied", "pg_monitor", "", nil, nil, `could not set role "pg_monitor"`},
+		// the session role would leak to the other clients of the pooler
+		{
+			"transaction pooling", "pg_monitor", config.PoolModeTransaction, []string{"begin", `set local role "pg_monitor"`, "commit"},
+			[]string{"begin", `set local role "pg_monitor"`, query, "commit"}, "",
+		},
+	}
+
+	for _, tt := range tests {
+		results := map[string]pgResult{
+			query: {columns: []pgproto3.FieldDescription{column("value", pgtype.Int4OID)}, rows: [][][]byte{{[]byte("1")}}},
+		}
+		for _, command := range tt.results {
+			results[command] = pgResult{}
+		}
+		log := &queryLog{}
+		dbConf := recordingPgServer(t, results, log)
+		dbConf.Role = tt.role
+		dbConf.PoolMode = tt.poolMode
+
+		conn, err := New(context.Background(), dbConf)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: expected error %q, got %v", tt.name, tt.wantErr, err)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: could not connect: %v", tt.name, err)
+		}
+
+		if _, err := conn.Exec(query); err != nil {
+			t.Errorf("%s: could not query: %v", tt.name, err)
+		}
+		conn.Close()
+		if got := log.get(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected queries %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestParseBool(t *testing.T) {
+	tests := []struct {
+		str    string
+		want   float64
+		wantOk bool
+	}{
+		{"on", 1, true},
+		{"off", 0, true},
+		{"yes", 1, true},
+		{"no", 0, true},
+		{"true", 1, true},
+		{"false", 0, true},
+		{"t", 1, true},
+		{"f", 0, true},
+		{" ON ", 1, true},
+		{"No", 0, true},
+		{"1", 0, false},
+		{"0", 0, false},
+		{"y", 0, false},
+		{"enabled", 0, false},
+		{"", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseBool(tt.str)
+		if ok != tt.wantOk || got != tt.want {
+			t.Errorf("parseBool(%q) = %v, %v, want %v, %v", tt.str, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestToFloat64(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    float64 // NaN is expected as NaN
+		wantErr bool
+	}{
+		{"int8", int8(-8), -8, false},
+		{"int16", int16(16), 16, false},
+		{"int32", int32(32), 32, false},
+		{"int64", int64(1) << 53, 1 << 53, false},
+		{"float32", float32(0.5), 0.5, false},
+		{"float64", 1.25, 1.25, false},
+		{"true", true, 1, false},
+		{"false", false, 0, false},
+		{"time", time.Unix(1577934245, 600000000), 1577934245, false},
+		{"nil", nil, math.NaN(), false},
+		{"pgtype int4", &pgtype.Int4{Int: 4, Status: pgtype.Present}, 4, false},
+		{"pgtype int8 value", pgtype.Int8{Int: 8, Status: pgtype.Present}, 8, false},
+		{"pgtype null", &pgtype.Int8{Status: pgtype.Null}, math.NaN(), false},
+		{"pgtype bool", &pgtype.Bool{Bool: true, Status: pgtype.Present}, 1, false},
+		{"pgtype float8", pgtype.Float8{Float: 2.5, Status: pgtype.Present}, 2.5, false},
+		{"numeric string", "1e3", 1000, false},
+		{"padded string", "12   ", 12, false},
+		{"boolean string", "yes", 1, false},
+		{"numeric bytes", []byte("-0.5"), -0.5, false},
+		{"boolean bytes", []byte("f"), 0, false},
+		{"NaN string", "NaN", math.NaN(), false},
+		{"infinity string", "-Inf", math.Inf(-1), false},
+		{"text", "abc", math.NaN(), true},
+		{"empty string", "", math.NaN(), true},
+		{"unknown type", struct{}{}, math.NaN(), true},
+	}
+
+	for _, tt := range tests {
+		got, err := ToFloat64(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if math.IsNaN(tt.want) != math.IsNaN(got) || (!math.IsNaN(got) && got != tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestToStringTextWrappers(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		want   string
+		wantOk bool
+	}{
+		{"text", pgtype.Text{String: "a", Status: pgtype.Present}, "a", true},
+		{"text pointer", &pgtype.Text{String: "a", Status: pgtype.Present}, "a", true},
+		{"null text", pgtype.Text{Status: pgtype.Null}, "", true},
+		{"undefined text", pgtype.Text{String: "a"}, "", false},
+		{"nil text pointer", (*pgtype.Text)(nil), "", true},
+		{"varchar", pgtype.Varchar{String: "b", Status: pgtype.Present}, "b", true},
+		{"varchar pointer", &pgtype.Varchar{String: "b", Status: pgtype.Present}, "b", true},
+		{"null varchar", &pgtype.Varchar{Status: pgtype.Null}, "", true},
+		{"name", pgtype.Name{String: "pg_class", Status: pgtype.Present}, "pg_class", true},
+		{"name pointer", &pgtype.Name{String: "pg_class", Status: pgtype.Present}, "pg_class", true},
+		{"null name", pgtype.Name{Status: pgtype.Null}, "", true},
+		// the padding of the char(n) is kept
+		{"bpchar", pgtype.BPChar{String: "c  ", Status: pgtype.Present}, "c  ", true},
+		{"bpchar pointer", &pgtype.BPChar{String: "c", Status: pgtype.Present}, "c", true},
+		{"null bpchar", &pgtype.BPChar{Status: pgtype.Null}, "", true},
+	}
+
+	for _, tt := range tests {
+		got, ok := ToString(tt.value)
+		if ok != tt.wantOk || got != tt.want {
+			t.Errorf("%s: expected %q, %v, got %q, %v", tt.name, tt.want, tt.wantOk, got, ok)
+		}
+	}
+}
+
+func TestToStrings(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		want   []string
+		wantOk bool
+	}{
+		{"strings", []string{"a", "b"}, []string{"a", "b"}, true},
+		{"text array", &pgtype.TextArray{Elements: []pgtype.Text{{String: "a", Status: pgtype.Present}}, Status: pgtype.Present}, []string{"a"}, true},
+		{"varchar array", &pgtype.VarcharArray{Elements: []pgtype.Varchar{{String: "a,b", Status: pgtype.Present}}, Status: pgtype.Present}, []string{"a,b"}, true},
+		{"bool array", &pgtype.BoolArray{Elements: []pgtype.Bool{{Bool: true, Status: pgtype.Present}}, Status: pgtype.Present}, []string{"true"}, true},
+		{"int8 array", &pgtype.Int8Array{Elements: []pgtype.Int8{{Int: 1, Status: pgtype.Present}, {Int: -2, Status: pgtype.Present}}, Status: pgtype.Present}, []string{"1", "-2"}, true},
+		{"float8 array", &pgtype.Float8Array{Elements: []pgtype.Float8{{Float: 0.5, Status: pgtype.Present}}, Status: pgtype.Present}, []string{"0.5"}, true},
+		{"empty array", &pgtype.Int4Array{Status: pgtype.Present}, []string{}, true},
+		{"string", "a,b", nil, false},
+		{"nil", nil, nil, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := ToStrings(tt.value)
+		if ok != tt.wantOk || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %q, %v, got %q, %v", tt.name, tt.want, tt.wantOk, got, ok)
+		}
+	}
+}
+
+func TestToFloat64Wrappers(t *testing.T) {
+	tests := []struct {
+		name  string
+		value pgtype.Value
+		null  pgtype.Value
+		want  float64
+	}{
+		{"bool", &pgtype.Bool{Bool: true, Status: pgtype.Present}, &pgtype.Bool{Status: pgtype.Null}, 1},
+		{"bool false", &pgtype.Bool{Bool: false, Status: pgtype.Present}, &pgtype.Bool{Status: pgtype.Null}, 0},
+		{"int2", &pgtype.Int2{Int: -2, Status: pgtype.Present}, &pgtype.Int2{Status: pgtype.Null}, -2},
+		{"int4", &pgtype.Int4{Int: 4, Status: pgtype.Present}, &pgtype.Int4{Status: pgtype.Null}, 4},
+		{"int8", &pgtype.Int8{Int: 1 << 40, Status: pgtype.Present}, &pgtype.Int8{Status: pgtype.Null}, 1 << 40},
+		{"float4", &pgtype.Float4{Float: 0.25, Status: pgtype.Present}, &pgtype.Float4{Status: pgtype.Null}, 0.25},
+		{"float8", &pgtype.Float8{Float: -1.5, Status: pgtype.Present}, &pgtype.Float8{Status: pgtype.Null}, -1.5},
+	}
+
+	for _, tt := range tests {
+		// the wrappers are converted whether passed by pointer or by value
+		values := map[string]interface{}{
+			"pointer": tt.value,
+			"value":   reflect.ValueOf(tt.value).Elem().Interface(),
+		}
+		for kind, value := range values {
+			got, err := ToFloat64(value)
+			if err != nil || got != tt.want {
+				t.Errorf("%s %s: expected %v, got %v, %v", tt.name, kind, tt.want, got, err)
+			}
+		}
+
+		nulls := map[string]interface{}{
+			"pointer": tt.null,
+			"value":   reflect.ValueOf(tt.null).Elem().Interface(),
+		}
+		for kind, value := range nulls {
+			got, err := ToFloat64(value)
+			if err != nil || !math.IsNaN(got) {
+				t.Errorf("%s null %s: expected NaN, got %v, %v", tt.name, kind, got, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Package dbtest provides a fake database connection to test the collector without postgresql
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/adjust/postgresql_exporter/pkg/config"
+	"github.com/adjust/postgresql_exporter/pkg/db"
+)
+
+// ErrClosed is returned by the queries on the closed connection
+var ErrClosed = errors.New("connection is closed")
+
+// Conn is a fake database connection returning the scripted rows and errors of the queries
+type Conn struct {
+	sync.Mutex
+	Version config.PgVersion                    // Version returned by PgVersion
+	Rows    map[string][]map[string]interface{} // Rows returned by the queries
+	Errors  map[string]error                    // Errors returned by the queries, take precedence over the rows
+	Dead    bool                                // Whether the connection is reported dead by IsAlive
+
+	StatementTimeoutErr error         // Error returned by SetStatementTimeout
+	CloseErr            error         // Error returned by Close, the connection is closed anyway
+	Delay               time.Duration // Duration each query takes, cut short by the context set with SetContext
+
+	ctx              context.Context
+	executed         []string
+	args             map[string][]interface{}
+	statementTimeout time.Duration
+	closed           bool
+}
+
+var _ db.Interface = (*Conn)(nil)
+
+// New creates the fake connection to the database of the version
+func New(version config.PgVersion) *Conn {
+	return &Conn{
+		Version: version,
+		Rows:    make(map[string][]map[string]interface{}),
+		Errors:  make(map[string]error),
+		args:    make(map[string][]interface{}),
+	}
+}
+
+// SetRows sets the rows returned by the query
+func (c *Conn) SetRows(query string, rows ...map[string]interface{}) *Conn {
+	c.Lock()
+	defer c.Unlock()
+
+	c.Rows[query] = rows
+	return c
+}
+
+// SetError sets the error returned by the query
+func (c *Conn) SetError(query string, err error) *Conn {
+	c.Lock()
+	defer c.Unlock()
+
+	c.Errors[query] = err
+	return c
+}
+
+// Executed returns the queries executed or prepared on the connection, in order
+func (c *Conn) Executed() []string {
+	c.Lock()
+	defer c.Unlock()
+
+	return append([]string{}, c.executed...)
+}
+
+// Args returns the parameters the query was last executed with
+func (c *Conn) Args(query string) []interface{} {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.args[query]
+}
+
+// StatementTimeout returns the statement timeout set on the connection
+func (c *Conn) StatementTimeout() (time.Duration, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.statementTimeout, nil
+}
+
+// Closed reports whether the connection was closed
+func (c *Conn) Closed() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.closed
+}
+
+// SetStatementTimeout records the statement timeout, unless StatementTimeoutErr is set
+func (c *Conn) SetStatementTimeout(duration time.Duration) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.StatementTimeoutErr != nil {
+		return c.StatementTimeoutErr
+	}
+	c.statementTimeout = duration
+	return nil
+}
+
+// Exec returns the rows of the query
+func (c *Conn) Exec(query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := c.result(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// ExecFunc calls fn for each row of the query, error returned by fn stops the query and is returned as is
+func (c *Conn) ExecFunc(query string, fn func(map[string]interface{}) error, args ...interface{}) error {
+	rows, err := c.result(query, args...)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Begin records the start of the transaction as the "begin" query
+func (c *Conn) Begin() error {
+	_, err := c.result("begin")
+
+	return err
+}
+
+// Commit records the end of the transaction as the "commit" query
+func (c *Conn) Commit() error {
+	_, err := c.result("commit")
+
+	return err
+}
+
+// Prepare returns the error of the query
+func (c *Conn) Prepare(query string) error {
+	_, err := c.result(query)
+
+	return err
+}
+
+// PgVersion returns the version of the database
+func (c *Conn) PgVersion() config.PgVersion {
+	return c.Version
+}
+
+// IsAlive reports whether the connection is usable
+func (c *Conn) IsAlive() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return !c.Dead && !c.closed
+}
+
+// SetContext sets the context the query delays are canceled along with
+func (c *Conn) SetContext(ctx context.Context) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.ctx = ctx
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.closed = true
+	return c.CloseErr
+}
+
+// result records the query and its parameters and returns its rows or error after the delay,
+// db.ErrScrapeTimeout if the context is done first. The delay runs unlocked, so that the concurrent
+// queries overlap as on the real connections
+func (c *Conn) result(query string, args ...interface{}) ([]map[string]interface{}, error) {
+	c.Lock()
+	c.executed = append(c.executed, query)
+	c.args[query] = args
+	delay := c.Delay
+	var done <-chan struct{}
+	if c.ctx != nil {
+		done = c.ctx.Done()
+	}
+	c.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return nil, db.ErrScrapeTimeout
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if err, ok := c.Errors[query]; ok {
+		return nil, err
+	}
+
+	return c.Rows[query], nil
+}
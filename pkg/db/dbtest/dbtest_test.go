@@ -0,0 +1,101 @@
+package dbtest
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func ExampleConn() {
+	conn := New(140002).
+		SetRows("select 1 as one", map[string]interface{}{"one": int64(1)}).
+		SetError("select broken", errors.New("syntax error"))
+
+	rows, err := conn.Exec("select 1 as one")
+	fmt.Println(rows, err)
+	_, err = conn.Exec("select broken")
+	fmt.Println(err)
+	fmt.Println(conn.Executed())
+	// Output:
+	// [map[one:1]] <nil>
+	// syntax error
+	// [select 1 as one select broken]
+}
+
+func TestConn(t *testing.T) {
+	errBroken := errors.New("broken")
+	errStop := errors.New("stop")
+	rows := []map[string]interface{}{{"n": 1}, {"n": 2}, {"n": 3}}
+
+	tests := []struct {
+		name     string
+		query    string
+		fnErr    error // Error returned by the row callback after the first row
+		closed   bool
+		wantRows int
+		wantErr  error
+	}{
+		{"all the rows", "select n", nil, false, 3, nil},
+		{"scripted error", "select broken", nil, false, 0, errBroken},
+		{"callback error stops the query", "select n", errStop, false, 1, errStop},
+		{"closed connection", "select n", nil, true, 0, ErrClosed},
+		{"unknown query", "select unknown", nil, false, 0, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := New(140002).SetRows("select n", rows...).SetError("select broken", errBroken)
+			if tt.closed {
+				conn.Close()
+			}
+
+			got := 0
+			err := conn.ExecFunc(tt.query, func(map[string]interface{}) error {
+				got++
+				return tt.fnErr
+			})
+			if err != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if got != tt.wantRows {
+				t.Errorf("expected %d rows, got %d", tt.wantRows, got)
+			}
+			if executed := conn.Executed(); !reflect.DeepEqual(executed, []string{tt.query}) {
+				t.Errorf("expected the query to be recorded, got %q", executed)
+			}
+			if conn.IsAlive() == tt.closed {
+				t.Errorf("expected alive %v, got %v", !tt.closed, conn.IsAlive())
+			}
+		})
+	}
+}
+
+func TestConcurrentDelay(t *testing.T) {
+	const queries = 4
+	conn := New(140002).SetRows("select 1")
+	conn.Delay = 200 * time.Millisecond
+
+	// the delays of the concurrent queries overlap rather than add up
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := conn.Exec("select 1"); err != nil {
+				t.Errorf("could not exec: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed >= queries*conn.Delay/2 {
+		t.Errorf("expected the queries to run concurrently, took %v", elapsed)
+	}
+	if got := len(conn.Executed()); got != queries {
+		t.Errorf("expected %d executed queries, got %d", queries, got)
+	}
+}
@@ -0,0 +1,38 @@
+package db
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// connectTimeout describes the timeout of connecting and setting up the session, if the context has no earlier deadline
+const connectTimeout = 30 * time.Second
+
+// dialFunc describes the function connecting to the address, canceled with the context
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// directDialer connects to the address directly with the keepalive of the pgx default dialer
+func directDialer() dialFunc {
+	return (&net.Dialer{KeepAlive: 5 * time.Minute}).DialContext
+}
+
+// contextDialer binds the dial function to the context, the dialed connection gets the deadline of the context
+// to bound the startup of the session, which pgx does not cancel. conn receives the dialed connection
+// to lift the deadline once the session is set up
+func contextDialer(ctx context.Context, dial dialFunc, conn *net.Conn) pgx.DialFunc {
+	return func(network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			c.SetDeadline(deadline)
+		}
+		*conn = c
+
+		return c, nil
+	}
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/adjust/postgresql_exporter/pkg/config"
+)
+
+// stalledServer accepts the connections and never replies, returning its address
+func stalledServer(t *testing.T) (string, uint16) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	host, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	return host, uint16(port)
+}
+
+func TestNewStartupTimeout(t *testing.T) {
+	host, port := stalledServer(t)
+
+	tests := []struct {
+		name   string
+		tunnel bool
+	}{
+		{"direct", false},
+		{"ssh tunnel", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbConf := config.DbConfig{Host: host, Port: port, User: "postgres", Dbname: "postgres"}
+			if tt.tunnel {
+				fakeSSH(t, "")
+				dbConf.Tunnel = "monitoring@bastion"
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			if _, err := New(ctx, dbConf); err == nil {
+				t.Fatal("expected error connecting to the stalled server")
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("expected the connection to time out with the context, took %v", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/jackc/pgx/pgtype"
+)
+
+// statementsResult returns the result of n rows of the name, calls and total_time columns
+func statementsResult(n int) pgResult {
+	res := pgResult{columns: []pgproto3.FieldDescription{
+		column("name", pgtype.TextOID),
+		column("calls", pgtype.Int8OID),
+		column("total_time", pgtype.Float8OID),
+	}}
+	for i := 0; i < n; i++ {
+		res.rows = append(res.rows, [][]byte{
+			[]byte("query_" + strconv.Itoa(i)),
+			[]byte(strconv.Itoa(i)),
+			[]byte(strconv.Itoa(i) + ".5"),
+		})
+	}
+
+	return res
+}
+
+func TestExec(t *testing.T) {
+	errStop := errors.New("stop")
+	conn := connectPg(t, pgServer(t, map[string]pgResult{"select statements": statementsResult(3)}))
+
+	want := []map[string]interface{}{
+		{"name": "query_0", "calls": int64(0), "total_time": 0.5},
+		{"name": "query_1", "calls": int64(1), "total_time": 1.5},
+		{"name": "query_2", "calls": int64(2), "total_time": 2.5},
+	}
+	rows, err := conn.Exec("select statements")
+	if err != nil {
+		t.Fatalf("could not exec: %v", err)
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("expected rows %v, got %v", want, rows)
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		stopAt   int
+		wantRows int
+		wantErr  bool
+	}{
+		{"all rows", "select statements", -1, 3, false},
+		{"stopped by fn", "select statements", 1, 2, true},
+		{"failed query", "select missing", -1, 0, true},
+	}
+
+	for _, tt := range tests {
+		var got []map[string]interface{}
+		err := conn.ExecFunc(tt.query, func(row map[string]interface{}) error {
+			got = append(got, copyRow(row))
+			if len(got)-1 == tt.stopAt {
+				return errStop
+			}
+			return nil
+		})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+		if tt.stopAt >= 0 && err != errStop {
+			t.Errorf("%s: expected the error of fn returned as is, got %v", tt.name, err)
+		}
+		if len(got) != tt.wantRows || (len(got) > 0 && !reflect.DeepEqual(got, want[:tt.wantRows])) {
+			t.Errorf("%s: expected rows %v, got %v", tt.name, want[:tt.wantRows], got)
+		}
+	}
+
+	// the connection is usable after the query stopped by fn
+	if rows, err := conn.Exec("select statements"); err != nil || len(rows) != 3 {
+		t.Errorf("expected the rows after the stopped query, got %v, %v", rows, err)
+	}
+}
+
+func BenchmarkExec(b *testing.B) {
+	const rowsNum = 10000
+	conn := connectPg(b, pgServer(b, map[string]pgResult{"select statements": statementsResult(rowsNum)}))
+
+	sum := func(row map[string]interface{}) error {
+		if _, ok := row["calls"].(int64); !ok {
+			return fmt.Errorf("unexpected calls %v", row["calls"])
+		}
+		return nil
+	}
+
+	b.Run("map per row", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			rows, err := conn.Exec("select statements")
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, row := range rows {
+				if err := sum(row); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("streamed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := conn.ExecFunc("select statements", sum); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/jackc/pgx/pgtype"
+)
+
+// moneyOID describes the OID of the money type, which pgtype does not define
+const moneyOID = 790
+
+// money decodes the money values in the text format, the only one requested for it, into float64.
+// The values which could not be parsed are kept as the raw text, so that only they fail the conversion
+// rather than the whole result
+type money struct {
+	amount float64
+	text   string // Raw value if it could not be parsed
+	status pgtype.Status
+}
+
+// Set assigns the amount
+func (dst *money) Set(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*dst = money{status: pgtype.Null}
+	case float64:
+		*dst = money{amount: v, status: pgtype.Present}
+	default:
+		return fmt.Errorf("cannot convert %v to money", src)
+	}
+
+	return nil
+}
+
+// Get returns the amount as float64, the raw text if it could not be parsed, nil if NULL
+func (dst *money) Get() interface{} {
+	if dst.status != pgtype.Present {
+		return nil
+	}
+	if dst.text != "" {
+		return dst.text
+	}
+
+	return dst.amount
+}
+
+// AssignTo assigns the amount to *float64
+func (dst *money) AssignTo(target interface{}) error {
+	v, ok := target.(*float64)
+	if !ok || dst.status != pgtype.Present || dst.text != "" {
+		return fmt.Errorf("cannot assign %v to %T", dst.Get(), target)
+	}
+	*v = dst.amount
+
+	return nil
+}
+
+// DecodeText decodes the money value formatted as of lc_monetary
+func (dst *money) DecodeText(ci *pgtype.ConnInfo, src []byte) error {
+	if src == nil {
+		*dst = money{status: pgtype.Null}
+		return nil
+	}
+
+	amount, ok := parseMoney(string(src))
+	if !ok {
+		*dst = money{text: string(src), status: pgtype.Present}
+		return nil
+	}
+	*dst = money{amount: amount, status: pgtype.Present}
+
+	return nil
+}
+
+// parseMoney parses the money amount formatted with the currency symbol, the group separators
+// and the minus sign or the parentheses for the negative amounts, e.g. "$1,234.56" or "($1.50)".
+// The amounts with the decimal comma are not supported, so the ambiguous separators, e.g. "1.234,56"
+// or "12,50", are rejected rather than misread
+func parseMoney(str string) (float64, bool) {
+	str = strings.TrimSpace(str)
+	negative := false
+	if strings.HasPrefix(str, "(") && strings.HasSuffix(str, ")") {
+		negative = true
+		str = str[1 : len(str)-1]
+	}
+
+	var (
+		amount    strings.Builder
+		hasDigits bool
+		decimal   bool
+		separator rune // kind of the group separators
+		grouped   bool // whether the digits are counted since the group separator
+		groupLen  int
+	)
+	runes := []rune(str)
+	for i, r := range runes {
+		isSeparator := r == ',' ||
+			unicode.IsSpace(r) && hasDigits && !decimal && i+1 < len(runes) && unicode.IsDigit(runes[i+1])
+		switch {
+		case r >= '0' && r <= '9':
+			hasDigits = true
+			groupLen++
+			amount.WriteRune(r)
+		case r == '.':
+			if decimal || grouped && groupLen != 3 {
+				return 0, false
+			}
+			decimal = true
+			grouped = false
+			amount.WriteRune(r)
+		case isSeparator:
+			// the group separators go between the digits before the decimal point, all of the same kind
+			if decimal || !hasDigits || separator != 0 && separator != r || grouped && groupLen != 3 {
+				return 0, false
+			}
+			separator = r
+			grouped = true
+			groupLen = 0
+		case r == '-' && !negative && !hasDigits:
+			negative = true
+		case unicode.IsSpace(r) || unicode.Is(unicode.Sc, r):
+			// currency symbols
+		default:
+			return 0, false
+		}
+	}
+	if !hasDigits || grouped && groupLen != 3 {
+		return 0, false
+	}
+
+	result, err := strconv.ParseFloat(amount.String(), 64)
+	if err != nil {
+		return 0, false
+	}
+	if negative {
+		result = -result
+	}
+
+	return result, true
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/jackc/pgx/pgtype"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		str    string
+		want   float64
+		wantOk bool
+	}{
+		{"$1,234.56", 1234.56, true},
+		{"-$1.50", -1.5, true},
+		{"($1.50)", -1.5, true},
+		{"€ 12.00", 12, true},
+		{"0.00", 0, true},
+		{"$1,234,567.00", 1234567, true},
+		{"1 234.50 €", 1234.5, true},
+		{"12.00 €", 12, true},
+		// the ambiguous separators
+		{"1.234,56", 0, false},
+		{"1.234.567", 0, false},
+		{"12,50", 0, false},
+		{"1 234,56 €", 0, false},
+		{"1,234 567.00", 0, false},
+		{"$1,2345.00", 0, false},
+		{"$1.50,", 0, false},
+		{"$,1.50", 0, false},
+		{"$", 0, false},
+		{"$-", 0, false},
+		{"abc", 0, false},
+		{"", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseMoney(tt.str)
+		if ok != tt.wantOk || got != tt.want {
+			t.Errorf("parseMoney(%q) = %v, %v, want %v, %v", tt.str, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestMoneyDecodeText(t *testing.T) {
+	tests := []struct {
+		src  []byte
+		want interface{}
+	}{
+		{[]byte("$1,000.25"), 1000.25},
+		{[]byte("($3.00)"), -3.0},
+		{nil, nil},
+		// the values which could not be parsed are kept as the raw text
+		{[]byte("n/a"), "n/a"},
+		{[]byte("1.234,56 €"), "1.234,56 €"},
+	}
+
+	for _, tt := range tests {
+		var m money
+		if err := m.DecodeText(nil, tt.src); err != nil {
+			t.Errorf("DecodeText(%q): unexpected error %v", tt.src, err)
+			continue
+		}
+		if m.Get() != tt.want {
+			t.Errorf("DecodeText(%q) = %v, want %v", tt.src, m.Get(), tt.want)
+		}
+	}
+}
+
+func TestMoneyExec(t *testing.T) {
+	conn := connectPg(t, pgServer(t, map[string]pgResult{
+		"select balances": {
+			columns: []pgproto3.FieldDescription{column("name", pgtype.TextOID), column("balance", moneyOID)},
+			rows: [][][]byte{
+				{[]byte("a"), []byte("$1,234.56")},
+				{[]byte("b"), []byte("1.234,56 €")},
+				{[]byte("c"), []byte("($2.50)")},
+			},
+		},
+	}))
+
+	// the value which could not be parsed fails only its own conversion
+	rows, err := conn.Exec("select balances")
+	if err != nil {
+		t.Fatalf("could not exec: %v", err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(rows))
+	}
+	tests := []struct {
+		want    float64
+		wantErr bool
+	}{
+		{1234.56, false},
+		{0, true},
+		{-2.5, false},
+	}
+	for i, tt := range tests {
+		got, err := ToFloat64(rows[i]["balance"])
+		if (err != nil) != tt.wantErr {
+			t.Errorf("row %d: expected error %v, got %v", i, tt.wantErr, err)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("row %d: expected %v, got %v", i, tt.want, got)
+		}
+	}
+}
+
+func TestToFloat64Text(t *testing.T) {
+	tests := []struct {
+		value   interface{}
+		want    float64
+		wantErr bool
+	}{
+		{"42", 42, false},
+		{" 1.5 ", 1.5, false},
+		{[]byte("7"), 7, false},
+		{"on", 1, false},
+		{"off", 0, false},
+		// the money amounts are decoded by the money type only, the text is parsed strictly
+		{"$1.50", 0, true},
+		{"1,2,3", 0, true},
+		{"$-", 0, true},
+		{[]byte("1,000"), 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ToFloat64(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ToFloat64(%q): expected error %v, got %v", tt.value, tt.wantErr, err)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("ToFloat64(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
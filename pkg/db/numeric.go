@@ -0,0 +1,72 @@
+package db
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/jackc/pgx/pgtype"
+)
+
+// Signs of the special numeric values in the binary format
+const (
+	numericNaNSign    = 0xC000
+	numericPosInfSign = 0xD000
+	numericNegInfSign = 0xF000
+)
+
+// numeric extends pgtype.Numeric with the special values: NaN and infinities, which pgtype.Numeric can not decode
+type numeric struct {
+	pgtype.Numeric
+	special *float64
+}
+
+// DecodeText decodes the numeric value in the text format
+func (dst *numeric) DecodeText(ci *pgtype.ConnInfo, src []byte) error {
+	switch string(src) {
+	case "NaN":
+		dst.setSpecial(math.NaN())
+		return nil
+	case "Infinity":
+		dst.setSpecial(math.Inf(1))
+		return nil
+	case "-Infinity":
+		dst.setSpecial(math.Inf(-1))
+		return nil
+	}
+
+	dst.special = nil
+	return dst.Numeric.DecodeText(ci, src)
+}
+
+// DecodeBinary decodes the numeric value in the binary format
+func (dst *numeric) DecodeBinary(ci *pgtype.ConnInfo, src []byte) error {
+	if len(src) >= 8 {
+		switch binary.BigEndian.Uint16(src[4:]) {
+		case numericNaNSign:
+			dst.setSpecial(math.NaN())
+			return nil
+		case numericPosInfSign:
+			dst.setSpecial(math.Inf(1))
+			return nil
+		case numericNegInfSign:
+			dst.setSpecial(math.Inf(-1))
+			return nil
+		}
+	}
+
+	dst.special = nil
+	return dst.Numeric.DecodeBinary(ci, src)
+}
+
+// Get returns float64 for the special values and *pgtype.Numeric otherwise
+func (dst *numeric) Get() interface{} {
+	if dst.special != nil {
+		return *dst.special
+	}
+
+	return dst.Numeric.Get()
+}
+
+func (dst *numeric) setSpecial(value float64) {
+	*dst = numeric{Numeric: pgtype.Numeric{Status: pgtype.Present}, special: &value}
+}
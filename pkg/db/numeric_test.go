@@ -0,0 +1,106 @@
+package db
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/jackc/pgx/pgtype"
+)
+
+// specialNumeric returns the numeric value of the sign in the binary format: no digits, weight, sign and scale
+func specialNumeric(sign uint16) []byte {
+	src := make([]byte, 8)
+	binary.BigEndian.PutUint16(src[4:], sign)
+
+	return src
+}
+
+// sameFloat reports whether the values are equal, NaN equals NaN
+func sameFloat(a, b float64) bool {
+	return a == b || math.IsNaN(a) && math.IsNaN(b)
+}
+
+func TestNumericDecode(t *testing.T) {
+	regular := &pgtype.Numeric{}
+	if err := regular.Set(12.5); err != nil {
+		t.Fatalf("could not set numeric: %v", err)
+	}
+	regularBinary, err := regular.EncodeBinary(nil, nil)
+	if err != nil {
+		t.Fatalf("could not encode numeric: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		binary  bool
+		src     []byte
+		want    float64
+		wantErr bool
+	}{
+		{"text NaN", false, []byte("NaN"), math.NaN(), false},
+		{"text infinity", false, []byte("Infinity"), math.Inf(1), false},
+		{"text negative infinity", false, []byte("-Infinity"), math.Inf(-1), false},
+		{"text value", false, []byte("-12.5"), -12.5, false},
+		{"text NULL", false, nil, math.NaN(), false},
+		{"text garbage", false, []byte("twelve"), 0, true},
+		{"binary NaN", true, specialNumeric(numericNaNSign), math.NaN(), false},
+		{"binary infinity", true, specialNumeric(numericPosInfSign), math.Inf(1), false},
+		{"binary negative infinity", true, specialNumeric(numericNegInfSign), math.Inf(-1), false},
+		{"binary value", true, regularBinary, 12.5, false},
+		{"binary NULL", true, nil, math.NaN(), false},
+	}
+
+	for _, tt := range tests {
+		var n numeric
+		if tt.binary {
+			err = n.DecodeBinary(nil, tt.src)
+		} else {
+			err = n.DecodeText(nil, tt.src)
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		got, err := ToFloat64(n.Get())
+		if err != nil || !sameFloat(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v, %v", tt.name, tt.want, got, err)
+		}
+	}
+
+	// the decoded special value does not stick to the reused value
+	var n numeric
+	n.DecodeText(nil, []byte("NaN"))
+	n.DecodeText(nil, []byte("1"))
+	if got, err := ToFloat64(n.Get()); err != nil || got != 1 {
+		t.Errorf("expected the value decoded after NaN, got %v, %v", got, err)
+	}
+}
+
+func TestNumericExec(t *testing.T) {
+	conn := connectPg(t, pgServer(t, map[string]pgResult{
+		"select numerics": {
+			columns: []pgproto3.FieldDescription{column("value", pgtype.NumericOID)},
+			rows:    [][][]byte{{[]byte("NaN")}, {[]byte("Infinity")}, {[]byte("-Infinity")}, {[]byte("1.25")}, {nil}},
+		},
+	}))
+
+	rows, err := conn.Exec("select numerics")
+	if err != nil {
+		t.Fatalf("could not exec: %v", err)
+	}
+	want := []float64{math.NaN(), math.Inf(1), math.Inf(-1), 1.25, math.NaN()}
+	if len(rows) != len(want) {
+		t.Fatalf("expected %d rows, got %d", len(want), len(rows))
+	}
+	for i, row := range rows {
+		if got, err := ToFloat64(row["value"]); err != nil || !sameFloat(got, want[i]) {
+			t.Errorf("row %d: expected %v, got %v, %v", i, want[i], got, err)
+		}
+	}
+}
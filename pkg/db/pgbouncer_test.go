@@ -0,0 +1,97 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/jackc/pgx/pgtype"
+)
+
+// pgbouncerResults are the SHOW commands output recorded from pgbouncer, trimmed to a few columns of each type
+var pgbouncerResults = map[string]pgResult{
+	"show pools": {
+		columns: []pgproto3.FieldDescription{
+			column("database", pgtype.TextOID),
+			column("user", pgtype.TextOID),
+			column("cl_active", pgtype.Int4OID),
+			column("cl_waiting", pgtype.Int4OID),
+			column("maxwait_us", pgtype.Int8OID),
+			column("pool_mode", pgtype.TextOID),
+		},
+		rows: [][][]byte{
+			{[]byte("pgbouncer"), []byte("pgbouncer"), []byte("1"), []byte("0"), []byte("0"), []byte("statement")},
+			{[]byte("app"), []byte("app"), []byte("12"), []byte("3"), []byte("1500"), []byte("transaction")},
+		},
+	},
+	"show stats": {
+		columns: []pgproto3.FieldDescription{
+			column("database", pgtype.TextOID),
+			column("total_xact_count", pgtype.Int8OID),
+			column("total_query_time", pgtype.Int8OID),
+			column("avg_recv", pgtype.NumericOID),
+		},
+		rows: [][][]byte{
+			{[]byte("app"), []byte("10452"), []byte("98230411"), []byte("1024.5")},
+		},
+	},
+	"show servers": {
+		columns: []pgproto3.FieldDescription{
+			column("database", pgtype.VarcharOID),
+			column("port", pgtype.Int2OID),
+			column("connect_time", pgtype.TimestampOID),
+			column("tls", pgtype.BoolOID),
+			column("ptr", pgtype.NameOID),
+			column("wait", pgtype.Float8OID),
+		},
+		rows: [][][]byte{
+			{[]byte("app"), []byte("5432"), []byte("2024-01-02 03:04:05"), []byte("f"), []byte("0x1f2e3d"), []byte("0.25")},
+		},
+	},
+}
+
+func TestPgbouncerShow(t *testing.T) {
+	conn := connectPg(t, pgServer(t, pgbouncerResults))
+
+	tests := []struct {
+		query   string
+		row     int
+		column  string
+		want    float64
+		wantStr string
+	}{
+		{"show pools", 1, "cl_active", 12, ""},
+		{"show pools", 1, "maxwait_us", 1500, ""},
+		{"show pools", 1, "pool_mode", 0, "transaction"},
+		{"show stats", 0, "total_xact_count", 10452, ""},
+		{"show stats", 0, "avg_recv", 1024.5, ""},
+		{"show servers", 0, "port", 5432, ""},
+		{"show servers", 0, "connect_time", float64(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Unix()), ""},
+		{"show servers", 0, "tls", 0, ""},
+		{"show servers", 0, "ptr", 0, "0x1f2e3d"},
+		{"show servers", 0, "wait", 0.25, ""},
+	}
+
+	results := make(map[string][]map[string]interface{})
+	for _, tt := range tests {
+		rows, ok := results[tt.query]
+		if !ok {
+			var err error
+			if rows, err = conn.Exec(tt.query); err != nil {
+				t.Fatalf("%s: could not exec: %v", tt.query, err)
+			}
+			results[tt.query] = rows
+		}
+
+		value := rows[tt.row][tt.column]
+		if tt.wantStr != "" {
+			if got, ok := ToString(value); !ok || got != tt.wantStr {
+				t.Errorf("%s %s: expected %q, got %v", tt.query, tt.column, tt.wantStr, value)
+			}
+			continue
+		}
+		if got, err := ToFloat64(value); err != nil || got != tt.want {
+			t.Errorf("%s %s: expected %v, got %v (%T), %v", tt.query, tt.column, tt.want, got, value, err)
+		}
+	}
+}
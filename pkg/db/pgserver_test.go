@@ -0,0 +1,182 @@
+package db
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/jackc/pgx/pgtype"
+
+	"github.com/adjust/postgresql_exporter/pkg/config"
+)
+
+// pgResult describes the result of the query returned by pgServer, the values are in the text format.
+// The result without the columns is of the command, e.g. "begin"
+type pgResult struct {
+	columns []pgproto3.FieldDescription
+	rows    [][][]byte
+}
+
+// column describes the result column of the type
+func column(name string, oid pgtype.OID) pgproto3.FieldDescription {
+	return pgproto3.FieldDescription{Name: name, DataTypeOID: uint32(oid), DataTypeSize: -1}
+}
+
+// pgServer starts the fake postgresql server answering the simple queries with the results,
+// returning the isNotPg config of the connection to it
+func pgServer(t testing.TB, results map[string]pgResult) config.DbConfig {
+	return recordingPgServer(t, results, nil)
+}
+
+// queryLog records the queries received by the fake server
+type queryLog struct {
+	sync.Mutex
+	queries []string
+}
+
+func (l *queryLog) add(query string) {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.queries = append(l.queries, query)
+}
+
+func (l *queryLog) get() []string {
+	l.Lock()
+	defer l.Unlock()
+
+	return append([]string{}, l.queries...)
+}
+
+// recordingPgServer starts the fake server as pgServer does, recording the received queries in the log if set
+func recordingPgServer(t testing.TB, results map[string]pgResult, log *queryLog) config.DbConfig {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go servePg(conn, results, log)
+		}
+	}()
+
+	host, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	return config.DbConfig{Host: host, Port: uint16(port), User: "postgres", Dbname: "postgres", IsNotPg: true}
+}
+
+// servePg serves the connection until it is terminated
+func servePg(conn net.Conn, results map[string]pgResult, log *queryLog) {
+	defer conn.Close()
+
+	backend, err := pgproto3.NewBackend(conn, conn)
+	if err != nil {
+		return
+	}
+	startup, err := backend.ReceiveStartupMessage()
+	if err != nil {
+		return
+	}
+	backend.Send(&pgproto3.Authentication{Type: pgproto3.AuthTypeOk})
+	// required by the simple protocol queries
+	backend.Send(&pgproto3.ParameterStatus{Name: "standard_conforming_strings", Value: "on"})
+	// the startup parameters are reported back to check them in the tests, the client_encoding is required as well
+	for name, value := range startup.Parameters {
+		backend.Send(&pgproto3.ParameterStatus{Name: name, Value: value})
+	}
+	backend.Send(&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 1})
+	backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+
+		query, ok := msg.(*pgproto3.Query)
+		if !ok {
+			return
+		}
+
+		log.add(query.String)
+
+		result, ok := results[query.String]
+		if !ok {
+			result, ok = pgTypes(query.String)
+		}
+		if !ok {
+			backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42601", Message: "unexpected query"})
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+			continue
+		}
+		if result.columns == nil {
+			backend.Send(&pgproto3.CommandComplete{CommandTag: strings.ToUpper(strings.Fields(query.String)[0])})
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+			continue
+		}
+
+		backend.Send(&pgproto3.RowDescription{Fields: result.columns})
+		for _, row := range result.rows {
+			backend.Send(&pgproto3.DataRow{Values: row})
+		}
+		backend.Send(&pgproto3.CommandComplete{CommandTag: "SELECT " + strconv.Itoa(len(result.rows))})
+		backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	}
+}
+
+// pgTypes answers the pg_type queries pgx loads the data types with if the connection is not isNotPg,
+// only the built-in types are reported, there are no enum arrays and domains
+func pgTypes(query string) (pgResult, bool) {
+	if !strings.Contains(query, "from pg_type t") {
+		return pgResult{}, false
+	}
+
+	result := pgResult{columns: []pgproto3.FieldDescription{column("oid", pgtype.OIDOID), column("typname", pgtype.TextOID)}}
+	if strings.Contains(query, "typbasetype") {
+		result.columns = append(result.columns, column("typbasetype", pgtype.OIDOID))
+		return result, true
+	}
+	if strings.Contains(query, "typtype = 'b'") {
+		return result, true
+	}
+
+	for name, oid := range map[string]pgtype.OID{
+		"bool":    pgtype.BoolOID,
+		"float8":  pgtype.Float8OID,
+		"int4":    pgtype.Int4OID,
+		"int8":    pgtype.Int8OID,
+		"name":    pgtype.NameOID,
+		"numeric": pgtype.NumericOID,
+		"oid":     pgtype.OIDOID,
+		"text":    pgtype.TextOID,
+	} {
+		result.rows = append(result.rows, [][]byte{[]byte(strconv.Itoa(int(oid))), []byte(name)})
+	}
+
+	return result, true
+}
+
+// connectPg connects to the fake server
+func connectPg(t testing.TB, dbConf config.DbConfig) *Db {
+	conn, err := New(context.Background(), dbConf)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
@@ -0,0 +1,235 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adjust/postgresql_exporter/pkg/config"
+)
+
+// sshCommand creates the command of the ssh client killed once the context is done, replaced in the tests
+var sshCommand = func(ctx context.Context, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, "ssh", args...)
+}
+
+// sshExitTimeout describes how long the ssh client is given to exit on close before it is killed
+var sshExitTimeout = 5 * time.Second
+
+// sshAddr describes the address the connection is forwarded to
+type sshAddr string
+
+// Network returns the network of the address
+func (a sshAddr) Network() string {
+	return "ssh"
+}
+
+// String returns the forwarded address
+func (a sshAddr) String() string {
+	return string(a)
+}
+
+// sshConn describes the connection forwarded by the ssh client through its stdin and stdout,
+// closing the connection stops the client
+type sshConn struct {
+	r          *os.File // Read end of the stdout of the client
+	w          *os.File // Write end of the stdin of the client
+	stderrR    *os.File // Read end of the stderr of the client
+	addr       sshAddr
+	stderr     bytes.Buffer
+	stderrDone chan struct{} // Closed once the stderr is read till the end, it can be read then
+	exited     chan struct{} // Closed once the client exits
+	detached   chan struct{} // Closed once the connection outlives the dial context
+	detachOnce sync.Once
+	kill       func() // Kills the client
+}
+
+// Read reads from the forwarded connection, the client exiting, e.g. failing to authenticate,
+// closes the connection with its error output
+func (c *sshConn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if err == io.EOF {
+		select {
+		case <-c.stderrDone:
+			if msg := strings.TrimSpace(c.stderr.String()); msg != "" {
+				err = fmt.Errorf("tunnel closed: %s", msg)
+			}
+		case <-time.After(time.Second):
+		}
+	}
+
+	return n, err
+}
+
+// Write writes to the forwarded connection
+func (c *sshConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// Close closes the forwarded connection and stops the client, killing it if it does not exit in time,
+// e.g. stuck on the half-open connection to the tunnel host
+func (c *sshConn) Close() error {
+	err := c.w.Close()
+	if rErr := c.r.Close(); err == nil {
+		err = rErr
+	}
+	select {
+	case <-c.exited:
+	case <-time.After(sshExitTimeout):
+		c.kill()
+		<-c.exited
+	}
+	c.kill()
+	// the children of the client keeping its stderr open, e.g. of ProxyCommand, do not block the close
+	c.stderrR.Close()
+
+	return err
+}
+
+// detach stops killing the client once the dial context is done, as the session is set up
+func (c *sshConn) detach() {
+	c.detachOnce.Do(func() { close(c.detached) })
+}
+
+// LocalAddr returns the forwarded address, as the local end is the pipe to the client
+func (c *sshConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// RemoteAddr returns the forwarded address
+func (c *sshConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline sets the deadline of both the reads and the writes
+func (c *sshConn) SetDeadline(t time.Time) error {
+	if err := c.r.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.w.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline
+func (c *sshConn) SetReadDeadline(t time.Time) error {
+	return c.r.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline
+func (c *sshConn) SetWriteDeadline(t time.Time) error {
+	return c.w.SetWriteDeadline(t)
+}
+
+// sshDialer returns the dial function connecting to the addresses through the SSH tunnel: each connection
+// runs its own "ssh -W", authenticated with the key file or the defaults of the ssh client, e.g. ssh-agent.
+// The tunnel host key must be known, as the client runs in the batch mode
+func sshDialer(dbConfig config.DbConfig) (dialFunc, error) {
+	user, addr, err := dbConfig.TunnelAddr()
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tunnel %q: %v", dbConfig.Tunnel, err)
+	}
+
+	args := []string{"-l", user, "-p", port, "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=yes"}
+	if dbConfig.TunnelKeyFile != "" {
+		args = append(args, "-i", dbConfig.TunnelKeyFile, "-o", "IdentitiesOnly=yes")
+	}
+	if dbConfig.TunnelKnownHosts != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+dbConfig.TunnelKnownHosts)
+	}
+
+	return func(ctx context.Context, network, target string) (net.Conn, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		cmdCtx, kill := context.WithCancel(context.Background())
+		conn, err := startSSH(sshCommand(cmdCtx, append(args, "-W", target, "--", host)...), target)
+		if err != nil {
+			kill()
+			return nil, err
+		}
+		conn.kill = kill
+
+		// the client is killed if the dial context is done before the session is set up, the established
+		// connection outlives the context once detached
+		go func() {
+			select {
+			case <-ctx.Done():
+				kill()
+			case <-conn.detached:
+			case <-conn.exited:
+			}
+		}()
+
+		return conn, nil
+	}, nil
+}
+
+// startSSH starts the ssh client forwarding the connection to the target through its stdin and stdout
+func startSSH(cmd *exec.Cmd, target string) (*sshConn, error) {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not create tunnel pipe: %v", err)
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, fmt.Errorf("could not create tunnel pipe: %v", err)
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		stdoutR.Close()
+		stdoutW.Close()
+		return nil, fmt.Errorf("could not create tunnel pipe: %v", err)
+	}
+
+	conn := &sshConn{
+		r:          stdoutR,
+		w:          stdinW,
+		stderrR:    stderrR,
+		addr:       sshAddr(target),
+		stderrDone: make(chan struct{}),
+		exited:     make(chan struct{}),
+		detached:   make(chan struct{}),
+	}
+	// the client gets the pipes as they are, so that waiting for it does not wait for its stdio to be closed
+	cmd.Stdin = stdinR
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+	err = cmd.Start()
+	// the ends of the client are not needed once it is started
+	stdinR.Close()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		stdoutR.Close()
+		stdinW.Close()
+		stderrR.Close()
+		return nil, fmt.Errorf("could not start ssh: %v", err)
+	}
+
+	go func() {
+		io.Copy(&conn.stderr, stderrR)
+		close(conn.stderrDone)
+	}()
+	go func() {
+		cmd.Wait()
+		close(conn.exited)
+	}()
+
+	return conn, nil
+}
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adjust/postgresql_exporter/pkg/config"
+)
+
+// fakeSSH replaces the ssh client with the test binary acting as "ssh -W": it connects to the target itself
+// and records its arguments in the returned file. The client fails to authenticate if mode is "fail"
+// and hangs ignoring its stdin if mode is "hang"
+func fakeSSH(t *testing.T, mode string) string {
+	argsFile := filepath.Join(t.TempDir(), "args")
+	prev := sshCommand
+	sshCommand = func(ctx context.Context, args ...string) *exec.Cmd {
+		cmd := exec.CommandContext(ctx, os.Args[0], append([]string{"-test.run=TestSSHHelperProcess", "--"}, args...)...)
+		cmd.Env = append(os.Environ(), "SSH_HELPER_ARGS="+argsFile, "SSH_HELPER_MODE="+mode)
+		return cmd
+	}
+	t.Cleanup(func() { sshCommand = prev })
+
+	return argsFile
+}
+
+// TestSSHHelperProcess is the fake ssh client run by fakeSSH
+func TestSSHHelperProcess(t *testing.T) {
+	argsFile := os.Getenv("SSH_HELPER_ARGS")
+	if argsFile == "" {
+		return
+	}
+	defer os.Exit(0)
+
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	args = args[1:]
+	ioutil.WriteFile(argsFile, []byte(strings.Join(args, "\n")), 0600)
+
+	switch os.Getenv("SSH_HELPER_MODE") {
+	case "fail":
+		fmt.Fprintln(os.Stderr, "monitoring@bastion: Permission denied (publickey).")
+		os.Exit(255)
+	case "hang":
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+
+	var target string
+	for i, arg := range args {
+		if arg == "-W" && i+1 < len(args) {
+			target = args[i+1]
+		}
+	}
+	conn, err := net.Dial("tcp", target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "channel 0: open failed: connect failed: %v\n", err)
+		os.Exit(255)
+	}
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.Close()
+	}()
+	io.Copy(os.Stdout, conn)
+}
+
+func TestSSHTunnel(t *testing.T) {
+	tests := []struct {
+		name      string
+		tunnel    string
+		keyFile   string
+		fail      bool
+		wantArgs  []string
+		wantError string
+	}{
+		{
+			"default port",
+			"monitoring@bastion",
+			"",
+			false,
+			[]string{"-l", "monitoring", "-p", "22", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=yes",
+				"-o", "UserKnownHostsFile=known_hosts", "-W", "{target}", "--", "bastion"},
+			"",
+		},
+		{
+			"key file",
+			"monitoring@bastion:2222",
+			"id_ed25519",
+			false,
+			[]string{"-l", "monitoring", "-p", "2222", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=yes",
+				"-i", "id_ed25519", "-o", "IdentitiesOnly=yes", "-o", "UserKnownHostsFile=known_hosts", "-W", "{target}", "--", "bastion"},
+			"",
+		},
+		{"rejected", "monitoring@bastion", "", true, nil, "Permission denied (publickey)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode := ""
+			if tt.fail {
+				mode = "fail"
+			}
+			argsFile := fakeSSH(t, mode)
+			dbConf := pgServer(t, map[string]pgResult{";": {}})
+			dbConf.Tunnel = tt.tunnel
+			dbConf.TunnelKeyFile = tt.keyFile
+			dbConf.TunnelKnownHosts = "known_hosts"
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn, err := New(ctx, dbConf)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("expected error %q, got %v", tt.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not connect through the tunnel: %v", err)
+			}
+			defer conn.Close()
+			if _, err := conn.Exec(";"); err != nil {
+				t.Errorf("could not query through the tunnel: %v", err)
+			}
+
+			data, err := ioutil.ReadFile(argsFile)
+			if err != nil {
+				t.Fatalf("expected the connection to go through the tunnel: %v", err)
+			}
+			target := net.JoinHostPort(dbConf.Host, fmt.Sprint(dbConf.Port))
+			want := strings.Replace(strings.Join(tt.wantArgs, "\n"), "{target}", target, 1)
+			if got := string(data); got != want {
+				t.Errorf("expected ssh arguments %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestSSHTunnelHang(t *testing.T) {
+	fakeSSH(t, "hang")
+	prev := sshExitTimeout
+	sshExitTimeout = 100 * time.Millisecond
+	defer func() { sshExitTimeout = prev }()
+
+	dial, err := sshDialer(config.DbConfig{Tunnel: "monitoring@bastion"})
+	if err != nil {
+		t.Fatalf("could not set up tunnel: %v", err)
+	}
+
+	// the client ignoring its closed stdin is killed on close
+	conn, err := dial(context.Background(), "tcp", "db:5432")
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	start := time.Now()
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected close to kill the client, took %v", elapsed)
+	}
+
+	// the client is killed once the dial context is done before the connection is detached
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err = dial(ctx, "tcp", "db:5432")
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer conn.Close()
+	cancel()
+	select {
+	case <-conn.(*sshConn).exited:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the client to be killed once the dial context is done")
+	}
+}
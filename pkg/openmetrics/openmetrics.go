@@ -0,0 +1,169 @@
+package openmetrics
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/adjust/postgresql_exporter/pkg/samples"
+)
+
+// ContentType describes the OpenMetrics text format content type
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+const mediaType = "application/openmetrics-text"
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	valueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// Handler serves the metrics of the gatherer in the OpenMetrics text format if the client accepts it,
+// the other requests are passed to the next handler. With compress the response is gzipped if the client accepts it
+func Handler(gatherer prometheus.Gatherer, next http.Handler, compress bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the response differs by the headers, so the caches must not serve it to the other clients
+		w.Header().Add("Vary", "Accept")
+		if compress {
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+		if !accepted(r.Header.Get("Accept")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		metricFamilies, err := gatherer.Gather()
+		if err != nil {
+			if len(metricFamilies) == 0 {
+				http.Error(w, fmt.Sprintf("could not gather metrics: %v", err), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("could not gather some of the metrics: %v", err)
+		}
+
+		var out io.Writer = w
+		w.Header().Set("Content-Type", ContentType)
+		if compress && gzipAccepted(r.Header.Get("Accept-Encoding")) {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		}
+
+		if err := Write(out, metricFamilies); err != nil {
+			log.Printf("could not write metrics: %v", err)
+		}
+	})
+}
+
+// Write writes the metric families in the OpenMetrics text format
+func Write(w io.Writer, metricFamilies []*dto.MetricFamily) error {
+	buf := bufio.NewWriter(w)
+	names := make(map[string]bool, len(metricFamilies))
+	for _, mf := range metricFamilies {
+		names[mf.GetName()] = true
+	}
+	for _, mf := range metricFamilies {
+		writeMetricFamily(buf, mf, names)
+	}
+	buf.WriteString("# EOF\n")
+
+	return buf.Flush()
+}
+
+// writeMetricFamily writes the metric family, names are the names of all the families written,
+// so that the counter keeps its _total suffix in the family name if the trimmed one is taken, e.g. by a gauge
+func writeMetricFamily(w *bufio.Writer, mf *dto.MetricFamily, names map[string]bool) {
+	name := mf.GetName()
+	metricType := "unknown"
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		metricType = "counter"
+		if trimmed := strings.TrimSuffix(name, "_total"); !names[trimmed] {
+			name = trimmed
+		}
+	case dto.MetricType_GAUGE:
+		metricType = "gauge"
+	case dto.MetricType_SUMMARY:
+		metricType = "summary"
+	case dto.MetricType_HISTOGRAM:
+		metricType = "histogram"
+	}
+
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+	if mf.Help != nil {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, helpEscaper.Replace(mf.GetHelp()))
+	}
+
+	for _, m := range mf.Metric {
+		samples.Flatten(mf, m, func(s samples.Sample) {
+			// the counter sample is suffixed with _total, which is not a part of the family name
+			if mf.GetType() == dto.MetricType_COUNTER {
+				s.Name = name + "_total"
+			}
+			writeSample(w, s.Name, m, s.LabelName, s.LabelValue, s.Value)
+		})
+	}
+}
+
+// writeSample writes the sample line, the additional label is written if its name is not empty
+func writeSample(w *bufio.Writer, name string, m *dto.Metric, labelName, labelValue string, value float64) {
+	w.WriteString(name)
+
+	labels := make([]string, 0, len(m.Label)+1)
+	for _, lp := range m.Label {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, lp.GetName(), valueEscaper.Replace(lp.GetValue())))
+	}
+	if labelName != "" {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, labelName, valueEscaper.Replace(labelValue)))
+	}
+	if len(labels) > 0 {
+		fmt.Fprintf(w, "{%s}", strings.Join(labels, ","))
+	}
+
+	fmt.Fprintf(w, " %s", samples.FormatFloat(value))
+	if m.TimestampMs != nil {
+		fmt.Fprintf(w, " %s", samples.FormatFloat(float64(m.GetTimestampMs())/1000))
+	}
+	w.WriteString("\n")
+}
+
+// accepted checks if the Accept header contains OpenMetrics media type
+func accepted(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mt != mediaType {
+			continue
+		}
+
+		if q, ok := params["q"]; ok {
+			if val, err := strconv.ParseFloat(q, 64); err == nil && val == 0 {
+				continue
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func gzipAccepted(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "gzip" || strings.HasPrefix(part, "gzip;") {
+			return true
+		}
+	}
+
+	return false
+}
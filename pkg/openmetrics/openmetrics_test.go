@@ -0,0 +1,241 @@
+package openmetrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func label(name, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)}
+}
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		mf   *dto.MetricFamily
+		want string
+	}{
+		{
+			"counter",
+			&dto.MetricFamily{
+				Name: proto.String("pg_xact_commit_total"),
+				Help: proto.String("Number of commits"),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{Label: []*dto.LabelPair{label("datname", "postgres")}, Counter: &dto.Counter{Value: proto.Float64(12)}},
+				},
+			},
+			"# TYPE pg_xact_commit counter\n# HELP pg_xact_commit Number of commits\n" +
+				"pg_xact_commit_total{datname=\"postgres\"} 12\n",
+		},
+		{
+			"gauge with escaping and timestamp",
+			&dto.MetricFamily{
+				Name: proto.String("pg_settings_value"),
+				Help: proto.String("Value of the\nsetting \\"),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label:       []*dto.LabelPair{label("name", "say \"hi\"\n")},
+						Gauge:       &dto.Gauge{Value: proto.Float64(math.Inf(-1))},
+						TimestampMs: proto.Int64(1577934245600),
+					},
+				},
+			},
+			"# TYPE pg_settings_value gauge\n# HELP pg_settings_value Value of the\\nsetting \\\\\n" +
+				"pg_settings_value{name=\"say \\\"hi\\\"\\n\"} -Inf 1.5779342456e+09\n",
+		},
+		{
+			"summary",
+			&dto.MetricFamily{
+				Name: proto.String("pg_duration"),
+				Type: dto.MetricType_SUMMARY.Enum(),
+				Metric: []*dto.Metric{
+					{Summary: &dto.Summary{
+						SampleCount: proto.Uint64(4),
+						SampleSum:   proto.Float64(10),
+						Quantile:    []*dto.Quantile{{Quantile: proto.Float64(0.5), Value: proto.Float64(2)}},
+					}},
+				},
+			},
+			"# TYPE pg_duration summary\n" +
+				"pg_duration{quantile=\"0.5\"} 2\npg_duration_sum 10\npg_duration_count 4\n",
+		},
+		{
+			"histogram without the +Inf bucket",
+			&dto.MetricFamily{
+				Name: proto.String("pg_latency"),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{
+					{Histogram: &dto.Histogram{
+						SampleCount: proto.Uint64(3),
+						SampleSum:   proto.Float64(1.5),
+						Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(1)}},
+					}},
+				},
+			},
+			"# TYPE pg_latency histogram\n" +
+				"pg_latency_bucket{le=\"0.1\"} 1\npg_latency_bucket{le=\"+Inf\"} 3\npg_latency_sum 1.5\npg_latency_count 3\n",
+		},
+		{
+			"untyped",
+			&dto.MetricFamily{
+				Name:   proto.String("pg_untyped"),
+				Type:   dto.MetricType_UNTYPED.Enum(),
+				Metric: []*dto.Metric{{Untyped: &dto.Untyped{Value: proto.Float64(math.NaN())}}},
+			},
+			"# TYPE pg_untyped unknown\npg_untyped NaN\n",
+		},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := Write(&buf, []*dto.MetricFamily{tt.mf}); err != nil {
+			t.Errorf("%s: could not write: %v", tt.name, err)
+			continue
+		}
+		if got, want := buf.String(), tt.want+"# EOF\n"; got != want {
+			t.Errorf("%s: expected\n%s\ngot\n%s", tt.name, want, got)
+		}
+	}
+}
+
+func TestWriteCounterCollision(t *testing.T) {
+	mfs := []*dto.MetricFamily{
+		{
+			Name:   proto.String("pg_locks_total"),
+			Type:   dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(3)}}},
+		},
+		{
+			Name:   proto.String("pg_locks"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+		},
+	}
+
+	// the counter keeps the _total suffix in the family name taken by the gauge
+	want := "# TYPE pg_locks_total counter\npg_locks_total_total 3\n" +
+		"# TYPE pg_locks gauge\npg_locks 1\n# EOF\n"
+	var buf bytes.Buffer
+	if err := Write(&buf, mfs); err != nil {
+		t.Fatalf("could not write: %v", err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestAccepted(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"text/plain;version=0.0.4", false},
+		{"application/openmetrics-text; version=1.0.0; charset=utf-8", true},
+		{"application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1", true},
+		{"application/openmetrics-text;q=0,text/plain", false},
+		{"application/openmetrics-text;q=invalid", true},
+	}
+
+	for _, tt := range tests {
+		if got := accepted(tt.header); got != tt.want {
+			t.Errorf("accepted(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestGzipAccepted(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=1.0, *;q=0.5", true},
+		{"gzipped", false},
+		{"br", false},
+	}
+
+	for _, tt := range tests {
+		if got := gzipAccepted(tt.header); got != tt.want {
+			t.Errorf("gzipAccepted(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "pg_up", Help: "Whether the database is up"})
+	gauge.Set(1)
+	registry.MustRegister(gauge)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte("next\n"))
+	})
+
+	tests := []struct {
+		accept         string
+		acceptEncoding string
+		compress       bool
+		wantType       string
+		wantEncoding   string
+		wantVary       []string
+	}{
+		{"text/plain", "", false, "text/plain; version=0.0.4", "", []string{"Accept"}},
+		{"text/plain", "gzip", true, "text/plain; version=0.0.4", "", []string{"Accept", "Accept-Encoding"}},
+		{"application/openmetrics-text; version=1.0.0", "", false, ContentType, "", []string{"Accept"}},
+		{"application/openmetrics-text; version=1.0.0", "gzip", true, ContentType, "gzip", []string{"Accept", "Accept-Encoding"}},
+		{"application/openmetrics-text; version=1.0.0", "gzip", false, ContentType, "", []string{"Accept"}},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Accept", tt.accept)
+		req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		w := httptest.NewRecorder()
+		Handler(registry, next, tt.compress).ServeHTTP(w, req)
+
+		if got := w.Header().Get("Content-Type"); got != tt.wantType {
+			t.Errorf("%q: expected content type %q, got %q", tt.accept, tt.wantType, got)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+			t.Errorf("%q: expected content encoding %q, got %q", tt.accept, tt.wantEncoding, got)
+		}
+		if got := w.Header()["Vary"]; !reflect.DeepEqual(got, tt.wantVary) {
+			t.Errorf("%q, compress %v: expected vary %v, got %v", tt.accept, tt.compress, tt.wantVary, got)
+		}
+
+		body := w.Body.Bytes()
+		if tt.wantEncoding == "gzip" {
+			gz, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("%q: could not read gzipped body: %v", tt.accept, err)
+			}
+			if body, err = ioutil.ReadAll(gz); err != nil {
+				t.Fatalf("%q: could not read gzipped body: %v", tt.accept, err)
+			}
+		}
+		if tt.wantType != ContentType {
+			if string(body) != "next\n" {
+				t.Errorf("%q: expected the next handler response, got %q", tt.accept, body)
+			}
+			continue
+		}
+		if !strings.Contains(string(body), "pg_up 1\n") || !strings.HasSuffix(string(body), "# EOF\n") {
+			t.Errorf("%q: expected the metrics ending with # EOF, got %q", tt.accept, body)
+		}
+	}
+}
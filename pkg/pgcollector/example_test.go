@@ -0,0 +1,68 @@
+package pgcollector_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/adjust/postgresql_exporter/pkg/config"
+	"github.com/adjust/postgresql_exporter/pkg/db"
+	"github.com/adjust/postgresql_exporter/pkg/db/dbtest"
+	"github.com/adjust/postgresql_exporter/pkg/pgcollector"
+)
+
+// loadExampleConfig loads the config of the example, the query files are resolved relative to testdata
+func loadExampleConfig(cfgYAML string) *config.Config {
+	cfg := config.New(config.Stdin)
+	cfg.SetStdin(strings.NewReader(cfgYAML), "testdata")
+	if err := cfg.Load(); err != nil {
+		log.Fatalf("could not load config: %v", err)
+	}
+
+	return cfg
+}
+
+func ExampleNew() {
+	collector := pgcollector.New(context.Background(), pgcollector.Options{
+		DisableInternalMetrics: true,
+		Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+			return dbtest.New(140002).SetRows("select value", map[string]interface{}{"value": 42.0}), nil
+		},
+	})
+	collector.LoadConfig(loadExampleConfig(`test: {host: localhost, queryFiles: [queries.yaml]}`))
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collector)
+	metricFamilies, err := reg.Gather()
+	if err != nil {
+		log.Fatalf("could not gather metrics: %v", err)
+	}
+	for _, mf := range metricFamilies {
+		expfmt.MetricFamilyToText(os.Stdout, mf)
+	}
+	// Output:
+	// # HELP pg_test_value value of the test query
+	// # TYPE pg_test_value gauge
+	// pg_test_value 42
+}
+
+func ExamplePgCollector_CheckQueries() {
+	collector := pgcollector.New(context.Background(), pgcollector.Options{
+		Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+			return dbtest.New(140002).SetError("select value", errors.New(`column "value" does not exist`)), nil
+		},
+	})
+	collector.LoadConfig(loadExampleConfig(`test: {host: localhost, queryFiles: [queries.yaml]}`))
+
+	for _, failed := range collector.CheckQueries() {
+		fmt.Printf("%s\t%s\t%v\n", failed.DbName, failed.Query, failed.Err)
+	}
+	// Output:
+	// test	pg_test	column "value" does not exist
+}
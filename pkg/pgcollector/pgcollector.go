@@ -2,304 +2,1736 @@ package pgcollector
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 
 	"github.com/adjust/postgresql_exporter/pkg/config"
 	"github.com/adjust/postgresql_exporter/pkg/db"
 )
 
 const (
-	internalMetricsNamespace = "pg_exporter"
-	scrapeDurationMetricName = "last_scrape_duration_seconds"
-	timeOutsMetricName       = "last_scrape_timeouts"
-	errorsNumMetricName      = "last_scrape_errors"
+	defaultInternalMetricsNamespace = "pg_exporter"
+	scrapeDurationMetricName        = "last_scrape_duration_seconds"
+	timeOutsMetricName              = "last_scrape_timeouts"
+	errorsNumMetricName             = "last_scrape_errors"
+	lastSuccessMetricName           = "last_success_timestamp_seconds"
+	counterDecreasesMetricName      = "last_scrape_counter_decreases"
+	queryExecutionsMetricName       = "query_executions_total"
+	queryDurationMetricName         = "query_duration_seconds"
+	queryRowsMetricName             = "query_rows"
+	queryVariantMetricName          = "query_variant_info"
+	conversionErrorsMetricName      = "value_conversion_errors_total"
+	reloadSuccessMetricName         = "config_last_reload_success"
+	reloadTimestampMetricName       = "config_last_reload_timestamp_seconds"
+	configFileMtimeMetricName       = "config_file_mtime_seconds"
+	sinceReloadMetricName           = "seconds_since_last_reload"
+	configuredDatabasesMetricName   = "configured_databases"
+	configuredQueriesMetricName     = "configured_queries"
+	connectionErrorsMetricName      = "connection_errors_total"
+	upMetricName                    = "up"
+	staleMetricName                 = "stale"
+	versionMetricName               = "postgres_version"
+	statementTimeoutMetricName      = "statement_timeout_seconds"
+	scrapeWorkersMetricName         = "last_scrape_workers"
+	scrapeQueuedMetricName          = "last_scrape_queued_queries"
+
+	truncatedSuffix = "..."    // Suffix of the truncated label values
+	counterSuffix   = "_total" // Suffix of the counter names
+
+	instanceLabel = "instance" // Label of the per database internal metrics
+	queryLabel    = "query"    // Label of the per query internal metrics
+	versionLabel  = "version"  // Label of the database version
+	minVerLabel   = "min"      // Labels of the version range of the query variant
+	maxVerLabel   = "max"
+	fileLabel     = "file" // Label of the config file
+
+	hostAutoLabel      = "host" // Labels of the connection added with the AutoLabels option
+	portAutoLabel      = "port"
+	dbnameAutoLabel    = "dbname"
+	pgVersionAutoLabel = "pg_version"
 )
 
+// errRowFailed is returned when the row could not be processed, the error is already logged and counted
+var errRowFailed = errors.New("could not process row")
+
+// errRowsLimit is returned to abort the query exceeding the maxRows limit, its metrics are dropped
+var errRowsLimit = errors.New("rows limit reached")
+
 var internalMetricsDescriptions = map[string]string{
-	scrapeDurationMetricName: "Duration of the last scrape of metrics",
-	timeOutsMetricName:       "Number of timed out statements",
-	errorsNumMetricName:      "Number of errors during scraping",
+	scrapeDurationMetricName:      "Duration of the last scrape of metrics",
+	timeOutsMetricName:            "Number of timed out statements",
+	errorsNumMetricName:           "Number of errors during scraping",
+	lastSuccessMetricName:         "Time of the last scrape of the database without errors",
+	counterDecreasesMetricName:    "Number of counters decreased since the previous scrape",
+	queryExecutionsMetricName:     "Number of the query executions",
+	queryDurationMetricName:       "Duration of the last execution of the query",
+	queryRowsMetricName:           "Number of the rows returned by the last execution of the query",
+	queryVariantMetricName:        "Version range of the query variant used in the last execution, empty bound is unlimited",
+	conversionErrorsMetricName:    "Number of the column values which could not be converted",
+	reloadSuccessMetricName:       "Whether the last config reload succeeded",
+	reloadTimestampMetricName:     "Time of the last config reload attempt",
+	sinceReloadMetricName:         "Time passed since the last config reload attempt",
+	configFileMtimeMetricName:     "Modification time of the config file, later than the last reload if the file changed since",
+	configuredDatabasesMetricName: "Number of the databases in the loaded config",
+	configuredQueriesMetricName:   "Number of the queries of the database in the loaded config",
+	connectionErrorsMetricName:    "Number of the failed connection attempts to the database",
+	upMetricName:                  "Whether the last scrape of the database connected and its critical queries succeeded",
+	statementTimeoutMetricName:    "Statement timeout in effect on the database as of the last connection, 0 if disabled",
+	scrapeWorkersMetricName:       "Number of the connections the queries of the database were run on during the last scrape",
+	scrapeQueuedMetricName:        "Number of the queries of the database which waited for a free connection during the last scrape",
+	versionMetricName:             "Version of the database in the server_version_num format, as of the last connection",
+	staleMetricName:               "Whether the metrics of the database are retained from the earlier scrape as the last one could not connect",
+}
+
+// Options describes collector options
+type Options struct {
+	DisableInternalMetrics   bool          // Do not export the internal metrics of the exporter
+	InternalMetricsNamespace string        // Namespace of the internal metrics, "pg_exporter" if empty
+	ClampCounters            bool          // Report the previous value of the decreased counters
+	CounterSuffix            bool          // Append "_total" to the counter names lacking it
+	ScrapeTimeout            time.Duration // Maximum duration of the scrape, unlimited if 0
+	MaxConnections           int           // Maximum number of the open connections to all the databases, unlimited if 0
+	ScrapeSpread             time.Duration // Maximum random delay of the start of the database scrape, 0 to start at once
+	MaxConcurrency           int           // Maximum number of the queries running at once across all the databases, unlimited if 0
+	RetainFailed             time.Duration // How long to serve the last metrics of the database which could not be connected to, 0 to drop them
+	MaxLabelValueLength      int           // Maximum length of the label values, unlimited if 0
+	MaxLabelSets             int           // Maximum number of the label sets per metric of the query, unlimited if 0
+	AbortOnConversionError   bool          // Stop the query on the value which could not be converted instead of skipping it
+	AutoLabels               bool          // Label the metrics with the host, port, dbname and version of the connection
+	StrictColumns            bool          // Fail the query whose first row misses any of the columns its config refers to
+	OmitQueryPrefix          bool          // Do not prefix the metric names with the query name
+	Debug                    bool          // Log the skipped values too noisy for the default log, e.g. NaN
+
+	// Connect opens the connection to the database, db.New if nil. Set it to the dbtest.Conn factory
+	// to test the collector without postgresql
+	Connect func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error)
 }
 
 // PgCollector describes PostgreSQL metrics collector
 type PgCollector struct {
 	sync.Mutex
 	config   config.Interface
+	opts     Options
 	timeOuts uint32
 	errors   uint32
 	ctx      context.Context
+
+	counters         counterValues
+	counterDecreases uint32
+	conversionErrors uint32 // Number of the values which could not be converted, kept across the scrapes
+
+	queryStats map[queryKey]*queryStats   // Stats of the queries, kept across the scrapes
+	connSlots  chan struct{}              // Slots of the open connections limit, nil if unlimited
+	querySlots chan struct{}              // Slots of the concurrent queries limit, nil if unlimited
+	connErrors map[string]*uint32         // Number of the failed connection attempts per database, kept across the scrapes
+	dbVersions map[string]*int64          // Version of the database as of the last connection, kept across the scrapes
+	dbTimeouts map[string]*int64          // Statement timeout in effect as of the last connection, -1 if unknown, kept across the scrapes
+	idleConns  map[string]*[]db.Interface // Connections kept open between the scrapes per database, holding their connection slots
+
+	reloadSuccess bool      // Whether the last config load succeeded
+	reloadTime    time.Time // Time of the last config load attempt
+
+	dbErrors   map[string]*uint32 // Number of errors of the current scrape per database
+	dbCritical map[string]*uint32 // Number of the failed critical queries of the current scrape per database
+	dbWorkers  map[string]*uint32 // Number of the connections of the current scrape per database
+	dbQueued   map[string]*uint32 // Number of the queries which waited for a free connection in the current scrape per database
+	up         map[string]bool    // Whether the last scrape connected and the critical queries succeeded per database
+
+	retained    map[string]retainedMetrics // Metrics of the last scrape which connected per database
+	stale       map[string]bool            // Whether the retained metrics were served by the last scrape per database
+	lastSuccess map[string]time.Time       // Time of the last scrape without errors per database
+
+	spreadDelay func(max time.Duration) time.Duration // Start delay of the database scrape, random up to ScrapeSpread
 }
 
 type workerJob struct {
 	config.Query
-	dbLabels map[string]string
+	dbName       string
+	dbLabels     map[string]string
+	stats        *queryStats
+	summaries    map[summaryKey]prometheus.Summary
+	labelColumns []string
+	infoMetrics  []string
+	labelSets    map[string]*labelSets // Label sets seen per metric, used to limit the cardinality
+	rowNames     map[string]string     // Names of the rows per their metric names, used to detect the collisions
+}
+
+// summaryKey identifies the summary by the metric name and the labels
+type summaryKey struct {
+	name      string
+	signature uint64
+}
+
+// retainedMetrics describes the metrics of the database scrape kept to be served if the next scrapes fail
+type retainedMetrics struct {
+	metrics []prometheus.Metric
+	time    time.Time
+}
+
+// queryKey identifies the query of the database
+type queryKey struct {
+	dbName string
+	query  string
+}
+
+// queryStats describes the stats of the query
+type queryStats struct {
+	executions uint64
+	duration   int64        // Duration of the last execution in nanoseconds
+	rows       int64        // Number of the rows returned by the last execution
+	variant    atomic.Value // config.VerSQL used in the last execution
+}
+
+// labelSets describes the label sets of the metric seen during the job
+type labelSets struct {
+	signatures map[uint64]struct{}
+	dropped    bool // Set once the limit is hit and reported
+}
+
+// allowLabelSet checks if the metric with the labels fits into the limit of the label sets per metric,
+// the warning is logged once the limit is hit
+func (j *workerJob) allowLabelSet(name string, labels prometheus.Labels, limit int) bool {
+	if limit <= 0 {
+		return true
+	}
+
+	if j.labelSets == nil {
+		j.labelSets = make(map[string]*labelSets)
+	}
+	sets, ok := j.labelSets[name]
+	if !ok {
+		sets = &labelSets{signatures: make(map[uint64]struct{})}
+		j.labelSets[name] = sets
+	}
+
+	signature := model.LabelsToSignature(labels)
+	if _, ok := sets.signatures[signature]; ok {
+		return true
+	}
+	if len(sets.signatures) >= limit {
+		if !sets.dropped {
+			log.Printf("%q: metric %q has more than %d label sets, the rest are dropped", j.Name, name, limit)
+			sets.dropped = true
+		}
+		return false
+	}
+	sets.signatures[signature] = struct{}{}
+
+	return true
+}
+
+// allowRowName checks that the metric name made of the row name does not collide with the one made of another,
+// e.g. of "a-b" and "a.b", which would fail the gather
+func (j *workerJob) allowRowName(name, rowName string) bool {
+	if j.rowNames == nil {
+		j.rowNames = make(map[string]string)
+	}
+	if prev, ok := j.rowNames[name]; ok {
+		return prev == rowName
+	}
+	j.rowNames[name] = rowName
+
+	return true
+}
+
+// counterKey identifies the counter of the database by the metric name and the labels
+type counterKey struct {
+	dbName    string
+	name      string
+	signature uint64
+}
+
+// counterValues keeps the counter values of the previous and the current scrapes
+type counterValues struct {
+	sync.Mutex
+	prev map[counterKey]float64
+	cur  map[counterKey]float64
+}
+
+// rotate starts the new scrape, values of the counters not seen in the last scrape are forgotten
+func (c *counterValues) rotate() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.prev = c.cur
+	c.cur = make(map[counterKey]float64)
+}
+
+// observe stores the counter value and returns its value of the previous scrape if there was one
+func (c *counterValues) observe(key counterKey, value float64) (float64, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.cur[key] = value
+	prev, ok := c.prev[key]
+
+	return prev, ok
 }
 
 // New create new instance of the PostgreSQL metrics collector
-func New(ctx context.Context) *PgCollector {
+func New(ctx context.Context, opts Options) *PgCollector {
+	if opts.InternalMetricsNamespace == "" {
+		opts.InternalMetricsNamespace = defaultInternalMetricsNamespace
+	}
+	// leave at least half of the scrape timeout to the queries
+	if opts.ScrapeTimeout > 0 && opts.ScrapeSpread > opts.ScrapeTimeout/2 {
+		opts.ScrapeSpread = opts.ScrapeTimeout / 2
+	}
+
+	var connSlots chan struct{}
+	if opts.MaxConnections > 0 {
+		connSlots = make(chan struct{}, opts.MaxConnections)
+	}
+	var querySlots chan struct{}
+	if opts.MaxConcurrency > 0 {
+		querySlots = make(chan struct{}, opts.MaxConcurrency)
+	}
+
 	return &PgCollector{
-		ctx: ctx,
+		ctx:         ctx,
+		opts:        opts,
+		lastSuccess: make(map[string]time.Time),
+		up:          make(map[string]bool),
+		retained:    make(map[string]retainedMetrics),
+		stale:       make(map[string]bool),
+		counters:    counterValues{cur: make(map[counterKey]float64)},
+		queryStats:  make(map[queryKey]*queryStats),
+		connSlots:   connSlots,
+		querySlots:  querySlots,
+		connErrors:  make(map[string]*uint32),
+		dbVersions:  make(map[string]*int64),
+		dbTimeouts:  make(map[string]*int64),
+		idleConns:   make(map[string]*[]db.Interface),
+		spreadDelay: func(max time.Duration) time.Duration {
+			return time.Duration(rand.Int63n(int64(max)))
+		},
 	}
 }
 
-// LoadConfig loads config
+// LoadConfig loads config, waiting for the running scrape to finish
 func (p *PgCollector) LoadConfig(cfg *config.Config) {
+	p.Lock()
+	defer p.Unlock()
+
 	p.config = cfg
+	p.reloadSuccess = true
+	p.reloadTime = time.Now()
+	// the settings of the databases could have changed
+	p.closeIdleConns()
+}
+
+// Config returns the dump of the config in use
+func (p *PgCollector) Config() ([]byte, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.config.Dump()
+}
+
+// Wait waits for the running scrape to finish, the scrape is canceled along with the context of the collector.
+// The connections kept open between the scrapes are closed
+func (p *PgCollector) Wait() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.closeIdleConns()
+}
+
+// closeIdleConns closes the connections kept open between the scrapes
+func (p *PgCollector) closeIdleConns() {
+	for dbName, idle := range p.idleConns {
+		for _, conn := range *idle {
+			if err := conn.Close(); err != nil {
+				log.Printf("could not close idle db connection for %q: %v", dbName, err)
+			}
+			p.releaseConn()
+		}
+		delete(p.idleConns, dbName)
+	}
+}
+
+// ReloadFailed records the failed config reload, the previous config stays in use
+func (p *PgCollector) ReloadFailed() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.reloadSuccess = false
+	p.reloadTime = time.Now()
+}
+
+// addError counts the scrape error of the database
+func (p *PgCollector) addError(dbName string) {
+	atomic.AddUint32(&p.errors, 1)
+	if dbErrors, ok := p.dbErrors[dbName]; ok {
+		atomic.AddUint32(dbErrors, 1)
+	}
+}
+
+// addQueryError counts the failed query, the failure of the critical query fails the scrape of the database
+func (p *PgCollector) addQueryError(job *workerJob) {
+	p.addError(job.dbName)
+	if !job.Critical {
+		return
+	}
+	if dbCritical, ok := p.dbCritical[job.dbName]; ok {
+		atomic.AddUint32(dbCritical, 1)
+	}
+}
+
+// addConversionError counts the value which could not be converted,
+// it fails the scrape of the database but is not counted as a scrape error
+func (p *PgCollector) addConversionError(dbName string) {
+	atomic.AddUint32(&p.conversionErrors, 1)
+	if dbErrors, ok := p.dbErrors[dbName]; ok {
+		atomic.AddUint32(dbErrors, 1)
+	}
+}
+
+// connect opens the database connection and sets it up, the connection is closed if the setup fails
+func (p *PgCollector) connect(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+	var conn db.Interface
+	var err error
+	if p.opts.Connect != nil {
+		conn, err = p.opts.Connect(ctx, dbConf)
+	} else {
+		conn, err = db.New(ctx, dbConf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create db instance: %v", err)
+	}
+
+	if dbConf.StatementTimeout != 0 {
+		if err := conn.SetStatementTimeout(dbConf.StatementTimeout); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not set statement timeout for %s: %v", dbConf.InstanceName(), err)
+		}
+	}
+
+	return conn, nil
+}
+
+// debugf logs the message with the Debug option only
+func (p *PgCollector) debugf(format string, args ...interface{}) {
+	if p.opts.Debug {
+		log.Printf(format, args...)
+	}
+}
+
+// namespace returns the prefix of the metric names of the query: its name turned into a valid metric name,
+// e.g. "my.query" is "my_query", or nothing with the OmitQueryPrefix option
+func (p *PgCollector) namespace(job *workerJob) string {
+	if p.opts.OmitQueryPrefix {
+		return ""
+	}
+
+	return sanitizeName(job.Name)
 }
 
-func createMetric(job *workerJob, name string, constLabels prometheus.Labels, rawValue interface{}) (prometheus.Metric, error) {
-	switch job.Metrics[name].Usage {
+func (p *PgCollector) createMetric(job *workerJob, name string, metric config.Metric, constLabels prometheus.Labels, rawValue interface{}, row map[string]interface{}) (prometheus.Metric, error) {
+	if !job.allowLabelSet(name, constLabels, p.opts.MaxLabelSets) {
+		return nil, nil
+	}
+
+	switch metric.Usage {
 	case config.Counter:
+		if p.opts.CounterSuffix && !strings.HasSuffix(name, counterSuffix) {
+			name += counterSuffix
+		}
 		m := prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace:   job.Name,
+			Namespace:   p.namespace(job),
 			Name:        name,
-			Help:        job.Metrics[name].Description,
+			Help:        metric.Description,
 			ConstLabels: constLabels,
 		})
 		val, err := db.ToFloat64(rawValue)
 		if err != nil {
 			return nil, fmt.Errorf("could not convert to float64: %v", err)
 		}
+		if math.IsNaN(val) {
+			p.debugf("%q: skipping NaN value of %q", job.Name, name)
+			return nil, nil
+		}
+		// the counter panics on the negative value, the gauges are passed through as is
+		if val < 0 {
+			return nil, fmt.Errorf("negative value %v of counter %q, use GAUGE for the values which can be negative", val, name)
+		}
+
+		key := counterKey{
+			dbName:    job.dbName,
+			name:      prometheus.BuildFQName(p.namespace(job), "", name),
+			signature: model.LabelsToSignature(constLabels),
+		}
+		if prev, ok := p.counters.observe(key, val); ok && val < prev {
+			log.Printf("%q: counter %q decreased from %v to %v, check if it is a gauge", job.Name, name, prev, val)
+			atomic.AddUint32(&p.counterDecreases, 1)
+			if p.opts.ClampCounters {
+				p.counters.observe(key, prev)
+				val = prev
+			}
+		}
 
 		m.Add(val)
 		return m, nil
 	case config.Gauge:
 		m := prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace:   job.Name,
+			Namespace:   p.namespace(job),
 			Name:        name,
-			Help:        job.Metrics[name].Description,
+			Help:        metric.Description,
 			ConstLabels: constLabels,
 		})
 		val, err := db.ToFloat64(rawValue)
 		if err != nil {
 			return nil, fmt.Errorf("could not convert to float64: %v", err)
 		}
+		if math.IsNaN(val) {
+			p.debugf("%q: skipping NaN value of %q", job.Name, name)
+			return nil, nil
+		}
 
 		m.Add(val)
 		return m, nil
+	case config.Summary:
+		val, err := db.ToFloat64(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert to float64: %v", err)
+		}
+		if math.IsNaN(val) {
+			p.debugf("%q: skipping NaN value of %q", job.Name, name)
+			return nil, nil
+		}
+
+		// rows with the same labels are observed by the same summary, which is sent once the job is done
+		key := summaryKey{name: name, signature: model.LabelsToSignature(constLabels)}
+		m, ok := job.summaries[key]
+		if !ok {
+			m = prometheus.NewSummary(prometheus.SummaryOpts{
+				Namespace:   p.namespace(job),
+				Name:        name,
+				Help:        metric.Description,
+				ConstLabels: constLabels,
+				Objectives:  metric.Quantiles,
+			})
+			job.summaries[key] = m
+		}
+
+		m.Observe(val)
+		return nil, nil
+	case config.Histogram:
+		count, err := histogramCount(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert count of histogram %q: %v", name, err)
+		}
+		sum, err := db.ToFloat64(row[metric.SumColumn])
+		if err != nil {
+			return nil, fmt.Errorf("could not convert sum column %q to float64: %v", metric.SumColumn, err)
+		}
+
+		bounds := make([]float64, 0, len(metric.Buckets))
+		buckets := make(map[float64]uint64, len(metric.Buckets))
+		for bound, column := range metric.Buckets {
+			val, err := histogramCount(row[column])
+			if err != nil {
+				return nil, fmt.Errorf("could not convert bucket column %q of histogram %q: %v", column, name, err)
+			}
+			bounds = append(bounds, bound)
+			buckets[bound] = val
+		}
+
+		// the buckets are cumulative, each one counts the observations of the previous ones
+		sort.Float64s(bounds)
+		prev := uint64(0)
+		for _, bound := range bounds {
+			if buckets[bound] < prev {
+				return nil, fmt.Errorf("count %d of bucket %v of histogram %q is below the count %d of the previous bucket", buckets[bound], bound, name, prev)
+			}
+			prev = buckets[bound]
+		}
+		if count < prev {
+			return nil, fmt.Errorf("count %d of histogram %q is below the count %d of its buckets", count, name, prev)
+		}
+
+		desc := prometheus.NewDesc(prometheus.BuildFQName(p.namespace(job), "", name), metric.Description, nil, constLabels)
+		return prometheus.NewConstHistogram(desc, count, sum, buckets)
+	case config.Info:
+		m := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   p.namespace(job),
+			Name:        name,
+			Help:        metric.Description,
+			ConstLabels: constLabels,
+		})
+
+		m.Set(1)
+		return m, nil
 	}
 
 	return nil, nil
 }
 
-func (p *PgCollector) worker(conn db.Interface, jobs chan *workerJob, res chan<- prometheus.Metric, wg *sync.WaitGroup) {
+// histogramCount converts the count of the histogram or its bucket, NULL, NaN and the negative counts are rejected
+func histogramCount(value interface{}) (uint64, error) {
+	val, err := db.ToFloat64(value)
+	if err != nil {
+		return 0, fmt.Errorf("could not convert to float64: %v", err)
+	}
+	if math.IsNaN(val) || val < 0 {
+		return 0, fmt.Errorf("invalid count %v", val)
+	}
+
+	return uint64(val), nil
+}
+
+// worker runs the job batches on the connection, the batches of several jobs are run in a transaction.
+// The dead connection is replaced with a new one
+func (p *PgCollector) worker(ctx context.Context, conn *db.Interface, jobs chan []*workerJob, res chan<- prometheus.Metric, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-jobs:
-	for job := range jobs {
-		pgVer := conn.PgVersion()
-		sql := job.VerSQL.Query(pgVer)
-		if sql == "" {
-			log.Printf("could not find proper %q query variant for postgresql version %q", job.Name, pgVer)
-			atomic.AddUint32(&p.errors, 1)
+	for batch := range jobs {
+		if len(batch) == 1 {
+			p.runJob(ctx, conn, batch[0], false, res)
 			continue
 		}
 
-		labelColumns := make([]string, 0)
-		for metricName, metric := range job.Metrics {
-			if metric.Usage == config.Label {
-				labelColumns = append(labelColumns, metricName)
-				continue
+		if err := (*conn).Begin(); err != nil {
+			log.Printf("could not begin transaction of %q: %v", batch[0].Transaction, err)
+			for _, job := range batch {
+				p.addQueryError(job)
 			}
+			continue
+		}
+		for _, job := range batch {
+			p.runJob(ctx, conn, job, true, res)
+		}
+		if err := (*conn).Commit(); err != nil {
+			log.Printf("could not commit transaction of %q: %v", batch[0].Transaction, err)
+			p.addError(batch[0].dbName)
 		}
+	}
+}
 
-		rows, err := conn.Exec(sql)
-		if err != nil {
-			if err == db.ErrQueryTimeout {
-				atomic.AddUint32(&p.timeOuts, 1)
-			}
-			atomic.AddUint32(&p.errors, 1)
-			log.Printf("could not fetch metric %q: %v", job.Name, err)
-			continue
+// runJob runs the query of the job, sending its metrics to res
+func (p *PgCollector) runJob(ctx context.Context, conn *db.Interface, job *workerJob, inTx bool, res chan<- prometheus.Metric) {
+	pgVer := (*conn).PgVersion()
+	variant := job.Variant(pgVer)
+	sql := variant.SQL
+	if sql == "" {
+		log.Printf("could not find proper %q query variant for postgresql version %q", job.Name, pgVer)
+		p.addQueryError(job)
+		return
+	}
+	job.stats.variant.Store(variant)
+
+	for metricName, metric := range job.Metrics {
+		switch metric.Usage {
+		case config.Label:
+			job.labelColumns = append(job.labelColumns, metricName)
+		case config.Info:
+			job.infoMetrics = append(job.infoMetrics, metricName)
 		}
-		for _, row := range rows {
-			labels := make(map[string]string)
+	}
 
-			for _, columnName := range labelColumns {
-				val, ok := db.ToString(row[columnName])
-				if !ok {
-					log.Printf("%q: could not convert metric column value '%[2]v'(%[2]T) to string", job.Name, row[columnName])
-					atomic.AddUint32(&p.errors, 1)
-				}
-				labels[columnName] = val
-			}
-			constLabels := mergeLabels(job.dbLabels, labels)
+	if !p.acquireQuery(ctx) {
+		log.Printf("could not fetch metric %q: scrape timed out waiting for a free query slot", job.Name)
+		atomic.AddUint32(&p.timeOuts, 1)
+		p.addQueryError(job)
+		return
+	}
 
-			if job.NameColumn != "" {
-				metricName, ok := db.ToString(row[job.NameColumn])
-				if !ok {
-					log.Printf("%q: could not convert %v to string", job.Name, row[job.NameColumn])
-					atomic.AddUint32(&p.errors, 1)
-					continue jobs
-				}
+	// the metrics of the query limited by maxRows are held back until all of its rows are read,
+	// as exceeding the limit drops them all rather than an arbitrary subset of them
+	emit := func(m prometheus.Metric) { res <- m }
+	var held []prometheus.Metric
+	if job.MaxRows > 0 {
+		emit = func(m prometheus.Metric) { held = append(held, m) }
+	}
 
-				m, err := createMetric(job, metricName, constLabels, row[job.ValueColumn])
-				if err != nil {
-					log.Printf("%q: could not create metric: %v", job.Name, err)
-					atomic.AddUint32(&p.errors, 1)
-					continue jobs
-				}
-				if m != nil {
-					res <- m
-				}
-			} else {
-				for colName, colValue := range row {
-					if _, ok := labels[colName]; ok {
-						continue
-					}
-
-					if _, ok := job.Metrics[colName]; !ok {
-						continue
-					}
-
-					m, err := createMetric(job, colName, constLabels, colValue)
-					if err != nil {
-						log.Printf("could not create metric: %v", err)
-						atomic.AddUint32(&p.errors, 1)
-						continue jobs
-					}
-					if m != nil {
-						res <- m
-					}
+	rowsCnt := 0
+	start := time.Now()
+	exec := func() error {
+		atomic.AddUint64(&job.stats.executions, 1)
+		return (*conn).ExecFunc(sql, func(row map[string]interface{}) error {
+			if job.MaxRows > 0 && rowsCnt >= job.MaxRows {
+				log.Printf("%q: query returned more than %d rows, its metrics are dropped", job.Name, job.MaxRows)
+				p.addError(job.dbName)
+				return errRowsLimit
+			}
+			rowsCnt++
+			// the columns are checked in the first row only, so the query returning no rows is not checked
+			if rowsCnt == 1 && p.opts.StrictColumns {
+				if missing := missingColumns(job.Columns(), row); len(missing) > 0 {
+					log.Printf("%q: columns %s are missing from the query result", job.Name, strings.Join(missing, ", "))
+					p.addQueryError(job)
+					return errRowFailed
 				}
 			}
+
+			return p.processRow(job, row, emit)
+		}, job.Args...)
+	}
+	err := exec()
+	// the connection could have been closed by the server, e.g. on restart: the query is retried once
+	// on a new connection, unless some rows were already processed or the query is run in a transaction
+	if err != nil && err != errRowFailed && err != errRowsLimit && rowsCnt == 0 && !inTx && !(*conn).IsAlive() && ctx.Err() == nil && p.reconnect(ctx, job.dbName, conn) {
+		start = time.Now()
+		err = exec()
+	}
+	p.releaseQuery()
+	atomic.StoreInt64(&job.stats.duration, int64(time.Since(start)))
+	atomic.StoreInt64(&job.stats.rows, int64(rowsCnt))
+	if err == errRowFailed || err == errRowsLimit {
+		return
+	}
+	if err != nil {
+		if err == db.ErrQueryTimeout || err == db.ErrScrapeTimeout {
+			atomic.AddUint32(&p.timeOuts, 1)
 		}
+		p.addQueryError(job)
+		log.Printf("could not fetch metric %q: %v", job.Name, err)
+		return
+	}
+
+	for _, m := range held {
+		res <- m
+	}
+	for _, m := range job.summaries {
+		res <- m
 	}
 }
 
-// Collect implements Collect method of the Collector interface
-func (p *PgCollector) Collect(metricsCh chan<- prometheus.Metric) {
-	p.Lock()
-	defer p.Unlock()
-	defer func(start time.Time) {
-		gm := prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: internalMetricsNamespace,
-			Name:      scrapeDurationMetricName,
-			Help:      internalMetricsDescriptions[scrapeDurationMetricName],
-		})
-		gm.Set(time.Since(start).Seconds())
-		metricsCh <- gm
+// missingColumns returns the columns absent from the row
+func missingColumns(columns []string, row map[string]interface{}) []string {
+	var missing []string
+	for _, column := range columns {
+		if _, ok := row[column]; !ok {
+			missing = append(missing, column)
+		}
+	}
 
-		cm := prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: internalMetricsNamespace,
-			Name:      timeOutsMetricName,
-			Help:      internalMetricsDescriptions[timeOutsMetricName],
-		})
-		cm.Add(float64(atomic.LoadUint32(&p.timeOuts)))
-		metricsCh <- cm
+	return missing
+}
 
-		cm = prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: internalMetricsNamespace,
-			Name:      errorsNumMetricName,
-			Help:      internalMetricsDescriptions[errorsNumMetricName],
-		})
-		cm.Add(float64(atomic.LoadUint32(&p.errors)))
-		metricsCh <- cm
-	}(time.Now())
+// conversionFailed returns the error stopping the query on the value which could not be converted
+// if AbortOnConversionError is set, nil to skip just the metric or the row otherwise
+func (p *PgCollector) conversionFailed() error {
+	if p.opts.AbortOnConversionError {
+		return errRowFailed
+	}
 
-	atomic.StoreUint32(&p.timeOuts, 0)
-	atomic.StoreUint32(&p.errors, 0)
+	return nil
+}
 
-	wg := &sync.WaitGroup{}
+// processRow emits the metrics of the row, errRowFailed is returned if the rest of the rows should be skipped.
+// Panic caused by the row values, e.g. invalid summary objectives, is recovered and counted as an error
+func (p *PgCollector) processRow(job *workerJob, row map[string]interface{}, emit func(prometheus.Metric)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("%q: could not process row: %v", job.Name, r)
+			p.addError(job.dbName)
+			err = errRowFailed
+		}
+	}()
 
-	dbPool := make(map[string][]db.Interface)
-	dbJobs := make(map[string]chan *workerJob)
+	if job.NameColumn != "" && job.NameTemplate == "" && row[job.NameColumn] == nil {
+		log.Printf("%q: skipping the row with NULL name column %q", job.Name, job.NameColumn)
+		p.addConversionError(job.dbName)
+		return nil
+	}
 
-	for _, dbName := range p.config.DbList() {
-		dbConf := p.config.Db(dbName)
-		workersCnt := dbConf.Workers()
+	labels := make(map[string]string)
 
-		dbPool[dbName] = make([]db.Interface, 0)
-		for i := 0; i < workersCnt; i++ {
-			conn, err := db.New(p.ctx, dbConf)
-			if err != nil {
-				log.Printf("could not create db instance %q: %v", dbName, err)
-				atomic.AddUint32(&p.errors, 1)
-				break
-			}
-			if dbConf.StatementTimeout != 0 {
-				if err := conn.SetStatementTimeout(dbConf.StatementTimeout); err != nil {
-					log.Printf("could not set statement timeout for %s: %v", dbConf.InstanceName(), err)
-					atomic.AddUint32(&p.errors, 1)
-					break
+	for _, columnName := range job.labelColumns {
+		// hstore columns are expanded into a label per key, the keys colliding once sanitized are skipped
+		if pairs, ok := db.ToLabels(row[columnName]); ok {
+			keys := make(map[string][]string, len(pairs))
+			for key := range pairs {
+				keys[sanitizeName(key)] = append(keys[sanitizeName(key)], key)
+			}
+			for label, labelKeys := range keys {
+				if len(labelKeys) > 1 {
+					sort.Strings(labelKeys)
+					log.Printf("%q: skipping the keys %q of column %q colliding as label %q", job.Name, labelKeys, columnName, label)
+					continue
 				}
+				labels[label] = truncateValue(pairs[labelKeys[0]], p.opts.MaxLabelValueLength)
 			}
-
-			dbPool[dbName] = append(dbPool[dbName], conn)
+			continue
 		}
-		dbJobs[dbName] = make(chan *workerJob, len(dbPool[dbName]))
 
-		for _, conn := range dbPool[dbName] {
-			wg.Add(1)
-			go p.worker(conn, dbJobs[dbName], metricsCh, wg)
+		// array elements are joined into a single label value
+		if values, ok := db.ToStrings(row[columnName]); ok {
+			val := strings.Join(values, job.Metrics[columnName].LabelSeparator())
+			labels[columnName] = truncateValue(val, p.opts.MaxLabelValueLength)
+			continue
 		}
 
-		for _, query := range dbConf.Queries() {
-			if len(dbPool[dbName]) > 0 {
-				dbJobs[dbName] <- &workerJob{
-					dbLabels: dbConf.Labels(),
-					Query:    query,
-				}
-			}
+		val, ok := db.ToString(row[columnName])
+		if !ok {
+			log.Printf("%q: could not convert metric column value '%[2]v'(%[2]T) to string", job.Name, row[columnName])
+			p.addConversionError(job.dbName)
 		}
-		close(dbJobs[dbName])
+		labels[columnName] = truncateValue(val, p.opts.MaxLabelValueLength)
 	}
+	constLabels := mergeLabels(job.dbLabels, job.Labels, labels)
 
-	wg.Wait()
-	for dbName, dbs := range dbPool {
-		for id, dbConn := range dbs {
-			if dbConn == nil {
-				continue
+	// scale returns the value divided by the divisor column, false if the value is to be skipped
+	scale := func(colName string, value interface{}) (interface{}, bool) {
+		return value, true
+	}
+	if job.DivisorColumn != "" {
+		divisor, err := db.ToFloat64(row[job.DivisorColumn])
+		if err != nil {
+			log.Printf("%q: could not convert divisor column value '%[2]v'(%[2]T): %v", job.Name, row[job.DivisorColumn], err)
+			p.addConversionError(job.dbName)
+			return p.conversionFailed()
+		}
+		// the values of the row which are not scaled, e.g. the divisor itself, are still sent
+		validDivisor := divisor != 0 && !math.IsNaN(divisor)
+		if !validDivisor {
+			log.Printf("%q: skipping the values scaled by the divisor column %q of value %v", job.Name, job.DivisorColumn, divisor)
+			p.addConversionError(job.dbName)
+			if err := p.conversionFailed(); err != nil {
+				return err
 			}
+		}
 
-			if err := dbConn.Close(); err != nil {
-				log.Fatalf("%d: could not close db connection for %q: %v", id, dbName, err)
+		scale = func(colName string, value interface{}) (interface{}, bool) {
+			if colName == job.DivisorColumn || job.Metrics[colName].Usage == config.Histogram {
+				return value, true
 			}
+			if !validDivisor {
+				return nil, false
+			}
+			val, err := db.ToFloat64(value)
+			if err != nil {
+				// the conversion error is reported on the metric creation
+				return value, true
+			}
+
+			return val / divisor, true
 		}
 	}
-}
 
-// Describe implements Describe method of the Collector interface
-func (p *PgCollector) Describe(ch chan<- *prometheus.Desc) {
-	for _, dbName := range p.config.DbList() {
-		dbConf := p.config.Db(dbName)
-		for _, query := range dbConf.Queries() {
-			for metricName, metric := range query.Metrics {
-				if metric.Usage == config.Label ||
-					metric.Usage == config.Discard {
-					continue
-				}
-				ch <- prometheus.NewDesc(
-					prometheus.BuildFQName(query.Name, "", metricName),
-					metric.Description,
-					[]string{},
-					nil)
-			}
+	send := emit
+	if job.TimestampColumn != "" {
+		timestamp, err := toTimestamp(row[job.TimestampColumn])
+		if err != nil {
+			log.Printf("%q: could not convert timestamp column value '%[2]v'(%[2]T): %v", job.Name, row[job.TimestampColumn], err)
+			p.addConversionError(job.dbName)
+			return p.conversionFailed()
 		}
-	}
 
-	for name, description := range internalMetricsDescriptions {
-		ch <- prometheus.NewDesc(
-			prometheus.BuildFQName(internalMetricsNamespace, "", name),
-			description, []string{}, nil)
+		send = func(m prometheus.Metric) {
+			emit(prometheus.NewMetricWithTimestamp(timestamp, m))
+		}
 	}
-}
 
-func mergeLabels(a, b map[string]string) prometheus.Labels {
-	res := make(prometheus.Labels)
-	for id, value := range a {
-		res[id] = value
+	for _, metricName := range job.infoMetrics {
+		m, err := p.createMetric(job, metricName, job.Metrics[metricName], constLabels, nil, row)
+		if err != nil {
+			log.Printf("%q: could not create metric: %v", job.Name, err)
+			p.addConversionError(job.dbName)
+			if err := p.conversionFailed(); err != nil {
+				return err
+			}
+			continue
+		}
+		if m != nil {
+			send(m)
+		}
 	}
 
-	for id, value := range b {
-		res[id] = value
-	}
+	if job.NameColumn == "" && job.NameTemplate == "" {
+		for colName, colValue := range row {
+			if metric, ok := job.Metrics[colName]; !ok || metric.Usage == config.Label || metric.Usage == config.Info {
+				continue
+			}
 
-	return res
+			value, ok := scale(colName, colValue)
+			if !ok {
+				continue
+			}
+			m, err := p.createMetric(job, colName, job.Metrics[colName], constLabels, value, row)
+			if err != nil {
+				log.Printf("could not create metric: %v", err)
+				p.addConversionError(job.dbName)
+				if err := p.conversionFailed(); err != nil {
+					return err
+				}
+				continue
+			}
+			if m != nil {
+				send(m)
+			}
+		}
+
+		return nil
+	}
+
+	name, err := p.metricName(job, row)
+	if err != nil {
+		log.Printf("%q: %v", job.Name, err)
+		return p.conversionFailed()
+	}
+	// the empty name is skipped as the NULL one
+	if name == "" {
+		log.Printf("%q: skipping the row with empty metric name", job.Name)
+		p.addConversionError(job.dbName)
+		return nil
+	}
+	if !job.allowRowName(sanitizeName(name), name) {
+		log.Printf("%q: skipping the row with metric name %q colliding with %q", job.Name, name, job.rowNames[sanitizeName(name)])
+		p.addConversionError(job.dbName)
+		return nil
+	}
+
+	if len(job.ValueColumns) == 0 {
+		value, ok := scale(job.ValueColumn, row[job.ValueColumn])
+		if !ok {
+			return nil
+		}
+		m, err := p.createMetric(job, sanitizeName(name), job.Metrics[name], constLabels, value, row)
+		if err != nil {
+			log.Printf("%q: could not create metric: %v", job.Name, err)
+			p.addConversionError(job.dbName)
+			return p.conversionFailed()
+		}
+		if m != nil {
+			send(m)
+		}
+
+		return nil
+	}
+
+	for _, valueColumn := range job.ValueColumns {
+		metricName := name + "_" + valueColumn
+		metric, ok := job.Metrics[metricName]
+		if !ok {
+			metric = job.Metrics[valueColumn]
+		}
+
+		value, ok := scale(valueColumn, row[valueColumn])
+		if !ok {
+			continue
+		}
+		m, err := p.createMetric(job, sanitizeName(metricName), metric, constLabels, value, row)
+		if err != nil {
+			log.Printf("%q: could not create metric: %v", job.Name, err)
+			p.addConversionError(job.dbName)
+			if err := p.conversionFailed(); err != nil {
+				return err
+			}
+			continue
+		}
+		if m != nil {
+			send(m)
+		}
+	}
+
+	return nil
+}
+
+// metricName returns the metric name of the nameColumn or nameTemplate query row, empty if the column
+// is empty or the template renders nothing
+func (p *PgCollector) metricName(job *workerJob, row map[string]interface{}) (string, error) {
+	if job.NameTemplate == "" {
+		name, ok := db.ToString(row[job.NameColumn])
+		if !ok {
+			p.addConversionError(job.dbName)
+			return "", fmt.Errorf("could not convert %v to string", row[job.NameColumn])
+		}
+
+		return name, nil
+	}
+
+	columns := make(map[string]string, len(row))
+	for colName, colValue := range row {
+		if val, ok := db.ToString(colValue); ok {
+			columns[colName] = val
+		}
+	}
+
+	// the template fails on the row data, e.g. the NULL or missing column, as the nameColumn conversion does
+	name, err := job.MetricName(columns)
+	if err != nil {
+		p.addConversionError(job.dbName)
+		return "", err
+	}
+
+	return name, nil
+}
+
+// QueryCheckError describes the query which could not be prepared on the database,
+// Query is empty if the database could not be connected to
+type QueryCheckError struct {
+	DbName string
+	Query  string
+	Err    error
+}
+
+// CheckQueries prepares the queries chosen for the version of each database without executing them.
+// The databases which are not postgresql are skipped, as they do not support preparing the queries
+func (p *PgCollector) CheckQueries() []QueryCheckError {
+	p.Lock()
+	defer p.Unlock()
+
+	var res []QueryCheckError
+	for _, dbName := range p.config.DbList() {
+		dbConf := p.config.Db(dbName)
+		if dbConf.IsNotPg {
+			log.Printf("skipping %q: queries can be checked on postgresql only", dbName)
+			continue
+		}
+
+		conn, err := p.connect(p.ctx, dbConf)
+		if err != nil {
+			res = append(res, QueryCheckError{DbName: dbName, Err: err})
+			continue
+		}
+
+		for _, query := range dbConf.Queries() {
+			sql := query.SQL(conn.PgVersion())
+			if sql == "" {
+				continue
+			}
+
+			if err := conn.Prepare(sql); err != nil {
+				res = append(res, QueryCheckError{DbName: dbName, Query: query.Name, Err: err})
+			}
+		}
+
+		if err := conn.Close(); err != nil {
+			log.Printf("could not close db connection for %q: %v", dbName, err)
+		}
+	}
+
+	return res
+}
+
+// Probe connects to each database, returning the errors of the databases which could not be connected to
+func (p *PgCollector) Probe() []QueryCheckError {
+	p.Lock()
+	defer p.Unlock()
+
+	var res []QueryCheckError
+	for _, dbName := range p.config.DbList() {
+		conn, err := p.connect(p.ctx, p.config.Db(dbName))
+		if err != nil {
+			res = append(res, QueryCheckError{DbName: dbName, Err: err})
+			continue
+		}
+
+		if err := conn.Close(); err != nil {
+			log.Printf("could not close db connection for %q: %v", dbName, err)
+		}
+	}
+
+	return res
+}
+
+// Collect implements Collect method of the Collector interface
+func (p *PgCollector) Collect(metricsCh chan<- prometheus.Metric) {
+	p.Lock()
+	defer p.Unlock()
+	defer func(start time.Time) {
+		if p.opts.DisableInternalMetrics {
+			return
+		}
+
+		gm := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: p.opts.InternalMetricsNamespace,
+			Name:      scrapeDurationMetricName,
+			Help:      internalMetricsDescriptions[scrapeDurationMetricName],
+		})
+		gm.Set(time.Since(start).Seconds())
+		metricsCh <- gm
+
+		cm := prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: p.opts.InternalMetricsNamespace,
+			Name:      timeOutsMetricName,
+			Help:      internalMetricsDescriptions[timeOutsMetricName],
+		})
+		cm.Add(float64(atomic.LoadUint32(&p.timeOuts)))
+		metricsCh <- cm
+
+		cm = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: p.opts.InternalMetricsNamespace,
+			Name:      errorsNumMetricName,
+			Help:      internalMetricsDescriptions[errorsNumMetricName],
+		})
+		cm.Add(float64(atomic.LoadUint32(&p.errors)))
+		metricsCh <- cm
+
+		cm = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: p.opts.InternalMetricsNamespace,
+			Name:      counterDecreasesMetricName,
+			Help:      internalMetricsDescriptions[counterDecreasesMetricName],
+		})
+		cm.Add(float64(atomic.LoadUint32(&p.counterDecreases)))
+		metricsCh <- cm
+
+		cm = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: p.opts.InternalMetricsNamespace,
+			Name:      conversionErrorsMetricName,
+			Help:      internalMetricsDescriptions[conversionErrorsMetricName],
+		})
+		cm.Add(float64(atomic.LoadUint32(&p.conversionErrors)))
+		metricsCh <- cm
+
+		gm = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: p.opts.InternalMetricsNamespace,
+			Name:      reloadSuccessMetricName,
+			Help:      internalMetricsDescriptions[reloadSuccessMetricName],
+		})
+		if p.reloadSuccess {
+			gm.Set(1)
+		}
+		metricsCh <- gm
+
+		gm = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: p.opts.InternalMetricsNamespace,
+			Name:      reloadTimestampMetricName,
+			Help:      internalMetricsDescriptions[reloadTimestampMetricName],
+		})
+		gm.Set(float64(p.reloadTime.UnixNano()) / 1e9)
+		metricsCh <- gm
+
+		gm = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: p.opts.InternalMetricsNamespace,
+			Name:      sinceReloadMetricName,
+			Help:      internalMetricsDescriptions[sinceReloadMetricName],
+		})
+		gm.Set(time.Since(p.reloadTime).Seconds())
+		metricsCh <- gm
+
+		for _, filename := range p.config.Files() {
+			info, err := os.Stat(filename)
+			if err != nil {
+				log.Printf("could not stat config file: %v", err)
+				continue
+			}
+
+			gm := prometheus.NewGauge(prometheus.GaugeOpts{
+				Namespace:   p.opts.InternalMetricsNamespace,
+				Name:        configFileMtimeMetricName,
+				Help:        internalMetricsDescriptions[configFileMtimeMetricName],
+				ConstLabels: prometheus.Labels{fileLabel: filename},
+			})
+			gm.Set(float64(info.ModTime().UnixNano()) / 1e9)
+			metricsCh <- gm
+		}
+
+		gm = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: p.opts.InternalMetricsNamespace,
+			Name:      configuredDatabasesMetricName,
+			Help:      internalMetricsDescriptions[configuredDatabasesMetricName],
+		})
+		gm.Set(float64(len(p.config.DbList())))
+		metricsCh <- gm
+
+		for _, dbName := range p.config.DbList() {
+			dbConf := p.config.Db(dbName)
+			gm := prometheus.NewGauge(prometheus.GaugeOpts{
+				Namespace:   p.opts.InternalMetricsNamespace,
+				Name:        configuredQueriesMetricName,
+				Help:        internalMetricsDescriptions[configuredQueriesMetricName],
+				ConstLabels: prometheus.Labels{instanceLabel: dbName},
+			})
+			gm.Set(float64(len(dbConf.Queries())))
+			metricsCh <- gm
+
+			gm = prometheus.NewGauge(prometheus.GaugeOpts{
+				Namespace:   p.opts.InternalMetricsNamespace,
+				Name:        upMetricName,
+				Help:        internalMetricsDescriptions[upMetricName],
+				ConstLabels: prometheus.Labels{instanceLabel: dbName},
+			})
+			if p.up[dbName] {
+				gm.Set(1)
+			}
+			metricsCh <- gm
+
+			if p.opts.RetainFailed > 0 {
+				gm := prometheus.NewGauge(prometheus.GaugeOpts{
+					Namespace:   p.opts.InternalMetricsNamespace,
+					Name:        staleMetricName,
+					Help:        internalMetricsDescriptions[staleMetricName],
+					ConstLabels: prometheus.Labels{instanceLabel: dbName},
+				})
+				if p.stale[dbName] {
+					gm.Set(1)
+				}
+				metricsCh <- gm
+			}
+
+			if version, ok := p.dbVersions[dbName]; ok && config.PgVersion(atomic.LoadInt64(version)) != config.NoVersion {
+				pgVersion := config.PgVersion(atomic.LoadInt64(version))
+				gm := prometheus.NewGauge(prometheus.GaugeOpts{
+					Namespace:   p.opts.InternalMetricsNamespace,
+					Name:        versionMetricName,
+					Help:        internalMetricsDescriptions[versionMetricName],
+					ConstLabels: prometheus.Labels{instanceLabel: dbName, versionLabel: versionString(pgVersion)},
+				})
+				gm.Set(float64(pgVersion))
+				metricsCh <- gm
+			}
+
+			if workers, ok := p.dbWorkers[dbName]; ok {
+				gm := prometheus.NewGauge(prometheus.GaugeOpts{
+					Namespace:   p.opts.InternalMetricsNamespace,
+					Name:        scrapeWorkersMetricName,
+					Help:        internalMetricsDescriptions[scrapeWorkersMetricName],
+					ConstLabels: prometheus.Labels{instanceLabel: dbName},
+				})
+				gm.Set(float64(atomic.LoadUint32(workers)))
+				metricsCh <- gm
+
+				gm = prometheus.NewGauge(prometheus.GaugeOpts{
+					Namespace:   p.opts.InternalMetricsNamespace,
+					Name:        scrapeQueuedMetricName,
+					Help:        internalMetricsDescriptions[scrapeQueuedMetricName],
+					ConstLabels: prometheus.Labels{instanceLabel: dbName},
+				})
+				gm.Set(float64(atomic.LoadUint32(p.dbQueued[dbName])))
+				metricsCh <- gm
+			}
+
+			if timeout, ok := p.dbTimeouts[dbName]; ok && atomic.LoadInt64(timeout) >= 0 {
+				gm := prometheus.NewGauge(prometheus.GaugeOpts{
+					Namespace:   p.opts.InternalMetricsNamespace,
+					Name:        statementTimeoutMetricName,
+					Help:        internalMetricsDescriptions[statementTimeoutMetricName],
+					ConstLabels: prometheus.Labels{instanceLabel: dbName},
+				})
+				gm.Set(time.Duration(atomic.LoadInt64(timeout)).Seconds())
+				metricsCh <- gm
+			}
+
+			if connErrors, ok := p.connErrors[dbName]; ok {
+				cm := prometheus.NewCounter(prometheus.CounterOpts{
+					Namespace:   p.opts.InternalMetricsNamespace,
+					Name:        connectionErrorsMetricName,
+					Help:        internalMetricsDescriptions[connectionErrorsMetricName],
+					ConstLabels: prometheus.Labels{instanceLabel: dbName},
+				})
+				cm.Add(float64(atomic.LoadUint32(connErrors)))
+				metricsCh <- cm
+			}
+
+			if lastSuccess, ok := p.lastSuccess[dbName]; ok {
+				gm := prometheus.NewGauge(prometheus.GaugeOpts{
+					Namespace:   p.opts.InternalMetricsNamespace,
+					Name:        lastSuccessMetricName,
+					Help:        internalMetricsDescriptions[lastSuccessMetricName],
+					ConstLabels: prometheus.Labels{instanceLabel: dbName},
+				})
+				gm.Set(float64(lastSuccess.UnixNano()) / 1e9)
+				metricsCh <- gm
+			}
+
+			for _, query := range dbConf.Queries() {
+				stats, ok := p.queryStats[queryKey{dbName: dbName, query: query.Name}]
+				if !ok {
+					continue
+				}
+
+				cm := prometheus.NewCounter(prometheus.CounterOpts{
+					Namespace:   p.opts.InternalMetricsNamespace,
+					Name:        queryExecutionsMetricName,
+					Help:        internalMetricsDescriptions[queryExecutionsMetricName],
+					ConstLabels: prometheus.Labels{instanceLabel: dbName, queryLabel: query.Name},
+				})
+				cm.Add(float64(atomic.LoadUint64(&stats.executions)))
+				metricsCh <- cm
+
+				gm := prometheus.NewGauge(prometheus.GaugeOpts{
+					Namespace:   p.opts.InternalMetricsNamespace,
+					Name:        queryDurationMetricName,
+					Help:        internalMetricsDescriptions[queryDurationMetricName],
+					ConstLabels: prometheus.Labels{instanceLabel: dbName, queryLabel: query.Name},
+				})
+				gm.Set(time.Duration(atomic.LoadInt64(&stats.duration)).Seconds())
+				metricsCh <- gm
+
+				gm = prometheus.NewGauge(prometheus.GaugeOpts{
+					Namespace:   p.opts.InternalMetricsNamespace,
+					Name:        queryRowsMetricName,
+					Help:        internalMetricsDescriptions[queryRowsMetricName],
+					ConstLabels: prometheus.Labels{instanceLabel: dbName, queryLabel: query.Name},
+				})
+				gm.Set(float64(atomic.LoadInt64(&stats.rows)))
+				metricsCh <- gm
+
+				if variant, ok := stats.variant.Load().(config.VerSQL); ok {
+					gm := prometheus.NewGauge(prometheus.GaugeOpts{
+						Namespace: p.opts.InternalMetricsNamespace,
+						Name:      queryVariantMetricName,
+						Help:      internalMetricsDescriptions[queryVariantMetricName],
+						ConstLabels: prometheus.Labels{
+							instanceLabel: dbName,
+							queryLabel:    query.Name,
+							minVerLabel:   variant.MinVer.Bound(),
+							maxVerLabel:   variant.MaxVer.Bound(),
+						},
+					})
+					gm.Set(1)
+					metricsCh <- gm
+				}
+			}
+		}
+	}(time.Now())
+
+	atomic.StoreUint32(&p.timeOuts, 0)
+	atomic.StoreUint32(&p.errors, 0)
+	atomic.StoreUint32(&p.counterDecreases, 0)
+	p.counters.rotate()
+	p.dbErrors = make(map[string]*uint32)
+	p.dbCritical = make(map[string]*uint32)
+	p.dbWorkers = make(map[string]*uint32)
+	p.dbQueued = make(map[string]*uint32)
+	for _, dbName := range p.config.DbList() {
+		p.dbErrors[dbName] = new(uint32)
+		p.dbCritical[dbName] = new(uint32)
+		p.dbWorkers[dbName] = new(uint32)
+		p.dbQueued[dbName] = new(uint32)
+	}
+
+	ctx := p.ctx
+	if p.opts.ScrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(p.ctx, p.opts.ScrapeTimeout)
+		defer cancel()
+	}
+
+	dbLabels := make(map[string]prometheus.Labels)
+	for _, dbName := range p.config.DbList() {
+		dbConf := p.config.Db(dbName)
+		dbLabels[dbName] = mergeLabels(p.config.Labels(), dbConf.Labels())
+		if _, ok := p.connErrors[dbName]; !ok {
+			p.connErrors[dbName] = new(uint32)
+		}
+		if _, ok := p.dbVersions[dbName]; !ok {
+			version := int64(config.NoVersion)
+			p.dbVersions[dbName] = &version
+		}
+		if _, ok := p.dbTimeouts[dbName]; !ok {
+			timeout := int64(-1)
+			p.dbTimeouts[dbName] = &timeout
+		}
+		if _, ok := p.idleConns[dbName]; !ok {
+			p.idleConns[dbName] = new([]db.Interface)
+		}
+		for _, query := range dbConf.Queries() {
+			key := queryKey{dbName: dbName, query: query.Name}
+			if _, ok := p.queryStats[key]; !ok {
+				p.queryStats[key] = &queryStats{}
+			}
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	connsLock := sync.Mutex{}
+	dbConns := make(map[string]int)
+	dbMetrics := make(map[string][]prometheus.Metric)
+
+	for _, dbName := range p.config.DbList() {
+		var delay time.Duration
+		if p.opts.ScrapeSpread > 0 {
+			delay = p.spreadDelay(p.opts.ScrapeSpread)
+		}
+
+		wg.Add(1)
+		go func(dbName string) {
+			defer wg.Done()
+
+			if p.opts.RetainFailed <= 0 {
+				conns := p.collectDb(ctx, dbName, dbLabels[dbName], delay, metricsCh)
+				connsLock.Lock()
+				dbConns[dbName] = conns
+				connsLock.Unlock()
+				return
+			}
+
+			// the metrics are passed through, keeping a copy to be served if the next scrapes fail
+			var metrics []prometheus.Metric
+			ch := make(chan prometheus.Metric)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for m := range ch {
+					metrics = append(metrics, m)
+					metricsCh <- m
+				}
+			}()
+			conns := p.collectDb(ctx, dbName, dbLabels[dbName], delay, ch)
+			close(ch)
+			<-done
+
+			connsLock.Lock()
+			dbConns[dbName] = conns
+			dbMetrics[dbName] = metrics
+			connsLock.Unlock()
+		}(dbName)
+	}
+
+	wg.Wait()
+	for dbName, dbErrors := range p.dbErrors {
+		if dbConns[dbName] > 0 && atomic.LoadUint32(dbErrors) == 0 {
+			p.lastSuccess[dbName] = time.Now()
+		}
+		p.up[dbName] = dbConns[dbName] > 0 && atomic.LoadUint32(p.dbCritical[dbName]) == 0
+	}
+
+	if p.opts.RetainFailed > 0 {
+		p.serveRetained(dbConns, dbMetrics, metricsCh)
+	}
+}
+
+// serveRetained keeps the metrics of the databases which were connected to,
+// and sends the earlier metrics of the rest unless they are older than RetainFailed
+func (p *PgCollector) serveRetained(dbConns map[string]int, dbMetrics map[string][]prometheus.Metric, metricsCh chan<- prometheus.Metric) {
+	// the databases removed from the config are not scraped anymore
+	for dbName := range p.retained {
+		if _, ok := p.dbErrors[dbName]; !ok {
+			delete(p.retained, dbName)
+		}
+	}
+
+	for _, dbName := range p.config.DbList() {
+		p.stale[dbName] = false
+		if dbConns[dbName] > 0 {
+			p.retained[dbName] = retainedMetrics{metrics: dbMetrics[dbName], time: time.Now()}
+			continue
+		}
+
+		retained, ok := p.retained[dbName]
+		if !ok {
+			continue
+		}
+		if time.Since(retained.time) > p.opts.RetainFailed {
+			delete(p.retained, dbName)
+			continue
+		}
+
+		for _, m := range retained.metrics {
+			metricsCh <- m
+		}
+		p.stale[dbName] = true
+	}
+}
+
+// acquireConn takes a slot of the open connections limit, waiting for it if wait is set
+func (p *PgCollector) acquireConn(ctx context.Context, wait bool) bool {
+	if p.connSlots == nil {
+		return true
+	}
+
+	if !wait {
+		select {
+		case p.connSlots <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+
+	select {
+	case p.connSlots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// takeIdleConn takes the alive connection kept open between the scrapes along with its connection slot,
+// closing the dead ones; nil if there is none
+func (p *PgCollector) takeIdleConn(idle *[]db.Interface) db.Interface {
+	for len(*idle) > 0 {
+		conn := (*idle)[len(*idle)-1]
+		*idle = (*idle)[:len(*idle)-1]
+		if conn.IsAlive() {
+			return conn
+		}
+		conn.Close()
+		p.releaseConn()
+	}
+
+	return nil
+}
+
+// releaseConn frees the slot of the open connections limit
+func (p *PgCollector) releaseConn() {
+	if p.connSlots != nil {
+		<-p.connSlots
+	}
+}
+
+// reconnect replaces the dead connection of the database with a new one, reporting whether it succeeded
+func (p *PgCollector) reconnect(ctx context.Context, dbName string, conn *db.Interface) bool {
+	log.Printf("connection to %q is dead, reconnecting", dbName)
+	newConn, err := p.connect(ctx, p.config.Db(dbName))
+	if err != nil {
+		log.Printf("could not reconnect to %q: %v", dbName, err)
+		atomic.AddUint32(p.connErrors[dbName], 1)
+		return false
+	}
+
+	(*conn).Close()
+	*conn = newConn
+
+	return true
+}
+
+// acquireQuery takes a slot of the concurrent queries limit, waiting for it until the scrape is timed out
+func (p *PgCollector) acquireQuery(ctx context.Context) bool {
+	if p.querySlots == nil {
+		return true
+	}
+
+	select {
+	case p.querySlots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releaseQuery frees the slot of the concurrent queries limit
+func (p *PgCollector) releaseQuery() {
+	if p.querySlots != nil {
+		<-p.querySlots
+	}
+}
+
+// collectDb runs the queries of the database after the delay, returning the number of the connections used.
+// The connections are closed once the queries are done
+func (p *PgCollector) collectDb(ctx context.Context, dbName string, dbLabels prometheus.Labels, delay time.Duration, metricsCh chan<- prometheus.Metric) int {
+	dbConf := p.config.Db(dbName)
+	workersCnt := dbConf.Workers()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+
+	idle := p.idleConns[dbName]
+	pool := make([]db.Interface, 0)
+	defer func() {
+		for id, conn := range pool {
+			// the idle connections keep their slots, so that the open connections stay within the limit,
+			// the total minIdleConns below the limit leaves the slots to the other databases
+			if len(*idle) < dbConf.MinIdleConns && conn.IsAlive() && p.ctx.Err() == nil {
+				*idle = append(*idle, conn)
+				continue
+			}
+			// the connection dropped by the server may fail to close, its slot is released anyway
+			if err := conn.Close(); err != nil {
+				log.Printf("%d: could not close db connection for %q: %v", id, dbName, err)
+			}
+			p.releaseConn()
+		}
+	}()
+
+	for i := 0; i < workersCnt; i++ {
+		// the connections kept from the previous scrape are used first
+		if conn := p.takeIdleConn(idle); conn != nil {
+			conn.SetContext(ctx)
+			pool = append(pool, conn)
+			continue
+		}
+
+		// the first connection waits for a free slot, the jobs are queued to it if the others are taken
+		acquired := p.acquireConn(ctx, len(pool) == 0)
+		if ctx.Err() != nil {
+			if acquired {
+				p.releaseConn()
+			}
+			log.Printf("could not connect to %q: scrape timed out", dbName)
+			atomic.AddUint32(&p.timeOuts, 1)
+			p.addError(dbName)
+			break
+		}
+		if !acquired {
+			break
+		}
+
+		conn, err := p.connect(ctx, dbConf)
+		if err != nil {
+			p.releaseConn()
+			log.Printf("could not connect to %q: %v", dbName, err)
+			atomic.AddUint32(p.connErrors[dbName], 1)
+			p.addError(dbName)
+			break
+		}
+
+		pool = append(pool, conn)
+	}
+	if len(pool) == 0 {
+		return 0
+	}
+	atomic.StoreInt64(p.dbVersions[dbName], int64(pool[0].PgVersion()))
+	if !dbConf.IsNotPg {
+		// read back from the server, as the setting could have been overridden, e.g. by the role settings
+		timeout, err := pool[0].StatementTimeout()
+		if err != nil {
+			log.Printf("%q: %v", dbName, err)
+			p.addError(dbName)
+		} else {
+			atomic.StoreInt64(p.dbTimeouts[dbName], int64(timeout))
+		}
+	}
+
+	if p.opts.AutoLabels {
+		dbLabels = mergeLabels(autoLabels(dbConf, pool[0].PgVersion()), dbLabels)
+	}
+
+	wg := &sync.WaitGroup{}
+	jobs := make(chan []*workerJob, len(pool))
+	for i := range pool {
+		wg.Add(1)
+		go p.worker(ctx, &pool[i], jobs, metricsCh, wg)
+	}
+
+	// the queries of the same transaction are run together on one connection, sharing the snapshot
+	var batches [][]*workerJob
+	transactions := make(map[string]int)
+	for _, query := range dbConf.Queries() {
+		job := &workerJob{
+			dbName:    dbName,
+			stats:     p.queryStats[queryKey{dbName: dbName, query: query.Name}],
+			dbLabels:  dbLabels,
+			summaries: make(map[summaryKey]prometheus.Summary),
+			Query:     query,
+		}
+		if query.Transaction == "" || dbConf.IsNotPg {
+			batches = append(batches, []*workerJob{job})
+			continue
+		}
+		if i, ok := transactions[query.Transaction]; ok {
+			batches[i] = append(batches[i], job)
+			continue
+		}
+		transactions[query.Transaction] = len(batches)
+		batches = append(batches, []*workerJob{job})
+	}
+	// the workers take the first batches at once, the rest wait for a free one
+	queued := 0
+	for i := len(pool); i < len(batches); i++ {
+		queued += len(batches[i])
+	}
+	atomic.StoreUint32(p.dbWorkers[dbName], uint32(len(pool)))
+	atomic.StoreUint32(p.dbQueued[dbName], uint32(queued))
+
+	for _, batch := range batches {
+		jobs <- batch
+	}
+	close(jobs)
+	wg.Wait()
+
+	return len(pool)
+}
+
+// Describe implements Describe method of the Collector interface.
+// It sends no descriptors, which makes the collector unchecked: names of the
+// nameColumn metrics are known only at the scrape time, const labels depend on
+// the row values and the set of the queries can change on config reload.
+func (p *PgCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+// mergeLabels merges label sets, labels of the later sets override the earlier ones
+func mergeLabels(labelSets ...map[string]string) prometheus.Labels {
+	res := make(prometheus.Labels)
+	for _, labels := range labelSets {
+		for id, value := range labels {
+			res[id] = value
+		}
+	}
+
+	return res
+}
+
+// autoLabels returns the labels of the connection, the version is left out if unknown
+func autoLabels(dbConf config.DbConfig, version config.PgVersion) map[string]string {
+	labels := map[string]string{
+		hostAutoLabel:   dbConf.Host,
+		portAutoLabel:   strconv.Itoa(int(dbConf.Port)),
+		dbnameAutoLabel: dbConf.Dbname,
+	}
+	if version != config.NoVersion {
+		labels[pgVersionAutoLabel] = versionString(version)
+	}
+
+	return labels
+}
+
+// versionString formats the version as postgresql does: "14.2" since 10, "9.6.3" before
+func versionString(version config.PgVersion) string {
+	if version >= 100000 {
+		return fmt.Sprintf("%d.%d", version/10000, version%10000)
+	}
+
+	return version.String()
+}
+
+// truncateValue cuts the value down to maxLen characters marking it with the suffix, 0 means unlimited
+func truncateValue(value string, maxLen int) string {
+	if maxLen <= 0 || len(value) <= maxLen {
+		return value
+	}
+
+	runes := []rune(value)
+	if len(runes) <= maxLen {
+		return value
+	}
+
+	return string(runes[:maxLen]) + truncatedSuffix
+}
+
+// toTimestamp converts the timestamp or the unix epoch to the time, the epoch is rounded to milliseconds
+func toTimestamp(value interface{}) (time.Time, error) {
+	if ts, ok := value.(time.Time); ok {
+		return ts, nil
+	}
+
+	ts, err := db.ToFloat64(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if math.IsNaN(ts) || math.IsInf(ts, 0) {
+		return time.Time{}, fmt.Errorf("invalid timestamp %v", ts)
+	}
+
+	return time.Unix(0, int64(math.Round(ts*1000))*int64(time.Millisecond)), nil
+}
+
+// sanitizeName makes a valid metric or label name out of the value: invalid characters are replaced
+// with underscores and the name not starting with a letter, e.g. empty or reserved "__name", is prefixed with "x_"
+func sanitizeName(value string) string {
+	name := []rune(value)
+	for i, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			name[i] = '_'
+		}
+	}
+
+	if len(name) == 0 || !(name[0] >= 'a' && name[0] <= 'z' || name[0] >= 'A' && name[0] <= 'Z') {
+		return "x_" + string(name)
+	}
+
+	return string(name)
 }
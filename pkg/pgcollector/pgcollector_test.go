@@ -0,0 +1,2440 @@
+package pgcollector
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/pgtype"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+
+	"github.com/adjust/postgresql_exporter/pkg/config"
+	"github.com/adjust/postgresql_exporter/pkg/db"
+	"github.com/adjust/postgresql_exporter/pkg/db/dbtest"
+)
+
+// loadConfig loads the config read from the string, the query files are resolved relative to testdata
+func loadConfig(t testing.TB, cfgYAML string) *config.Config {
+	cfg := config.New(config.Stdin)
+	cfg.SetStdin(strings.NewReader(cfgYAML), "testdata")
+	if err := cfg.Load(); err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+
+	return cfg
+}
+
+// fakeConns creates the fake connections of the version, each returning the rows of the query
+type fakeConns struct {
+	sync.Mutex
+	version config.PgVersion
+	query   string
+	rows    []map[string]interface{}
+	opened  []*dbtest.Conn
+}
+
+func (f *fakeConns) connect(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	conn := dbtest.New(f.version).SetRows(f.query, f.rows...)
+	f.opened = append(f.opened, conn)
+
+	return conn, nil
+}
+
+// setRows sets the rows returned by the opened and the future connections
+func (f *fakeConns) setRows(rows ...map[string]interface{}) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.rows = rows
+	for _, conn := range f.opened {
+		conn.SetRows(f.query, rows...)
+	}
+}
+
+func (f *fakeConns) count() int {
+	f.Lock()
+	defer f.Unlock()
+
+	return len(f.opened)
+}
+
+// gather collects the metrics of the collector, failing the test if it takes longer than the timeout
+func gather(t testing.TB, p *PgCollector, timeout time.Duration) []*dto.MetricFamily {
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(p)
+
+	type result struct {
+		mfs []*dto.MetricFamily
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		mfs, err := reg.Gather()
+		done <- result{mfs, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatalf("could not gather metrics: %v", res.err)
+		}
+		return res.mfs
+	case <-time.After(timeout):
+		t.Fatalf("scrape did not finish in %v", timeout)
+	}
+
+	return nil
+}
+
+// scrape gathers the metrics of the collector of the options over the config, the fake connections return the rows
+// of the query
+func scrape(t testing.TB, cfgYAML string, opts Options, query string, rows ...map[string]interface{}) []*dto.MetricFamily {
+	conns := &fakeConns{version: 110000, query: query, rows: rows}
+	opts.Connect = conns.connect
+	p := New(context.Background(), opts)
+	p.LoadConfig(loadConfig(t, cfgYAML))
+
+	return gather(t, p, 5*time.Second)
+}
+
+// findMetric returns the metric family of the name, nil if not found
+func findMetric(mfs []*dto.MetricFamily, name string) *dto.MetricFamily {
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			return mf
+		}
+	}
+
+	return nil
+}
+
+// metricValue returns the value of the first counter or gauge of the name, NaN if not found
+func metricValue(mfs []*dto.MetricFamily, name string) float64 {
+	mf := findMetric(mfs, name)
+	if mf == nil || len(mf.Metric) == 0 {
+		return math.NaN()
+	}
+	if mf.GetType() == dto.MetricType_COUNTER {
+		return mf.Metric[0].GetCounter().GetValue()
+	}
+
+	return mf.Metric[0].GetGauge().GetValue()
+}
+
+func TestIdleConnsHoldSlots(t *testing.T) {
+	cfg := loadConfig(t, `
+a: {host: a, labels: {db: a}, workers: 2, minIdleConns: 2, queryFiles: [queries.yaml]}
+b: {host: b, labels: {db: b}, workers: 2, queryFiles: [queries.yaml]}
+`)
+	conns := &countedConns{}
+	p := New(context.Background(), Options{
+		DisableInternalMetrics: true,
+		MaxConnections:         3,
+		ScrapeTimeout:          time.Second,
+		Connect:                conns.connect,
+	})
+	p.LoadConfig(cfg)
+
+	for i := 0; i < 5; i++ {
+		mfs := gather(t, p, 5*time.Second)
+		mf := findMetric(mfs, "pg_test_value")
+		if mf == nil || len(mf.Metric) != 2 {
+			t.Fatalf("scrape %d: expected pg_test_value of both databases, got %v", i, mf)
+		}
+		// the idle connections of a keep their slots, leaving b the rest of the limit
+		idle := len(*p.idleConns["a"])
+		if n := len(p.connSlots); idle == 0 || n != idle {
+			t.Errorf("scrape %d: expected the slots of the %d idle connections to be taken, %d taken", i, idle, n)
+		}
+	}
+	if conns.maxOpen > 3 {
+		t.Errorf("expected at most 3 connections open, got %d", conns.maxOpen)
+	}
+
+	p.Wait()
+	if conns.open != 0 {
+		t.Errorf("expected all the connections to be closed, %d open", conns.open)
+	}
+	if n := len(p.connSlots); n != 0 {
+		t.Errorf("expected all the connection slots to be free, %d taken", n)
+	}
+}
+
+func TestHistogramCounts(t *testing.T) {
+	tests := []struct {
+		name    string
+		row     map[string]interface{}
+		wantErr bool
+	}{
+		{"valid", map[string]interface{}{"count": 5.0, "sum": 2.0, "le_100ms": 1.0, "le_1s": 4.0}, false},
+		{"equal buckets", map[string]interface{}{"count": 4.0, "sum": 2.0, "le_100ms": 4.0, "le_1s": 4.0}, false},
+		{"null count", map[string]interface{}{"count": nil, "sum": 2.0, "le_100ms": 1.0, "le_1s": 4.0}, true},
+		{"null bucket", map[string]interface{}{"count": 5.0, "sum": 2.0, "le_100ms": nil, "le_1s": 4.0}, true},
+		{"negative bucket", map[string]interface{}{"count": 5.0, "sum": 2.0, "le_100ms": -1.0, "le_1s": 4.0}, true},
+		{"decreasing buckets", map[string]interface{}{"count": 5.0, "sum": 2.0, "le_100ms": 3.0, "le_1s": 2.0}, true},
+		{"count below buckets", map[string]interface{}{"count": 3.0, "sum": 2.0, "le_100ms": 1.0, "le_1s": 4.0}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, `a: {host: a, workers: 1, queryFiles: [histogram.yaml]}`)
+			conns := &fakeConns{version: 110000, query: "select count", rows: []map[string]interface{}{tt.row}}
+			p := New(context.Background(), Options{Connect: conns.connect})
+			p.LoadConfig(cfg)
+
+			mfs := gather(t, p, 5*time.Second)
+			gotErr := metricValue(mfs, "pg_exporter_value_conversion_errors_total") > 0
+			if gotErr != tt.wantErr {
+				t.Errorf("expected conversion error %v, got %v", tt.wantErr, gotErr)
+			}
+			if found := findMetric(mfs, "pg_latency_count") != nil; found == tt.wantErr {
+				t.Errorf("expected histogram %v, got %v", !tt.wantErr, found)
+			}
+		})
+	}
+}
+
+func TestDivisorColumn(t *testing.T) {
+	tests := []struct {
+		name        string
+		divisor     interface{}
+		wantCommits float64 // NaN if the value is skipped
+		wantErrors  float64
+		wantDivisor bool
+	}{
+		{"valid", 10.0, 5, 0, true},
+		{"zero", 0.0, math.NaN(), 1, true},
+		// the NULL divisor is skipped as NaN
+		{"null", nil, math.NaN(), 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, `a: {host: a, workers: 1, queryFiles: [divisor.yaml]}`)
+			row := map[string]interface{}{"datname": "postgres", "commits": 50.0, "window_seconds": tt.divisor}
+			conns := &fakeConns{version: 110000, query: "select rates", rows: []map[string]interface{}{row}}
+			p := New(context.Background(), Options{Connect: conns.connect})
+			p.LoadConfig(cfg)
+
+			mfs := gather(t, p, 5*time.Second)
+			commits := metricValue(mfs, "pg_rates_commits")
+			if commits != tt.wantCommits && !(math.IsNaN(commits) && math.IsNaN(tt.wantCommits)) {
+				t.Errorf("expected commits %v, got %v", tt.wantCommits, commits)
+			}
+			if got := findMetric(mfs, "pg_rates_window_seconds") != nil; got != tt.wantDivisor {
+				t.Errorf("expected the divisor column exported %v, got %v", tt.wantDivisor, got)
+			}
+			if findMetric(mfs, "pg_rates_database") == nil {
+				t.Error("expected the info metric to be exported")
+			}
+			if errs := metricValue(mfs, "pg_exporter_value_conversion_errors_total"); errs != tt.wantErrors {
+				t.Errorf("expected %v conversion errors, got %v", tt.wantErrors, errs)
+			}
+		})
+	}
+}
+
+func TestMaxRows(t *testing.T) {
+	tests := []struct {
+		rows     int
+		wantRows int
+		wantErrs float64
+	}{
+		{1, 1, 0},
+		{2, 2, 0},
+		// the query exceeding the limit exports none of its metrics
+		{3, 0, 1},
+	}
+
+	for _, tt := range tests {
+		cfg := loadConfig(t, `a: {host: a, workers: 1, queryFiles: [maxrows.yaml]}`)
+		conns := &fakeConns{version: 110000, query: "select durations"}
+		for i := 0; i < tt.rows; i++ {
+			conns.rows = append(conns.rows, map[string]interface{}{"query": "q" + strconv.Itoa(i), "calls": float64(i), "duration": float64(i)})
+		}
+		p := New(context.Background(), Options{Connect: conns.connect})
+		p.LoadConfig(cfg)
+
+		mfs := gather(t, p, 5*time.Second)
+		for _, name := range []string{"pg_durations_calls", "pg_durations_duration"} {
+			got := 0
+			if mf := findMetric(mfs, name); mf != nil {
+				got = len(mf.Metric)
+			}
+			if got != tt.wantRows {
+				t.Errorf("%d rows: expected %d series of %s, got %d", tt.rows, tt.wantRows, name, got)
+			}
+		}
+		if errs := metricValue(mfs, "pg_exporter_last_scrape_errors"); errs != tt.wantErrs {
+			t.Errorf("%d rows: expected %v scrape errors, got %v", tt.rows, tt.wantErrs, errs)
+		}
+	}
+}
+
+func TestDisableInternalMetrics(t *testing.T) {
+	tests := []struct {
+		disable      bool
+		wantInternal bool
+	}{
+		{false, true},
+		{true, false},
+	}
+
+	for _, tt := range tests {
+		mfs := scrape(t, `a: {host: a, queryFiles: [queries.yaml]}`, Options{DisableInternalMetrics: tt.disable},
+			"select value", map[string]interface{}{"value": 1.0})
+
+		internal := false
+		for _, mf := range mfs {
+			if strings.HasPrefix(mf.GetName(), defaultInternalMetricsNamespace+"_") {
+				internal = true
+			}
+		}
+		if internal != tt.wantInternal {
+			t.Errorf("disable %v: expected internal metrics %v, got %v", tt.disable, tt.wantInternal, internal)
+		}
+		if findMetric(mfs, "pg_test_value") == nil {
+			t.Errorf("disable %v: expected the query metrics", tt.disable)
+		}
+	}
+}
+
+func TestInternalMetricsNamespace(t *testing.T) {
+	tests := []struct {
+		namespace string
+		want      string
+	}{
+		{"", "pg_exporter_last_scrape_errors"},
+		{"custom", "custom_last_scrape_errors"},
+	}
+
+	for _, tt := range tests {
+		mfs := scrape(t, `a: {host: a, queryFiles: [queries.yaml]}`, Options{InternalMetricsNamespace: tt.namespace},
+			"select value", map[string]interface{}{"value": 1.0})
+		if findMetric(mfs, tt.want) == nil {
+			t.Errorf("namespace %q: expected %q", tt.namespace, tt.want)
+		}
+	}
+}
+
+// metricLabels returns the labels of the metrics of the family keyed by the value of the label
+func metricLabels(mf *dto.MetricFamily, key string) map[string]map[string]string {
+	res := make(map[string]map[string]string)
+	if mf == nil {
+		return res
+	}
+	for _, m := range mf.Metric {
+		labels := make(map[string]string)
+		for _, lp := range m.Label {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		res[labels[key]] = labels
+	}
+
+	return res
+}
+
+func TestDbLabelsOverrideGlobalLabels(t *testing.T) {
+	mfs := scrape(t, `
+labels: {dc: eu, env: prod}
+a: {host: a, labels: {db: a, dc: us}, queryFiles: [queries.yaml]}
+b: {host: b, labels: {db: b}, queryFiles: [queries.yaml]}
+`, Options{}, "select value", map[string]interface{}{"value": 1.0})
+
+	got := metricLabels(findMetric(mfs, "pg_test_value"), "db")
+	tests := []struct {
+		db   string
+		want map[string]string
+	}{
+		{"a", map[string]string{"db": "a", "dc": "us", "env": "prod"}},
+		{"b", map[string]string{"db": "b", "dc": "eu", "env": "prod"}},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(got[tt.db], tt.want) {
+			t.Errorf("db %q: expected labels %v, got %v", tt.db, tt.want, got[tt.db])
+		}
+	}
+}
+
+func TestAutoLabels(t *testing.T) {
+	const cfgYAML = `
+labels: {pg_version: custom}
+a: {host: a.local, port: 5433, dbname: app, labels: {db: a}, queryFiles: [queries.yaml]}
+b: {host: b.local, port: 6432, dbname: app, labels: {db: b, host: primary}, queryFiles: [queries.yaml]}
+`
+	tests := []struct {
+		name       string
+		autoLabels bool
+		want       map[string]map[string]string
+	}{
+		{"disabled", false, map[string]map[string]string{
+			"a": {"db": "a", "pg_version": "custom"},
+			"b": {"db": "b", "host": "primary", "pg_version": "custom"},
+		}},
+		// the labels of the config take precedence
+		{"enabled", true, map[string]map[string]string{
+			"a": {"db": "a", "host": "a.local", "port": "5433", "dbname": "app", "pg_version": "custom"},
+			"b": {"db": "b", "host": "primary", "port": "6432", "dbname": "app", "pg_version": "custom"},
+		}},
+	}
+
+	for _, tt := range tests {
+		mfs := scrape(t, cfgYAML, Options{AutoLabels: tt.autoLabels}, "select value", map[string]interface{}{"value": 1.0})
+
+		if got := metricLabels(findMetric(mfs, "pg_test_value"), "db"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected labels %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestAutoLabelsVersion(t *testing.T) {
+	tests := []struct {
+		version config.PgVersion
+		want    map[string]string
+	}{
+		{110000, map[string]string{"host": "a", "port": "5432", "dbname": "app", "pg_version": "11.0"}},
+		{90603, map[string]string{"host": "a", "port": "5432", "dbname": "app", "pg_version": "9.6.3"}},
+		// the version is left out if unknown
+		{config.NoVersion, map[string]string{"host": "a", "port": "5432", "dbname": "app"}},
+	}
+
+	for _, tt := range tests {
+		got := autoLabels(config.DbConfig{Host: "a", Port: 5432, Dbname: "app"}, tt.version)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d: expected labels %v, got %v", tt.version, tt.want, got)
+		}
+	}
+}
+
+func TestConfigFileMtime(t *testing.T) {
+	queries, err := filepath.Abs("testdata/queries.yaml")
+	if err != nil {
+		t.Fatalf("could not resolve query file: %v", err)
+	}
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(filename, []byte("a: {host: a, queryFiles: ["+queries+"]}\n"), 0644); err != nil {
+		t.Fatalf("could not write config: %v", err)
+	}
+
+	cfg := config.New(filename)
+	if err := cfg.Load(); err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+	conns := &fakeConns{version: 110000, query: "select value", rows: []map[string]interface{}{{"value": 1.0}}}
+	p := New(context.Background(), Options{Connect: conns.connect})
+	p.LoadConfig(cfg)
+
+	// the change of the file after the load is seen on the next scrape
+	tests := []time.Time{time.Unix(1600000000, 0), time.Unix(1600000060, 500000000)}
+	for _, mtime := range tests {
+		if err := os.Chtimes(filename, mtime, mtime); err != nil {
+			t.Fatalf("could not set mtime: %v", err)
+		}
+
+		mf := findMetric(gather(t, p, 5*time.Second), "pg_exporter_config_file_mtime_seconds")
+		got := metricLabels(mf, "file")
+		if len(got) != 1 || got[filename] == nil {
+			t.Errorf("%v: expected the metric of %s, got %v", mtime, filename, got)
+			continue
+		}
+		if want := float64(mtime.UnixNano()) / 1e9; mf.Metric[0].GetGauge().GetValue() != want {
+			t.Errorf("%v: expected %v, got %v", mtime, want, mf.Metric[0].GetGauge().GetValue())
+		}
+	}
+
+	// the config read from stdin has no file
+	mfs := scrape(t, `a: {host: a, queryFiles: [queries.yaml]}`, Options{}, "select value", map[string]interface{}{"value": 1.0})
+	if mf := findMetric(mfs, "pg_exporter_config_file_mtime_seconds"); mf != nil {
+		t.Errorf("stdin: expected no mtime metric, got %v", mf)
+	}
+}
+
+func TestSecondsSinceLastReload(t *testing.T) {
+	const cfgYAML = `a: {host: a, queryFiles: [queries.yaml]}`
+	conns := &fakeConns{version: 110000, query: "select value", rows: []map[string]interface{}{{"value": 1.0}}}
+	p := New(context.Background(), Options{Connect: conns.connect})
+	load := func() { p.LoadConfig(loadConfig(t, cfgYAML)) }
+
+	// each step follows the previous one by 20ms at least
+	tests := []struct {
+		name      string
+		reload    func()
+		wantReset bool
+	}{
+		{"load", load, true},
+		{"second scrape", func() {}, false},
+		{"failed reload", p.ReloadFailed, true},
+		{"reload", load, true},
+	}
+
+	prev := 0.0
+	for i, tt := range tests {
+		if i > 0 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		start := time.Now()
+		tt.reload()
+		mfs := gather(t, p, 5*time.Second)
+		elapsed := time.Since(start).Seconds()
+
+		got := metricValue(mfs, "pg_exporter_seconds_since_last_reload")
+		if tt.wantReset && !(got >= 0 && got <= elapsed) {
+			t.Errorf("%s: expected at most %v, got %v", tt.name, elapsed, got)
+		}
+		if !tt.wantReset && got < prev+0.02 {
+			t.Errorf("%s: expected at least %v, got %v", tt.name, prev+0.02, got)
+		}
+		// derived from the reload timestamp
+		if reloaded := metricValue(mfs, "pg_exporter_config_last_reload_timestamp_seconds"); float64(start.UnixNano())/1e9-reloaded > got {
+			t.Errorf("%s: expected at least the time since the reload timestamp %v, got %v", tt.name, reloaded, got)
+		}
+		prev = got
+	}
+}
+
+func TestQueryLabels(t *testing.T) {
+	tests := []struct {
+		name string
+		row  map[string]interface{}
+		want map[string]string
+	}{
+		// the query labels override the db labels and are overridden by the row labels
+		{"row label", map[string]interface{}{"query": "select 1", "calls": 1.0}, map[string]string{"db": "a", "dc": "query", "source": "pg_stat_statements", "query": "select 1"}},
+	}
+
+	for _, tt := range tests {
+		mfs := scrape(t, `
+labels: {dc: eu}
+a: {host: a, labels: {db: a, dc: us}, queryFiles: [querylabels.yaml]}
+`, Options{}, "select statements", tt.row)
+
+		got := metricLabels(findMetric(mfs, "pg_statements_calls"), "db")["a"]
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected labels %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestDescribeDoesNotConnect(t *testing.T) {
+	connected := 0
+	p := New(context.Background(), Options{
+		Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+			connected++
+			return nil, errors.New("database is down")
+		},
+	})
+	p.LoadConfig(loadConfig(t, `a: {host: a, queryFiles: [queries.yaml]}`))
+
+	ch := make(chan *prometheus.Desc, 10)
+	p.Describe(ch)
+	close(ch)
+	if n := len(ch); n != 0 {
+		t.Errorf("expected the unchecked collector to describe no metrics, got %d", n)
+	}
+	if connected != 0 {
+		t.Errorf("expected Describe not to connect, connected %d times", connected)
+	}
+
+	// the registration describes the collector
+	if err := prometheus.NewRegistry().Register(p); err != nil {
+		t.Errorf("could not register the collector with the database down: %v", err)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	var rows []map[string]interface{}
+	for i := 1; i <= 4; i++ {
+		rows = append(rows, map[string]interface{}{"db": "a", "duration": float64(i), "default_duration": float64(i)})
+	}
+	rows = append(rows, map[string]interface{}{"db": "b", "duration": 10.0, "default_duration": 10.0})
+	mfs := scrape(t, `a: {host: a, queryFiles: [summary.yaml]}`, Options{}, "select durations", rows...)
+
+	tests := []struct {
+		metric        string
+		db            string
+		wantCount     uint64
+		wantSum       float64
+		wantQuantiles []float64
+	}{
+		{"pg_summary_duration", "a", 4, 10, []float64{0.5, 0.9}},
+		{"pg_summary_duration", "b", 1, 10, []float64{0.5, 0.9}},
+		{"pg_summary_default_duration", "a", 4, 10, []float64{0.5, 0.9, 0.99}},
+	}
+
+	for _, tt := range tests {
+		mf := findMetric(mfs, tt.metric)
+		if mf == nil {
+			t.Errorf("expected %q", tt.metric)
+			continue
+		}
+		var summary *dto.Summary
+		for _, m := range mf.Metric {
+			for _, lp := range m.Label {
+				if lp.GetName() == "db" && lp.GetValue() == tt.db {
+					summary = m.GetSummary()
+				}
+			}
+		}
+		if summary == nil {
+			t.Errorf("%s of %q: expected the summary of the rows with the same labels", tt.metric, tt.db)
+			continue
+		}
+		if summary.GetSampleCount() != tt.wantCount || summary.GetSampleSum() != tt.wantSum {
+			t.Errorf("%s of %q: expected count %d and sum %v, got %d and %v", tt.metric, tt.db,
+				tt.wantCount, tt.wantSum, summary.GetSampleCount(), summary.GetSampleSum())
+		}
+		var quantiles []float64
+		for _, q := range summary.Quantile {
+			quantiles = append(quantiles, q.GetQuantile())
+		}
+		if !reflect.DeepEqual(quantiles, tt.wantQuantiles) {
+			t.Errorf("%s of %q: expected quantiles %v, got %v", tt.metric, tt.db, tt.wantQuantiles, quantiles)
+		}
+	}
+}
+
+func TestInfoMetric(t *testing.T) {
+	mfs := scrape(t, `a: {host: a, queryFiles: [info.yaml]}`, Options{}, "select databases",
+		map[string]interface{}{"datname": "postgres", "encoding": "UTF8"},
+		map[string]interface{}{"datname": "template0", "encoding": "SQL_ASCII"},
+	)
+
+	mf := findMetric(mfs, "pg_database_info")
+	if mf == nil || mf.GetType() != dto.MetricType_GAUGE {
+		t.Fatalf("expected the info gauge, got %v", mf)
+	}
+	got := metricLabels(mf, "datname")
+	tests := []struct {
+		datname  string
+		encoding string
+	}{
+		{"postgres", "UTF8"},
+		{"template0", "SQL_ASCII"},
+	}
+	for _, tt := range tests {
+		if got[tt.datname]["encoding"] != tt.encoding {
+			t.Errorf("%q: expected encoding %q, got %v", tt.datname, tt.encoding, got[tt.datname])
+		}
+	}
+	for _, m := range mf.Metric {
+		if v := m.GetGauge().GetValue(); v != 1 {
+			t.Errorf("expected the info value 1, got %v", v)
+		}
+	}
+	if len(mf.Metric) != len(tests) {
+		t.Errorf("expected a metric per row, got %d", len(mf.Metric))
+	}
+}
+
+func TestValueColumns(t *testing.T) {
+	mfs := scrape(t, `a: {host: a, queryFiles: [valuecolumns.yaml]}`, Options{}, "select statements",
+		map[string]interface{}{"name": "select", "calls": int64(3), "total_time": 1.5},
+		map[string]interface{}{"name": "insert", "calls": int64(2), "total_time": 0.5},
+	)
+
+	tests := []struct {
+		metric   string
+		wantType dto.MetricType
+		want     float64
+	}{
+		{"pg_statements_select_calls", dto.MetricType_COUNTER, 3},
+		{"pg_statements_select_total_time", dto.MetricType_COUNTER, 1.5},
+		{"pg_statements_insert_calls", dto.MetricType_COUNTER, 2},
+		{"pg_statements_insert_total_time", dto.MetricType_GAUGE, 0.5},
+	}
+
+	for _, tt := range tests {
+		mf := findMetric(mfs, tt.metric)
+		if mf == nil {
+			t.Errorf("expected %q", tt.metric)
+			continue
+		}
+		if mf.GetType() != tt.wantType {
+			t.Errorf("%s: expected type %v, got %v", tt.metric, tt.wantType, mf.GetType())
+		}
+		if got := metricValue(mfs, tt.metric); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.metric, tt.want, got)
+		}
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"calls", "calls"},
+		{"select 1", "select_1"},
+		{"pg-stat.statements", "pg_stat_statements"},
+		{"1234", "x_1234"},
+		{"9lives", "x_9lives"},
+		{"a:b/c(d)", "a_b_c_d_"},
+		{"größe", "gr__e"},
+		{"ärger", "x__rger"},
+		{"_private", "x__private"},
+		{"__name__", "x___name__"},
+		{"", "x_"},
+	}
+
+	for _, tt := range tests {
+		got := sanitizeName(tt.value)
+		if got != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.value, tt.want, got)
+		}
+		if !model.LabelName(got).IsValid() || !model.IsValidMetricName(model.LabelValue(got)) {
+			t.Errorf("%q: %q is not a valid name", tt.value, got)
+		}
+	}
+}
+
+func TestQueryPrefix(t *testing.T) {
+	tests := []struct {
+		queryFile  string
+		omitPrefix bool
+		want       string
+	}{
+		{"queries.yaml", false, "pg_test_value"},
+		{"dotted.yaml", false, "my_query_value"},
+		{"hyphens.yaml", false, "pg_stat_tables_value"},
+		{"dotted.yaml", true, "value"},
+		{"hyphens.yaml", true, "value"},
+	}
+
+	for _, tt := range tests {
+		mfs := scrape(t, `a: {host: a, queryFiles: [`+tt.queryFile+`]}`, Options{OmitQueryPrefix: tt.omitPrefix}, "select value", map[string]interface{}{"value": 1.0})
+
+		var got []string
+		for _, mf := range mfs {
+			if !strings.HasPrefix(mf.GetName(), "pg_exporter_") {
+				got = append(got, mf.GetName())
+			}
+		}
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s, omit prefix %v: expected %s, got %v", tt.queryFile, tt.omitPrefix, tt.want, got)
+		}
+	}
+}
+
+func TestDynamicNamesSanitized(t *testing.T) {
+	mfs := scrape(t, `a: {host: a, queryFiles: [valuecolumns.yaml]}`, Options{}, "select statements",
+		map[string]interface{}{"name": "select 1", "calls": int64(1), "total_time": 1.0},
+		map[string]interface{}{"name": "42-x.y", "calls": int64(2), "total_time": 2.0},
+		// the name colliding with the first one once sanitized is skipped
+		map[string]interface{}{"name": "select-1", "calls": int64(3), "total_time": 3.0},
+	)
+
+	for _, name := range []string{"pg_statements_select_1_calls", "pg_statements_x_42_x_y_calls"} {
+		if findMetric(mfs, name) == nil {
+			t.Errorf("expected %q", name)
+		}
+	}
+	if got := metricValue(mfs, "pg_statements_select_1_calls"); got != 1 {
+		t.Errorf("expected the value of the first colliding name, got %v", got)
+	}
+	if got := metricValue(mfs, "pg_exporter_value_conversion_errors_total"); got != 1 {
+		t.Errorf("expected the conversion error of the colliding name, got %v", got)
+	}
+}
+
+func TestQueryEnabled(t *testing.T) {
+	tests := []struct {
+		queryFile string
+		want      bool
+	}{
+		{"queries.yaml", true},
+		{"enabled_true.yaml", true},
+		{"enabled_false.yaml", false},
+	}
+
+	for _, tt := range tests {
+		cfgYAML := `a: {host: a, queryFiles: [` + tt.queryFile + `]}`
+		dbConf := loadConfig(t, cfgYAML).Db("a")
+		if got := len(dbConf.Queries()) == 1; got != tt.want {
+			t.Errorf("%s: expected the query loaded %v, got %v", tt.queryFile, tt.want, got)
+		}
+
+		conns := &fakeConns{version: 110000, query: "select value", rows: []map[string]interface{}{{"value": 1.0}}}
+		p := New(context.Background(), Options{Connect: conns.connect})
+		p.LoadConfig(loadConfig(t, cfgYAML))
+
+		ch := make(chan *prometheus.Desc, 10)
+		p.Describe(ch)
+		close(ch)
+		for desc := range ch {
+			if strings.Contains(desc.String(), "pg_test_value") && !tt.want {
+				t.Errorf("%s: expected the disabled query not to be described, got %v", tt.queryFile, desc)
+			}
+		}
+
+		mfs := gather(t, p, 5*time.Second)
+		if got := findMetric(mfs, "pg_test_value") != nil; got != tt.want {
+			t.Errorf("%s: expected the metric %v, got %v", tt.queryFile, tt.want, got)
+		}
+		for _, conn := range conns.opened {
+			for _, query := range conn.Executed() {
+				if query == "select value" && !tt.want {
+					t.Errorf("%s: expected the disabled query not to be executed", tt.queryFile)
+				}
+			}
+		}
+	}
+}
+
+func TestTimestampColumn(t *testing.T) {
+	measuredAt := time.Date(2020, 1, 2, 3, 4, 5, 600*int(time.Millisecond), time.UTC)
+	tests := []struct {
+		name      string
+		timestamp interface{}
+		wantMs    int64 // 0 if no metric is expected
+	}{
+		{"time", measuredAt, measuredAt.UnixNano() / int64(time.Millisecond)},
+		{"epoch", 1577934245.6, 1577934245600},
+		{"integer epoch", int64(1577934245), 1577934245000},
+		{"null", nil, 0},
+	}
+
+	for _, tt := range tests {
+		mfs := scrape(t, `a: {host: a, queryFiles: [timestamp.yaml]}`, Options{}, "select value",
+			map[string]interface{}{"value": 1.0, "measured_at": tt.timestamp})
+
+		mf := findMetric(mfs, "pg_test_value")
+		if tt.wantMs == 0 {
+			if mf != nil {
+				t.Errorf("%s: expected no metric, got %v", tt.name, mf)
+			}
+			if metricValue(mfs, "pg_exporter_value_conversion_errors_total") != 1 {
+				t.Errorf("%s: expected a conversion error", tt.name)
+			}
+			continue
+		}
+		if mf == nil {
+			t.Errorf("%s: expected the metric", tt.name)
+			continue
+		}
+		if got := mf.Metric[0].GetTimestampMs(); got != tt.wantMs {
+			t.Errorf("%s: expected timestamp %d, got %d", tt.name, tt.wantMs, got)
+		}
+	}
+}
+
+func TestQueryArgs(t *testing.T) {
+	tests := []struct {
+		queryFile string
+		query     string
+		wantArgs  []interface{}
+	}{
+		{"queries.yaml", "select value", nil},
+		{"args.yaml", "select value from tables where schemaname = $1 and size > $2", []interface{}{"public", 1024}},
+	}
+
+	for _, tt := range tests {
+		conns := &fakeConns{version: 110000, query: tt.query, rows: []map[string]interface{}{{"value": 1.0}}}
+		p := New(context.Background(), Options{Connect: conns.connect})
+		p.LoadConfig(loadConfig(t, `a: {host: a, queryFiles: [`+tt.queryFile+`]}`))
+		gather(t, p, 5*time.Second)
+
+		if len(conns.opened) == 0 {
+			t.Fatalf("%s: expected a connection", tt.queryFile)
+		}
+		if executed := conns.opened[0].Executed(); len(executed) == 0 || executed[len(executed)-1] != tt.query {
+			t.Errorf("%s: expected %q to be executed, got %q", tt.queryFile, tt.query, executed)
+		}
+		if got := conns.opened[0].Args(tt.query); len(got) != 0 || len(tt.wantArgs) != 0 {
+			if !reflect.DeepEqual(got, tt.wantArgs) {
+				t.Errorf("%s: expected args %#v, got %#v", tt.queryFile, tt.wantArgs, got)
+			}
+		}
+	}
+}
+
+func TestLastSuccessTimestamp(t *testing.T) {
+	conns := &fakeConns{version: 110000, query: "select value", rows: []map[string]interface{}{{"value": 1.0}}}
+	var connectErr, queryErr error
+	p := New(context.Background(), Options{
+		Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+			if connectErr != nil {
+				return nil, connectErr
+			}
+			conn, err := conns.connect(ctx, dbConf)
+			if queryErr != nil {
+				conn.(*dbtest.Conn).SetError("select value", queryErr)
+			}
+			return conn, err
+		},
+	})
+	p.LoadConfig(loadConfig(t, `a: {host: a, queryFiles: [queries.yaml]}`))
+
+	const metric = "pg_exporter_last_success_timestamp_seconds"
+	var lastSuccess float64
+	tests := []struct {
+		name       string
+		connectErr error
+		queryErr   error
+		wantUpdate bool
+	}{
+		{"connection failed", errors.New("database is down"), nil, false},
+		{"succeeded", nil, nil, true},
+		{"query failed", nil, errors.New("relation does not exist"), false},
+		{"succeeded again", nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		connectErr, queryErr = tt.connectErr, tt.queryErr
+		before := float64(time.Now().UnixNano()) / 1e9
+		got := metricValue(gather(t, p, 5*time.Second), metric)
+
+		switch {
+		case tt.wantUpdate && !(got >= before):
+			t.Errorf("%s: expected the timestamp after %v, got %v", tt.name, before, got)
+		case !tt.wantUpdate && lastSuccess == 0 && !math.IsNaN(got):
+			t.Errorf("%s: expected no timestamp before the first success, got %v", tt.name, got)
+		case !tt.wantUpdate && lastSuccess != 0 && got != lastSuccess:
+			t.Errorf("%s: expected the timestamp of the previous success %v, got %v", tt.name, lastSuccess, got)
+		}
+		if !math.IsNaN(got) {
+			lastSuccess = got
+		}
+	}
+}
+
+func TestStatementTimeoutFailure(t *testing.T) {
+	tests := []struct {
+		timeoutErr error
+		wantUp     float64
+	}{
+		{nil, 1},
+		{errors.New("permission denied"), 0},
+	}
+
+	for _, tt := range tests {
+		conns := &fakeConns{version: 110000, query: "select value", rows: []map[string]interface{}{{"value": 1.0}}}
+		p := New(context.Background(), Options{
+			Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+				conn, err := conns.connect(ctx, dbConf)
+				conn.(*dbtest.Conn).StatementTimeoutErr = tt.timeoutErr
+				return conn, err
+			},
+		})
+		p.LoadConfig(loadConfig(t, `a: {host: a, statementTimeout: 1s, workers: 2, queryFiles: [queries.yaml]}`))
+		mfs := gather(t, p, 5*time.Second)
+
+		if got := metricValue(mfs, "pg_exporter_up"); got != tt.wantUp {
+			t.Errorf("timeout error %v: expected up %v, got %v", tt.timeoutErr, tt.wantUp, got)
+		}
+		if got := findMetric(mfs, "pg_test_value") != nil; got != (tt.timeoutErr == nil) {
+			t.Errorf("timeout error %v: expected the query metric %v, got %v", tt.timeoutErr, tt.timeoutErr == nil, got)
+		}
+		if conns.count() == 0 {
+			t.Errorf("timeout error %v: expected a connection", tt.timeoutErr)
+		}
+		for i, conn := range conns.opened {
+			if tt.timeoutErr == nil {
+				if timeout, _ := conn.StatementTimeout(); timeout != time.Second {
+					t.Errorf("connection %d: expected the statement timeout 1s, got %v", i, timeout)
+				}
+				continue
+			}
+			if !conn.Closed() {
+				t.Errorf("connection %d: expected the connection failing the setup to be closed", i)
+			}
+			if executed := conn.Executed(); len(executed) != 0 {
+				t.Errorf("connection %d: expected no queries on the connection failing the setup, got %q", i, executed)
+			}
+		}
+	}
+}
+
+func TestCounterDecreases(t *testing.T) {
+	values := []float64{5, 3, 7, 7}
+	tests := []struct {
+		clamp         bool
+		wantValues    []float64
+		wantDecreases []float64
+	}{
+		{false, []float64{5, 3, 7, 7}, []float64{0, 1, 0, 0}},
+		{true, []float64{5, 5, 7, 7}, []float64{0, 1, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		conns := &fakeConns{version: 110000, query: "select value"}
+		p := New(context.Background(), Options{Connect: conns.connect, ClampCounters: tt.clamp})
+		p.LoadConfig(loadConfig(t, `a: {host: a, queryFiles: [counter.yaml]}`))
+
+		for i, value := range values {
+			conns.setRows(map[string]interface{}{"value": value})
+			mfs := gather(t, p, 5*time.Second)
+			if got := metricValue(mfs, "pg_test_value"); got != tt.wantValues[i] {
+				t.Errorf("clamp %v, scrape %d: expected value %v, got %v", tt.clamp, i, tt.wantValues[i], got)
+			}
+			if got := metricValue(mfs, "pg_exporter_last_scrape_counter_decreases"); got != tt.wantDecreases[i] {
+				t.Errorf("clamp %v, scrape %d: expected decreases %v, got %v", tt.clamp, i, tt.wantDecreases[i], got)
+			}
+		}
+	}
+}
+
+// queryMetric returns the value of the counter or gauge of the name and the query label, NaN if not found
+func queryMetric(mfs []*dto.MetricFamily, name, query string) float64 {
+	mf := findMetric(mfs, name)
+	if mf == nil {
+		return math.NaN()
+	}
+	for _, m := range mf.Metric {
+		for _, lp := range m.Label {
+			if lp.GetName() != "query" || lp.GetValue() != query {
+				continue
+			}
+			if mf.GetType() == dto.MetricType_COUNTER {
+				return m.GetCounter().GetValue()
+			}
+			return m.GetGauge().GetValue()
+		}
+	}
+
+	return math.NaN()
+}
+
+func TestQueryExecutions(t *testing.T) {
+	conns := &fakeConns{version: 110000, query: "select value", rows: []map[string]interface{}{{"value": 1.0}}}
+	var queryErr error
+	p := New(context.Background(), Options{
+		Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+			conn, err := conns.connect(ctx, dbConf)
+			if queryErr != nil {
+				conn.(*dbtest.Conn).SetError("select value", queryErr)
+			}
+			return conn, err
+		},
+	})
+	p.LoadConfig(loadConfig(t, `a: {host: a, queryFiles: [queries.yaml]}`))
+
+	tests := []struct {
+		queryErr error
+		want     float64
+	}{
+		{nil, 1},
+		{errors.New("relation does not exist"), 2},
+		{nil, 3},
+	}
+
+	for i, tt := range tests {
+		queryErr = tt.queryErr
+		mfs := gather(t, p, 5*time.Second)
+		if got := queryMetric(mfs, "pg_exporter_query_executions_total", "pg_test"); got != tt.want {
+			t.Errorf("scrape %d: expected %v executions, got %v", i, tt.want, got)
+		}
+	}
+}
+
+func TestQueryDuration(t *testing.T) {
+	tests := []time.Duration{0, 20 * time.Millisecond, 100 * time.Millisecond}
+
+	for _, delay := range tests {
+		conns := &fakeConns{version: 110000, query: "select value", rows: []map[string]interface{}{{"value": 1.0}}}
+		p := New(context.Background(), Options{
+			Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+				conn, err := conns.connect(ctx, dbConf)
+				conn.(*dbtest.Conn).Delay = delay
+				return conn, err
+			},
+		})
+		p.LoadConfig(loadConfig(t, `a: {host: a, queryFiles: [queries.yaml]}`))
+
+		got := queryMetric(gather(t, p, 5*time.Second), "pg_exporter_query_duration_seconds", "pg_test")
+		if got < delay.Seconds() || got > (delay+time.Second).Seconds() {
+			t.Errorf("delay %v: expected the duration of the query, got %vs", delay, got)
+		}
+	}
+}
+
+func TestTruncateValue(t *testing.T) {
+	tests := []struct {
+		value  string
+		maxLen int
+		want   string
+	}{
+		{"select 1", 0, "select 1"},
+		{"select 1", 8, "select 1"},
+		{"select 1", 6, "select..."},
+		{"größe", 5, "größe"},
+		{"größenordnung", 5, "größe..."},
+		{"", 3, ""},
+	}
+
+	for _, tt := range tests {
+		if got := truncateValue(tt.value, tt.maxLen); got != tt.want {
+			t.Errorf("truncateValue(%q, %d) = %q, want %q", tt.value, tt.maxLen, got, tt.want)
+		}
+	}
+}
+
+func TestLabelGuards(t *testing.T) {
+	var rows []map[string]interface{}
+	for _, query := range []string{"select 1", "select 2", "select 3", "select 2"} {
+		rows = append(rows, map[string]interface{}{"query": query, "calls": int64(1)})
+	}
+
+	// the repeated label set is within the limit
+	tests := []struct {
+		opts       Options
+		wantLabels []string
+	}{
+		{Options{}, []string{"select 1", "select 2", "select 2", "select 3"}},
+		{Options{MaxLabelSets: 2}, []string{"select 1", "select 2", "select 2"}},
+		{Options{MaxLabelSets: 1, MaxLabelValueLength: 6}, []string{"select...", "select...", "select...", "select..."}},
+	}
+
+	for _, tt := range tests {
+		conns := &fakeConns{version: 110000, query: "select statements", rows: rows}
+		tt.opts.Connect = conns.connect
+		p := New(context.Background(), tt.opts)
+		p.LoadConfig(loadConfig(t, `a: {host: a, queryFiles: [labels.yaml]}`))
+
+		ch := make(chan prometheus.Metric, 100)
+		p.Collect(ch)
+		close(ch)
+		var got []string
+		for m := range ch {
+			if !strings.Contains(m.Desc().String(), `"pg_statements_calls"`) {
+				continue
+			}
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				t.Fatalf("could not write metric: %v", err)
+			}
+			for _, lp := range pb.Label {
+				if lp.GetName() == "query" {
+					got = append(got, lp.GetValue())
+				}
+			}
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.wantLabels) {
+			t.Errorf("max label sets %d, max value length %d: expected labels %q, got %q",
+				tt.opts.MaxLabelSets, tt.opts.MaxLabelValueLength, tt.wantLabels, got)
+		}
+	}
+}
+
+func TestHstoreLabels(t *testing.T) {
+	tests := []struct {
+		relname    string
+		meta       interface{}
+		wantLabels map[string]string
+	}{
+		{
+			"events",
+			map[string]pgtype.Text{
+				"owner":      {String: "billing", Status: pgtype.Present},
+				"data-class": {String: "pii", Status: pgtype.Present},
+				"1st":        {String: "yes", Status: pgtype.Present},
+			},
+			map[string]string{"relname": "events", "owner": "billing", "data_class": "pii", "x_1st": "yes"},
+		},
+		// the empty and the reserved keys are turned into valid names, the colliding keys are skipped
+		{
+			"logs",
+			map[string]string{"": "empty", "__name__": "reserved", "a-b": "dash", "a.b": "dot", "a_c": "kept"},
+			map[string]string{"relname": "logs", "x_": "empty", "x___name__": "reserved", "a_c": "kept"},
+		},
+		{"users", map[string]pgtype.Text{}, map[string]string{"relname": "users"}},
+		{"orders", map[string]string{"owner": "sales"}, map[string]string{"relname": "orders", "owner": "sales"}},
+	}
+
+	for _, tt := range tests {
+		mfs := scrape(t, `a: {host: a, queryFiles: [hstore.yaml]}`, Options{}, "select tables",
+			map[string]interface{}{"relname": tt.relname, "meta": tt.meta, "size": int64(8192)})
+
+		mf := findMetric(mfs, "pg_tables_size")
+		if mf == nil || len(mf.Metric) != 1 {
+			t.Errorf("%s: expected the metric, got %v", tt.relname, mf)
+			continue
+		}
+		got := make(map[string]string)
+		for _, lp := range mf.Metric[0].Label {
+			got[lp.GetName()] = lp.GetValue()
+		}
+		if !reflect.DeepEqual(got, tt.wantLabels) {
+			t.Errorf("%s: expected labels %v, got %v", tt.relname, tt.wantLabels, got)
+		}
+	}
+}
+
+func TestCheckQueries(t *testing.T) {
+	argsSQL := "select value from tables where schemaname = $1 and size > $2"
+	var opened []*dbtest.Conn
+	p := New(context.Background(), Options{
+		Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+			if dbConf.Host == "down" {
+				return nil, errors.New("connection refused")
+			}
+			conn := dbtest.New(110000).SetError(argsSQL, errors.New(`relation "tables" does not exist`))
+			opened = append(opened, conn)
+			return conn, nil
+		},
+	})
+	p.LoadConfig(loadConfig(t, `
+a: {host: a, queryFiles: [queries.yaml, args.yaml]}
+b: {host: down, queryFiles: [queries.yaml]}
+c: {host: c, isNotPg: true, queryFiles: [args.yaml]}
+`))
+
+	got := make(map[string]string)
+	for _, failed := range p.CheckQueries() {
+		got[failed.DbName+"/"+failed.Query] = failed.Err.Error()
+	}
+	want := map[string]string{
+		"a/pg_tables": `relation "tables" does not exist`,
+		"b/":          "could not create db instance: connection refused",
+	}
+	for key, wantErr := range want {
+		if !strings.Contains(got[key], wantErr) {
+			t.Errorf("%s: expected error %q, got %q", key, wantErr, got[key])
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("expected the errors %v, got %v", want, got)
+	}
+
+	if len(opened) != 1 {
+		t.Fatalf("expected a connection to the postgresql database only, got %d", len(opened))
+	}
+	executed := opened[0].Executed()
+	sort.Strings(executed)
+	if wantExecuted := []string{"select value", argsSQL}; !reflect.DeepEqual(executed, wantExecuted) {
+		t.Errorf("expected the queries prepared %q, got %q", wantExecuted, executed)
+	}
+	if !opened[0].Closed() {
+		t.Errorf("expected the connection closed")
+	}
+}
+
+func TestReloadMetrics(t *testing.T) {
+	conns := &fakeConns{version: 110000, query: "select value", rows: []map[string]interface{}{{"value": 1.0}}}
+	p := New(context.Background(), Options{Connect: conns.connect})
+	cfg := loadConfig(t, `a: {host: a, queryFiles: [queries.yaml]}`)
+
+	tests := []struct {
+		name        string
+		reload      func()
+		wantSuccess float64
+	}{
+		{"loaded", func() { p.LoadConfig(cfg) }, 1},
+		{"failed", p.ReloadFailed, 0},
+		{"reloaded", func() { p.LoadConfig(cfg) }, 1},
+	}
+
+	var prevTimestamp float64
+	for _, tt := range tests {
+		before := float64(time.Now().UnixNano()) / 1e9
+		tt.reload()
+		mfs := gather(t, p, 5*time.Second)
+
+		if got := metricValue(mfs, "pg_exporter_config_last_reload_success"); got != tt.wantSuccess {
+			t.Errorf("%s: expected reload success %v, got %v", tt.name, tt.wantSuccess, got)
+		}
+		timestamp := metricValue(mfs, "pg_exporter_config_last_reload_timestamp_seconds")
+		if !(timestamp >= before) || timestamp < prevTimestamp {
+			t.Errorf("%s: expected the reload timestamp after %v, got %v", tt.name, before, timestamp)
+		}
+		prevTimestamp = timestamp
+		// the failed reload keeps the config in use
+		if got := metricValue(mfs, "pg_test_value"); got != 1 {
+			t.Errorf("%s: expected the metrics of the config in use, got %v", tt.name, got)
+		}
+	}
+}
+
+func TestQueryVariantInfo(t *testing.T) {
+	tests := []struct {
+		version config.PgVersion
+		wantMin string
+		wantMax string
+	}{
+		{90600, "", "10.0.0"},
+		{110000, "10.0.0", "14.0.0"},
+		{140002, "14.0.0", ""},
+	}
+
+	for _, tt := range tests {
+		p := New(context.Background(), Options{
+			Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+				conn := dbtest.New(tt.version)
+				for _, sql := range []string{"select old value", "select value", "select new value"} {
+					conn.SetRows(sql, map[string]interface{}{"value": 1.0})
+				}
+				return conn, nil
+			},
+		})
+		p.LoadConfig(loadConfig(t, `a: {host: a, queryFiles: [variants.yaml]}`))
+
+		mf := findMetric(gather(t, p, 5*time.Second), "pg_exporter_query_variant_info")
+		if mf == nil || len(mf.Metric) != 1 {
+			t.Errorf("version %d: expected the variant info, got %v", tt.version, mf)
+			continue
+		}
+		got := make(map[string]string)
+		for _, lp := range mf.Metric[0].Label {
+			got[lp.GetName()] = lp.GetValue()
+		}
+		want := map[string]string{"instance": "a", "query": "pg_test", "min": tt.wantMin, "max": tt.wantMax}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("version %d: expected labels %v, got %v", tt.version, want, got)
+		}
+	}
+}
+
+func TestRecoverRowPanic(t *testing.T) {
+	tests := []struct {
+		queryFile  string
+		wantErrors float64
+	}{
+		{"summary.yaml", 0},
+		// the summary panics on the quantile label
+		{"panic.yaml", 1},
+	}
+
+	for _, tt := range tests {
+		mfs := scrape(t, `a: {host: a, queryFiles: [`+tt.queryFile+`]}`, Options{}, "select durations",
+			map[string]interface{}{"db": "a", "quantile": "a", "duration": 1.0, "default_duration": 1.0},
+			map[string]interface{}{"db": "b", "quantile": "b", "duration": 2.0, "default_duration": 2.0})
+		if got := metricValue(mfs, "pg_exporter_last_scrape_errors"); got != tt.wantErrors {
+			t.Errorf("%s: expected %v errors, got %v", tt.queryFile, tt.wantErrors, got)
+		}
+		if got := metricValue(mfs, "pg_exporter_up"); got != 1 {
+			t.Errorf("%s: expected up 1, got %v", tt.queryFile, got)
+		}
+	}
+}
+
+func TestScrapeSpread(t *testing.T) {
+	tests := []struct {
+		spread       time.Duration
+		timeout      time.Duration
+		delays       []time.Duration
+		wantMax      time.Duration
+		wantConnects []time.Duration // minimum offsets of the connections since the scrape start
+	}{
+		{0, 0, nil, 0, []time.Duration{0, 0}},
+		{time.Second, 0, []time.Duration{0, 150 * time.Millisecond}, time.Second, []time.Duration{0, 150 * time.Millisecond}},
+		// the spread is capped at the half of the timeout, the delay past the timeout skips the database
+		{time.Second, 200 * time.Millisecond, []time.Duration{0, time.Second}, 100 * time.Millisecond, []time.Duration{0}},
+	}
+
+	for _, tt := range tests {
+		var (
+			lock     sync.Mutex
+			start    time.Time
+			connects []time.Duration
+			maxes    []time.Duration
+		)
+		p := New(context.Background(), Options{
+			ScrapeSpread:  tt.spread,
+			ScrapeTimeout: tt.timeout,
+			Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+				lock.Lock()
+				defer lock.Unlock()
+				connects = append(connects, time.Since(start))
+				return dbtest.New(110000).SetRows("select value", map[string]interface{}{"value": 1.0}), nil
+			},
+		})
+		p.spreadDelay = func(max time.Duration) time.Duration {
+			delay := tt.delays[len(maxes)]
+			maxes = append(maxes, max)
+			return delay
+		}
+		p.LoadConfig(loadConfig(t, `{a: {host: a, labels: {db: a}, queryFiles: [queries.yaml]}, b: {host: b, labels: {db: b}, queryFiles: [queries.yaml]}}`))
+
+		start = time.Now()
+		gather(t, p, 5*time.Second)
+		if elapsed := time.Since(start); tt.timeout > 0 && elapsed > tt.timeout+100*time.Millisecond {
+			t.Errorf("spread %v, timeout %v: expected the scrape to finish in time, took %v", tt.spread, tt.timeout, elapsed)
+		}
+
+		for _, max := range maxes {
+			if max != tt.wantMax {
+				t.Errorf("spread %v, timeout %v: expected the maximum delay %v, got %v", tt.spread, tt.timeout, tt.wantMax, max)
+			}
+		}
+		if len(maxes) != len(tt.delays) {
+			t.Errorf("spread %v, timeout %v: expected %d delays, got %d", tt.spread, tt.timeout, len(tt.delays), len(maxes))
+		}
+
+		lock.Lock()
+		sort.Slice(connects, func(i, j int) bool { return connects[i] < connects[j] })
+		if len(connects) != len(tt.wantConnects) {
+			t.Errorf("spread %v, timeout %v: expected %d connections, got %v", tt.spread, tt.timeout, len(tt.wantConnects), connects)
+		} else {
+			for i, offset := range connects {
+				if offset < tt.wantConnects[i] || offset > tt.wantConnects[i]+100*time.Millisecond {
+					t.Errorf("spread %v, timeout %v: expected connection %d after %v, got %v", tt.spread, tt.timeout, i, tt.wantConnects[i], offset)
+				}
+			}
+		}
+		lock.Unlock()
+	}
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	tests := []struct {
+		delay        time.Duration
+		wantValue    bool
+		wantErrors   float64
+		wantTimeOuts float64
+	}{
+		{0, true, 0, 0},
+		// the query past the timeout is canceled and counted as the scrape error
+		{10 * time.Second, false, 1, 1},
+	}
+
+	for _, tt := range tests {
+		p := New(context.Background(), Options{
+			ScrapeTimeout: timeout,
+			Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+				conn := dbtest.New(110000).SetRows("select value", map[string]interface{}{"value": 1.0})
+				conn.Delay = tt.delay
+				conn.SetContext(ctx)
+				return conn, nil
+			},
+		})
+		p.LoadConfig(loadConfig(t, `{a: {host: a, labels: {db: a}, queryFiles: [queries.yaml]}}`))
+
+		start := time.Now()
+		mfs := gather(t, p, 5*time.Second)
+		if elapsed := time.Since(start); elapsed > timeout+100*time.Millisecond {
+			t.Errorf("delay %v: expected the scrape to finish within the timeout, took %v", tt.delay, elapsed)
+		}
+		if got := findMetric(mfs, "pg_test_value") != nil; got != tt.wantValue {
+			t.Errorf("delay %v: expected pg_test_value reported %v, got %v", tt.delay, tt.wantValue, got)
+		}
+		if got := metricValue(mfs, "pg_exporter_last_scrape_errors"); got != tt.wantErrors {
+			t.Errorf("delay %v: expected %v scrape errors, got %v", tt.delay, tt.wantErrors, got)
+		}
+		if got := metricValue(mfs, "pg_exporter_last_scrape_timeouts"); got != tt.wantTimeOuts {
+			t.Errorf("delay %v: expected %v scrape timeouts, got %v", tt.delay, tt.wantTimeOuts, got)
+		}
+		p.Wait()
+	}
+}
+
+func TestNaNValues(t *testing.T) {
+	tests := []struct {
+		queryFile string
+		value     interface{}
+	}{
+		{"queries.yaml", math.NaN()},
+		{"queries.yaml", "NaN"},
+		{"queries.yaml", nil},
+		{"counter.yaml", math.NaN()},
+	}
+
+	for _, tt := range tests {
+		mfs := scrape(t, `a: {host: a, queryFiles: [`+tt.queryFile+`]}`, Options{Debug: true}, "select value", map[string]interface{}{"value": tt.value})
+
+		if mf := findMetric(mfs, "pg_test_value"); mf != nil {
+			t.Errorf("%s %#v: expected the NaN value to be skipped, got %v", tt.queryFile, tt.value, mf)
+		}
+		if errs := metricValue(mfs, "pg_exporter_value_conversion_errors_total"); errs != 0 {
+			t.Errorf("%s %#v: expected no conversion errors, got %v", tt.queryFile, tt.value, errs)
+		}
+	}
+
+	// the NaN observations are left out of the summary
+	mfs := scrape(t, `a: {host: a, queryFiles: [summary.yaml]}`, Options{}, "select durations",
+		map[string]interface{}{"db": "a", "duration": math.NaN()},
+		map[string]interface{}{"db": "a", "duration": 0.5},
+	)
+	mf := findMetric(mfs, "pg_summary_duration")
+	if mf == nil || len(mf.Metric) != 1 {
+		t.Fatalf("expected the summary, got %v", mf)
+	}
+	if summary := mf.Metric[0].GetSummary(); summary.GetSampleCount() != 1 || summary.GetSampleSum() != 0.5 {
+		t.Errorf("expected the single observation of 0.5, got %v", summary)
+	}
+}
+
+func TestNegativeValues(t *testing.T) {
+	tests := []struct {
+		queryFile string
+		value     interface{}
+		wantValue float64
+		wantFound bool
+	}{
+		// clock skew and replication lag can be negative
+		{"queries.yaml", -1.5, -1.5, true},
+		{"queries.yaml", "-42", -42, true},
+		{"queries.yaml", int64(-7), -7, true},
+		{"queries.yaml", math.Inf(-1), math.Inf(-1), true},
+		{"counter.yaml", 3.0, 3, true},
+		{"counter.yaml", 0.0, 0, true},
+		// the counter would panic on the negative value
+		{"counter.yaml", -1.5, 0, false},
+		{"counter.yaml", "-42", 0, false},
+	}
+
+	for _, tt := range tests {
+		mfs := scrape(t, `a: {host: a, queryFiles: [`+tt.queryFile+`]}`, Options{}, "select value", map[string]interface{}{"value": tt.value})
+
+		got := metricValue(mfs, "pg_test_value")
+		if !tt.wantFound {
+			if !math.IsNaN(got) {
+				t.Errorf("%s %#v: expected no metric, got %v", tt.queryFile, tt.value, got)
+			}
+			if errs := metricValue(mfs, "pg_exporter_value_conversion_errors_total"); errs != 1 {
+				t.Errorf("%s %#v: expected a conversion error, got %v", tt.queryFile, tt.value, errs)
+			}
+			continue
+		}
+		if got != tt.wantValue {
+			t.Errorf("%s %#v: expected %v, got %v", tt.queryFile, tt.value, tt.wantValue, got)
+		}
+	}
+}
+
+func TestStrictColumns(t *testing.T) {
+	tests := []struct {
+		name       string
+		strict     bool
+		row        map[string]interface{}
+		wantMetric bool
+		wantErrors float64
+	}{
+		{"all columns", true, map[string]interface{}{"query": "select 1", "calls": 5.0}, true, 0},
+		{"extra column", true, map[string]interface{}{"query": "select 1", "calls": 5.0, "userid": 10.0}, true, 0},
+		// the misspelled label column fails the query instead of yielding the metric without the label
+		{"missing label", true, map[string]interface{}{"querytext": "select 1", "calls": 5.0}, false, 1},
+		{"missing label not strict", false, map[string]interface{}{"querytext": "select 1", "calls": 5.0}, true, 0},
+	}
+
+	for _, tt := range tests {
+		mfs := scrape(t, `a: {host: a, queryFiles: [labels.yaml]}`, Options{StrictColumns: tt.strict}, "select statements", tt.row)
+
+		if got := findMetric(mfs, "pg_statements_calls") != nil; got != tt.wantMetric {
+			t.Errorf("%s: expected metric %v, got %v", tt.name, tt.wantMetric, got)
+		}
+		if got := metricValue(mfs, "pg_exporter_last_scrape_errors"); got != tt.wantErrors {
+			t.Errorf("%s: expected %v scrape errors, got %v", tt.name, tt.wantErrors, got)
+		}
+	}
+}
+
+func TestConversionErrors(t *testing.T) {
+	tests := []struct {
+		value      interface{}
+		wantErrors float64
+	}{
+		{1.0, 0},
+		{"1.5", 0},
+		{"not a number", 1},
+		{struct{}{}, 1},
+	}
+
+	for _, tt := range tests {
+		mfs := scrape(t, `a: {host: a, queryFiles: [queries.yaml]}`, Options{}, "select value", map[string]interface{}{"value": tt.value})
+		if got := metricValue(mfs, "pg_exporter_value_conversion_errors_total"); got != tt.wantErrors {
+			t.Errorf("%#v: expected %v conversion errors, got %v", tt.value, tt.wantErrors, got)
+		}
+		// the data problems are not counted as the scrape or connection errors
+		if got := metricValue(mfs, "pg_exporter_last_scrape_errors"); got != 0 {
+			t.Errorf("%#v: expected no scrape errors, got %v", tt.value, got)
+		}
+		if got := metricValue(mfs, "pg_exporter_connection_errors_total"); got != 0 {
+			t.Errorf("%#v: expected no connection errors, got %v", tt.value, got)
+		}
+	}
+}
+
+// countedConns counts the open fake connections, keeping the maximum number open at once
+type countedConns struct {
+	sync.Mutex
+	open    int
+	maxOpen int
+}
+
+type countedConn struct {
+	*dbtest.Conn
+	conns *countedConns
+}
+
+func (c *countedConns) connect(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.open++
+	if c.open > c.maxOpen {
+		c.maxOpen = c.open
+	}
+	conn := dbtest.New(110000).SetRows("select value", map[string]interface{}{"value": 1.0})
+	conn.Delay = 10 * time.Millisecond
+
+	return &countedConn{Conn: conn, conns: c}, nil
+}
+
+func (c *countedConn) Close() error {
+	c.conns.Lock()
+	c.conns.open--
+	c.conns.Unlock()
+
+	return c.Conn.Close()
+}
+
+func TestMaxConnections(t *testing.T) {
+	tests := []struct {
+		maxConnections int
+		wantMaxOpen    int
+	}{
+		{0, 9},
+		{1, 1},
+		{2, 2},
+		{4, 4},
+	}
+
+	for _, tt := range tests {
+		conns := &countedConns{}
+		p := New(context.Background(), Options{MaxConnections: tt.maxConnections, Connect: conns.connect})
+		p.LoadConfig(loadConfig(t, `
+a: {host: a, labels: {db: a}, workers: 3, queryFiles: [queries.yaml]}
+b: {host: b, labels: {db: b}, workers: 3, queryFiles: [queries.yaml]}
+c: {host: c, labels: {db: c}, workers: 3, queryFiles: [queries.yaml]}
+`))
+
+		mfs := gather(t, p, 5*time.Second)
+		if mf := findMetric(mfs, "pg_test_value"); mf == nil || len(mf.Metric) != 3 {
+			t.Errorf("max connections %d: expected pg_test_value of all the databases, got %v", tt.maxConnections, mf)
+		}
+		conns.Lock()
+		if conns.maxOpen > tt.wantMaxOpen {
+			t.Errorf("max connections %d: expected at most %d open connections, got %d", tt.maxConnections, tt.wantMaxOpen, conns.maxOpen)
+		}
+		if conns.open != 0 {
+			t.Errorf("max connections %d: expected all the connections to be closed, %d open", tt.maxConnections, conns.open)
+		}
+		conns.Unlock()
+	}
+}
+
+func TestCloseError(t *testing.T) {
+	conns := &fakeConns{version: 110000, query: "select value", rows: []map[string]interface{}{{"value": 1.0}}}
+	connect := func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+		conn, err := conns.connect(ctx, dbConf)
+		conn.(*dbtest.Conn).CloseErr = errors.New("connection reset by peer")
+		return conn, err
+	}
+	p := New(context.Background(), Options{MaxConnections: 1, Connect: connect})
+	p.LoadConfig(loadConfig(t, `a: {host: a, workers: 1, queryFiles: [queries.yaml]}`))
+
+	// the connection failing to close releases its slot for the next scrape
+	for i := 0; i < 2; i++ {
+		mfs := gather(t, p, 5*time.Second)
+		if mf := findMetric(mfs, "pg_test_value"); mf == nil {
+			t.Errorf("scrape %d: expected pg_test_value", i)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		unreachable []string
+		wantFailed  []string
+	}{
+		{nil, nil},
+		{[]string{"b"}, []string{"b"}},
+		{[]string{"a", "b"}, []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		conns := &fakeConns{version: 110000}
+		p := New(context.Background(), Options{
+			Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+				for _, host := range tt.unreachable {
+					if dbConf.Host == host {
+						return nil, errors.New("connection refused")
+					}
+				}
+				return conns.connect(ctx, dbConf)
+			},
+		})
+		p.LoadConfig(loadConfig(t, `{a: {host: a, queryFiles: [queries.yaml]}, b: {host: b, queryFiles: [queries.yaml]}}`))
+
+		var failed []string
+		for _, f := range p.Probe() {
+			if f.Err == nil {
+				t.Errorf("unreachable %v: expected the error of %q", tt.unreachable, f.DbName)
+			}
+			failed = append(failed, f.DbName)
+		}
+		sort.Strings(failed)
+		if !reflect.DeepEqual(failed, tt.wantFailed) {
+			t.Errorf("unreachable %v: expected failed %v, got %v", tt.unreachable, tt.wantFailed, failed)
+		}
+		for i, conn := range conns.opened {
+			if !conn.Closed() {
+				t.Errorf("unreachable %v: connection %d was not closed", tt.unreachable, i)
+			}
+		}
+	}
+}
+
+func TestQueryRows(t *testing.T) {
+	conns := &fakeConns{version: 110000, query: "select statements"}
+	p := New(context.Background(), Options{Connect: conns.connect})
+	p.LoadConfig(loadConfig(t, `a: {host: a, queryFiles: [labels.yaml]}`))
+
+	tests := []int{0, 1, 5, 2}
+
+	for i, rowsCnt := range tests {
+		rows := make([]map[string]interface{}, rowsCnt)
+		for j := range rows {
+			rows[j] = map[string]interface{}{"query": "select " + strconv.Itoa(j), "calls": float64(j)}
+		}
+		conns.setRows(rows...)
+
+		mfs := gather(t, p, 5*time.Second)
+		if got := queryMetric(mfs, "pg_exporter_query_rows", "pg_statements"); got != float64(rowsCnt) {
+			t.Errorf("scrape %d: expected %d rows, got %v", i, rowsCnt, got)
+		}
+	}
+}
+
+func TestArrayLabelSeparator(t *testing.T) {
+	tests := []struct {
+		members     interface{}
+		options     interface{}
+		wantMembers string
+		wantOptions string
+	}{
+		{[]string{"a", "b"}, []string{"login", "replication=on,off"}, "a,b", "login|replication=on,off"},
+		{[]string{}, []string{"login"}, "", "login"},
+		{
+			&pgtype.TextArray{Elements: []pgtype.Text{{String: "x", Status: pgtype.Present}, {String: "y", Status: pgtype.Present}}, Status: pgtype.Present},
+			&pgtype.Int4Array{Elements: []pgtype.Int4{{Int: 1, Status: pgtype.Present}, {Int: 2, Status: pgtype.Present}}, Status: pgtype.Present},
+			"x,y", "1|2",
+		},
+		{"plain", "text", "plain", "text"},
+	}
+
+	for _, tt := range tests {
+		mfs := scrape(t, `a: {host: a, queryFiles: [arrays.yaml]}`, Options{}, "select roles",
+			map[string]interface{}{"members": tt.members, "options": tt.options, "count": 1.0})
+		mf := findMetric(mfs, "pg_roles_count")
+		if mf == nil || len(mf.Metric) != 1 {
+			t.Errorf("%v, %v: expected pg_roles_count, got %v", tt.members, tt.options, mf)
+			continue
+		}
+		labels := make(map[string]string)
+		for _, lp := range mf.Metric[0].Label {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		if labels["members"] != tt.wantMembers || labels["options"] != tt.wantOptions {
+			t.Errorf("%v, %v: expected labels %q and %q, got %q and %q", tt.members, tt.options,
+				tt.wantMembers, tt.wantOptions, labels["members"], labels["options"])
+		}
+	}
+}
+
+func TestNameTemplate(t *testing.T) {
+	mfs := scrape(t, `a: {host: a, queryFiles: [nametemplate.yaml]}`, Options{}, "select tables",
+		map[string]interface{}{"schema": "public", "table": "users", "size": int64(8192)},
+		map[string]interface{}{"schema": "billing", "table": "invoices", "size": int64(16384)},
+	)
+
+	tests := []struct {
+		metric string
+		want   float64
+	}{
+		{"pg_tables_public_users_size", 8192},
+		{"pg_tables_billing_invoices_size", 16384},
+	}
+
+	for _, tt := range tests {
+		if got := metricValue(mfs, tt.metric); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.metric, tt.want, got)
+		}
+	}
+	if errs := metricValue(mfs, "pg_exporter_last_scrape_errors"); errs != 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+}
+
+func TestNameTemplateMissingColumn(t *testing.T) {
+	mfs := scrape(t, `a: {host: a, queryFiles: [nametemplate.yaml]}`, Options{}, "select tables",
+		map[string]interface{}{"schema": "public", "size": int64(8192)},
+	)
+
+	if errs := metricValue(mfs, "pg_exporter_value_conversion_errors_total"); errs != 1 {
+		t.Errorf("expected the conversion error of the missing column, got %v", errs)
+	}
+	if errs := metricValue(mfs, "pg_exporter_last_scrape_errors"); errs != 0 {
+		t.Errorf("expected no scrape errors, got %v", errs)
+	}
+	for _, mf := range mfs {
+		if strings.HasPrefix(mf.GetName(), "pg_tables_") {
+			t.Errorf("unexpected metric %q", mf.GetName())
+		}
+	}
+}
+
+func TestNameTemplateEmpty(t *testing.T) {
+	mfs := scrape(t, `a: {host: a, queryFiles: [templatename.yaml]}`, Options{}, "select settings",
+		map[string]interface{}{"category": "", "name": "", "value": 1.0},
+		map[string]interface{}{"category": "wal_", "name": "buffers", "value": 2.0},
+	)
+
+	var metrics []string
+	for _, mf := range mfs {
+		if strings.HasPrefix(mf.GetName(), "pg_settings_") {
+			metrics = append(metrics, mf.GetName())
+		}
+	}
+	if want := []string{"pg_settings_wal_buffers_value"}; !reflect.DeepEqual(metrics, want) {
+		t.Errorf("expected metrics %v, got %v", want, metrics)
+	}
+	if got := metricValue(mfs, "pg_exporter_value_conversion_errors_total"); got != 1 {
+		t.Errorf("expected the conversion error of the empty name, got %v", got)
+	}
+}
+
+func TestConfiguredCounts(t *testing.T) {
+	conns := &fakeConns{version: 110000, query: "select value", rows: []map[string]interface{}{{"value": 1.0}}}
+	p := New(context.Background(), Options{Connect: conns.connect})
+
+	tests := []struct {
+		cfgYAML       string
+		wantDatabases float64
+		wantQueries   map[string]float64
+	}{
+		{
+			`{a: {host: a, labels: {db: a}, queryFiles: [queries.yaml, labels.yaml]}, b: {host: b, labels: {db: b}, queryFiles: [queries.yaml]}}`,
+			2,
+			map[string]float64{"a": 2, "b": 1},
+		},
+		{
+			`a: {host: a, queryFiles: [queries.yaml]}`,
+			1,
+			map[string]float64{"a": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		p.LoadConfig(loadConfig(t, tt.cfgYAML))
+		mfs := gather(t, p, 5*time.Second)
+
+		if got := metricValue(mfs, "pg_exporter_configured_databases"); got != tt.wantDatabases {
+			t.Errorf("%s: expected %v databases, got %v", tt.cfgYAML, tt.wantDatabases, got)
+		}
+
+		queries := make(map[string]float64)
+		if mf := findMetric(mfs, "pg_exporter_configured_queries"); mf != nil {
+			for _, m := range mf.Metric {
+				for _, lp := range m.Label {
+					if lp.GetName() == "instance" {
+						queries[lp.GetValue()] = m.GetGauge().GetValue()
+					}
+				}
+			}
+		}
+		if !reflect.DeepEqual(queries, tt.wantQueries) {
+			t.Errorf("%s: expected queries %v, got %v", tt.cfgYAML, tt.wantQueries, queries)
+		}
+	}
+}
+
+func TestConnectionErrors(t *testing.T) {
+	var (
+		lock        sync.Mutex
+		unreachable string
+		queryErr    error
+	)
+	p := New(context.Background(), Options{
+		Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			if dbConf.Host == unreachable {
+				return nil, errors.New("connection refused")
+			}
+			conn := dbtest.New(110000).SetRows("select value", map[string]interface{}{"value": 1.0})
+			if queryErr != nil {
+				conn.SetError("select value", queryErr)
+			}
+			return conn, nil
+		},
+	})
+	p.LoadConfig(loadConfig(t, `{a: {host: a, labels: {db: a}, queryFiles: [queries.yaml]}, b: {host: b, labels: {db: b}, queryFiles: [queries.yaml]}}`))
+
+	tests := []struct {
+		unreachable string
+		queryErr    error
+		want        map[string]float64
+	}{
+		{"", nil, map[string]float64{"a": 0, "b": 0}},
+		{"b", nil, map[string]float64{"a": 0, "b": 1}},
+		// the query errors are not the connection errors
+		{"", errors.New("relation does not exist"), map[string]float64{"a": 0, "b": 1}},
+		{"b", nil, map[string]float64{"a": 0, "b": 2}},
+	}
+
+	for i, tt := range tests {
+		lock.Lock()
+		unreachable, queryErr = tt.unreachable, tt.queryErr
+		lock.Unlock()
+
+		mfs := gather(t, p, 5*time.Second)
+		got := make(map[string]float64)
+		if mf := findMetric(mfs, "pg_exporter_connection_errors_total"); mf != nil {
+			for _, m := range mf.Metric {
+				for _, lp := range m.Label {
+					if lp.GetName() == "instance" {
+						got[lp.GetValue()] = m.GetCounter().GetValue()
+					}
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("scrape %d: expected connection errors %v, got %v", i, tt.want, got)
+		}
+	}
+}
+
+func TestCriticalQueries(t *testing.T) {
+	var (
+		lock        sync.Mutex
+		failed      string
+		unreachable bool
+	)
+	p := New(context.Background(), Options{
+		Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			if unreachable {
+				return nil, errors.New("connection refused")
+			}
+			conn := dbtest.New(110000).
+				SetRows("select critical", map[string]interface{}{"value": 1.0}).
+				SetRows("select optional", map[string]interface{}{"value": 2.0})
+			if failed != "" {
+				conn.SetError(failed, errors.New("relation does not exist"))
+			}
+			return conn, nil
+		},
+	})
+	p.LoadConfig(loadConfig(t, `a: {host: a, queryFiles: [critical.yaml]}`))
+
+	tests := []struct {
+		name        string
+		failed      string
+		unreachable bool
+		wantUp      float64
+	}{
+		{"succeeded", "", false, 1},
+		{"optional failed", "select optional", false, 1},
+		{"critical failed", "select critical", false, 0},
+		{"unreachable", "", true, 0},
+		{"recovered", "", false, 1},
+	}
+
+	for _, tt := range tests {
+		lock.Lock()
+		failed, unreachable = tt.failed, tt.unreachable
+		lock.Unlock()
+
+		mfs := gather(t, p, 5*time.Second)
+		if got := metricValue(mfs, "pg_exporter_up"); got != tt.wantUp {
+			t.Errorf("%s: expected up %v, got %v", tt.name, tt.wantUp, got)
+		}
+	}
+}
+
+func TestNullNameColumn(t *testing.T) {
+	tests := []struct {
+		rows           []map[string]interface{}
+		wantMetrics    []string
+		wantConversion float64
+	}{
+		{
+			[]map[string]interface{}{{"name": "select", "calls": int64(3), "total_time": 1.5}},
+			[]string{"pg_statements_select_calls"},
+			0,
+		},
+		{
+			[]map[string]interface{}{
+				{"name": nil, "calls": int64(1), "total_time": 0.5},
+				{"name": "select", "calls": int64(3), "total_time": 1.5},
+			},
+			[]string{"pg_statements_select_calls"},
+			1,
+		},
+		{
+			[]map[string]interface{}{{"calls": int64(1), "total_time": 0.5}},
+			nil,
+			1,
+		},
+		// the empty name is skipped as the NULL one, even if the conversion errors abort the query
+		{
+			[]map[string]interface{}{
+				{"name": "", "calls": int64(1), "total_time": 0.5},
+				{"name": "select", "calls": int64(3), "total_time": 1.5},
+			},
+			[]string{"pg_statements_select_calls"},
+			1,
+		},
+	}
+
+	for _, tt := range tests {
+		mfs := scrape(t, `a: {host: a, queryFiles: [valuecolumns.yaml]}`, Options{AbortOnConversionError: true}, "select statements", tt.rows...)
+
+		var metrics []string
+		for _, mf := range mfs {
+			if strings.HasSuffix(mf.GetName(), "_calls") {
+				metrics = append(metrics, mf.GetName())
+			}
+		}
+		if !reflect.DeepEqual(metrics, tt.wantMetrics) {
+			t.Errorf("%v: expected metrics %v, got %v", tt.rows, tt.wantMetrics, metrics)
+		}
+		if got := metricValue(mfs, "pg_exporter_value_conversion_errors_total"); got != tt.wantConversion {
+			t.Errorf("%v: expected %v conversion errors, got %v", tt.rows, tt.wantConversion, got)
+		}
+	}
+}
+
+// concurrentConn counts the queries running at once, keeping the maximum number
+type concurrentConn struct {
+	*dbtest.Conn
+	queries *countedConns
+}
+
+func (c *concurrentConn) run(fn func() error) error {
+	c.queries.Lock()
+	c.queries.open++
+	if c.queries.open > c.queries.maxOpen {
+		c.queries.maxOpen = c.queries.open
+	}
+	c.queries.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+	err := fn()
+
+	c.queries.Lock()
+	c.queries.open--
+	c.queries.Unlock()
+
+	return err
+}
+
+func (c *concurrentConn) Exec(query string, args ...interface{}) (rows []map[string]interface{}, err error) {
+	err = c.run(func() error {
+		rows, err = c.Conn.Exec(query, args...)
+		return err
+	})
+
+	return rows, err
+}
+
+func (c *concurrentConn) ExecFunc(query string, fn func(map[string]interface{}) error, args ...interface{}) error {
+	return c.run(func() error { return c.Conn.ExecFunc(query, fn, args...) })
+}
+
+func TestScrapeQueue(t *testing.T) {
+	tests := []struct {
+		workers        int
+		maxConnections int
+		wantWorkers    float64
+		wantQueued     float64
+	}{
+		{1, 0, 1, 3},
+		{2, 0, 2, 2},
+		{4, 0, 4, 0},
+		{8, 0, 8, 0},
+		// the connections the limit leaves no slots for are not opened
+		{4, 2, 2, 2},
+	}
+
+	for _, tt := range tests {
+		cfgYAML := `a: {host: a, workers: ` + strconv.Itoa(tt.workers) + `, queryFiles: [queries.yaml, labels.yaml, critical.yaml]}`
+		mfs := scrape(t, cfgYAML, Options{MaxConnections: tt.maxConnections}, "select value", map[string]interface{}{"value": 1.0})
+
+		if got := metricValue(mfs, "pg_exporter_last_scrape_workers"); got != tt.wantWorkers {
+			t.Errorf("workers %d, max connections %d: expected %v workers, got %v", tt.workers, tt.maxConnections, tt.wantWorkers, got)
+		}
+		if got := metricValue(mfs, "pg_exporter_last_scrape_queued_queries"); got != tt.wantQueued {
+			t.Errorf("workers %d, max connections %d: expected %v queued queries, got %v", tt.workers, tt.maxConnections, tt.wantQueued, got)
+		}
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	tests := []struct {
+		maxConcurrency int
+		wantMax        int
+	}{
+		{0, 9},
+		{1, 1},
+		{3, 3},
+	}
+
+	for _, tt := range tests {
+		queries := &countedConns{}
+		p := New(context.Background(), Options{
+			MaxConcurrency: tt.maxConcurrency,
+			Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+				conn := dbtest.New(110000).SetRows("select value", map[string]interface{}{"value": 1.0})
+				return &concurrentConn{Conn: conn, queries: queries}, nil
+			},
+		})
+		p.LoadConfig(loadConfig(t, `
+a: {host: a, labels: {db: a}, workers: 3, queryFiles: [queries.yaml, labels.yaml, critical.yaml]}
+b: {host: b, labels: {db: b}, workers: 3, queryFiles: [queries.yaml, labels.yaml, critical.yaml]}
+c: {host: c, labels: {db: c}, workers: 3, queryFiles: [queries.yaml, labels.yaml, critical.yaml]}
+`))
+
+		mfs := gather(t, p, 5*time.Second)
+		if mf := findMetric(mfs, "pg_test_value"); mf == nil || len(mf.Metric) != 3 {
+			t.Errorf("max concurrency %d: expected pg_test_value of all the databases, got %v", tt.maxConcurrency, mf)
+		}
+		if got := metricValue(mfs, "pg_exporter_last_scrape_errors"); got != 0 {
+			t.Errorf("max concurrency %d: expected no errors, got %v", tt.maxConcurrency, got)
+		}
+		queries.Lock()
+		if queries.maxOpen > tt.wantMax {
+			t.Errorf("max concurrency %d: expected at most %d queries at once, got %d", tt.maxConcurrency, tt.wantMax, queries.maxOpen)
+		}
+		queries.Unlock()
+	}
+}
+
+func TestRetainFailed(t *testing.T) {
+	type scrapeStep struct {
+		unreachable bool
+		wait        time.Duration
+		wantValue   float64 // NaN if the metric is not expected
+		wantStale   float64 // NaN if the metric is not expected
+	}
+	tests := []struct {
+		name         string
+		retainFailed time.Duration
+		steps        []scrapeStep
+	}{
+		{"disabled", 0, []scrapeStep{
+			{false, 0, 1, math.NaN()},
+			{true, 0, math.NaN(), math.NaN()},
+		}},
+		{"retained", time.Minute, []scrapeStep{
+			{false, 0, 1, 0},
+			{true, 0, 1, 1},
+			{true, 0, 1, 1},
+			{false, 0, 1, 0},
+		}},
+		{"expired", 50 * time.Millisecond, []scrapeStep{
+			{false, 0, 1, 0},
+			{true, 0, 1, 1},
+			{true, 100 * time.Millisecond, math.NaN(), 0},
+		}},
+	}
+
+	for _, tt := range tests {
+		var (
+			lock        sync.Mutex
+			unreachable bool
+		)
+		conns := &fakeConns{version: 110000, query: "select value", rows: []map[string]interface{}{{"value": 1.0}}}
+		p := New(context.Background(), Options{
+			RetainFailed: tt.retainFailed,
+			Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+				lock.Lock()
+				defer lock.Unlock()
+				if unreachable {
+					return nil, errors.New("connection refused")
+				}
+				return conns.connect(ctx, dbConf)
+			},
+		})
+		p.LoadConfig(loadConfig(t, `a: {host: a, queryFiles: [queries.yaml]}`))
+
+		for i, step := range tt.steps {
+			time.Sleep(step.wait)
+			lock.Lock()
+			unreachable = step.unreachable
+			lock.Unlock()
+
+			mfs := gather(t, p, 5*time.Second)
+			if got := metricValue(mfs, "pg_test_value"); math.IsNaN(got) != math.IsNaN(step.wantValue) || (!math.IsNaN(got) && got != step.wantValue) {
+				t.Errorf("%s, scrape %d: expected pg_test_value %v, got %v", tt.name, i, step.wantValue, got)
+			}
+			if got := metricValue(mfs, "pg_exporter_stale"); math.IsNaN(got) != math.IsNaN(step.wantStale) || (!math.IsNaN(got) && got != step.wantStale) {
+				t.Errorf("%s, scrape %d: expected stale %v, got %v", tt.name, i, step.wantStale, got)
+			}
+		}
+	}
+}
+
+func TestPostgresVersion(t *testing.T) {
+	tests := []struct {
+		version     config.PgVersion
+		wantLabel   string
+		wantMissing bool
+	}{
+		{140002, "14.2", false},
+		{100000, "10.0", false},
+		{90603, "9.6.3", false},
+		{config.NoVersion, "", true},
+	}
+
+	for _, tt := range tests {
+		conns := &fakeConns{version: tt.version, query: "select value", rows: []map[string]interface{}{{"value": 1.0}}}
+		p := New(context.Background(), Options{Connect: conns.connect})
+		p.LoadConfig(loadConfig(t, `a: {host: a, queryFiles: [queries.yaml]}`))
+
+		mfs := gather(t, p, 5*time.Second)
+		mf := findMetric(mfs, "pg_exporter_postgres_version")
+		if tt.wantMissing {
+			if mf != nil {
+				t.Errorf("%d: expected no version metric, got %v", tt.version, mf)
+			}
+			continue
+		}
+		if mf == nil || len(mf.Metric) != 1 {
+			t.Errorf("%d: expected a single version metric, got %v", tt.version, mf)
+			continue
+		}
+
+		labels := make(map[string]string)
+		for _, lp := range mf.Metric[0].Label {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		if labels["version"] != tt.wantLabel || labels["instance"] != "a" {
+			t.Errorf("%d: expected version %q of instance a, got %v", tt.version, tt.wantLabel, labels)
+		}
+		if got := mf.Metric[0].GetGauge().GetValue(); got != float64(tt.version) {
+			t.Errorf("%d: expected value %d, got %v", tt.version, tt.version, got)
+		}
+	}
+}
+
+func TestReconnectDeadConnection(t *testing.T) {
+	tests := []struct {
+		name          string
+		dead          bool
+		reconnectErr  error
+		wantValue     float64 // NaN if the metric is not expected
+		wantErrors    float64
+		wantConnects  int
+		wantConnError float64
+	}{
+		{"dead connection", true, nil, 1, 0, 2, 0},
+		{"reconnect failed", true, errors.New("connection refused"), math.NaN(), 1, 2, 1},
+		{"query error", false, nil, math.NaN(), 1, 1, 0},
+	}
+
+	for _, tt := range tests {
+		var (
+			lock   sync.Mutex
+			opened []*dbtest.Conn
+		)
+		connects := 0
+		p := New(context.Background(), Options{
+			Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+				lock.Lock()
+				defer lock.Unlock()
+				connects++
+				if connects == 1 {
+					// the server closed the connection, e.g. on restart
+					conn := dbtest.New(110000).SetError("select value", errors.New("connection reset by peer"))
+					conn.Dead = tt.dead
+					opened = append(opened, conn)
+					return conn, nil
+				}
+				if tt.reconnectErr != nil {
+					return nil, tt.reconnectErr
+				}
+				conn := dbtest.New(110000).SetRows("select value", map[string]interface{}{"value": 1.0})
+				opened = append(opened, conn)
+				return conn, nil
+			},
+		})
+		p.LoadConfig(loadConfig(t, `a: {host: a, queryFiles: [queries.yaml]}`))
+
+		mfs := gather(t, p, 5*time.Second)
+		if got := metricValue(mfs, "pg_test_value"); math.IsNaN(got) != math.IsNaN(tt.wantValue) || (!math.IsNaN(got) && got != tt.wantValue) {
+			t.Errorf("%s: expected pg_test_value %v, got %v", tt.name, tt.wantValue, got)
+		}
+		if got := metricValue(mfs, "pg_exporter_last_scrape_errors"); got != tt.wantErrors {
+			t.Errorf("%s: expected %v errors, got %v", tt.name, tt.wantErrors, got)
+		}
+		if got := metricValue(mfs, "pg_exporter_connection_errors_total"); got != tt.wantConnError {
+			t.Errorf("%s: expected %v connection errors, got %v", tt.name, tt.wantConnError, got)
+		}
+
+		lock.Lock()
+		if connects != tt.wantConnects {
+			t.Errorf("%s: expected %d connection attempts, got %d", tt.name, tt.wantConnects, connects)
+		}
+		for i, conn := range opened {
+			if !conn.Closed() {
+				t.Errorf("%s: connection %d was not closed", tt.name, i)
+			}
+		}
+		lock.Unlock()
+	}
+}
+
+func TestTransactionQueries(t *testing.T) {
+	tests := []struct {
+		name       string
+		beginErr   error
+		wantValues bool
+		wantErrors float64
+	}{
+		{"committed", nil, true, 0},
+		{"begin failed", errors.New("connection reset by peer"), false, 2},
+	}
+
+	for _, tt := range tests {
+		var (
+			lock   sync.Mutex
+			opened []*dbtest.Conn
+		)
+		p := New(context.Background(), Options{
+			Connect: func(ctx context.Context, dbConf config.DbConfig) (db.Interface, error) {
+				lock.Lock()
+				defer lock.Unlock()
+				conn := dbtest.New(110000).
+					SetRows("select value", map[string]interface{}{"value": 1.0}).
+					SetRows("select sizes", map[string]interface{}{"bytes": 8192.0}).
+					SetRows("select rows", map[string]interface{}{"rows": 100.0})
+				if tt.beginErr != nil {
+					conn.SetError("begin", tt.beginErr)
+				}
+				opened = append(opened, conn)
+				return conn, nil
+			},
+		})
+		p.LoadConfig(loadConfig(t, `a: {host: a, workers: 3, queryFiles: [queries.yaml, transaction.yaml]}`))
+
+		mfs := gather(t, p, 5*time.Second)
+		if got := metricValue(mfs, "pg_test_value"); got != 1 {
+			t.Errorf("%s: expected the query out of the transaction to run, got %v", tt.name, got)
+		}
+		for _, name := range []string{"pg_table_size_bytes", "pg_table_rows_rows"} {
+			if got := findMetric(mfs, name) != nil; got != tt.wantValues {
+				t.Errorf("%s: expected %s %v, got %v", tt.name, name, tt.wantValues, got)
+			}
+		}
+		if got := metricValue(mfs, "pg_exporter_last_scrape_errors"); got != tt.wantErrors {
+			t.Errorf("%s: expected %v errors, got %v", tt.name, tt.wantErrors, got)
+		}
+
+		// the queries of the transaction run on the same connection between begin and commit
+		lock.Lock()
+		var tx []string
+		for _, conn := range opened {
+			executed := conn.Executed()
+			for i, query := range executed {
+				if query == "begin" {
+					tx = executed[i:]
+				}
+				if query == "commit" {
+					tx = tx[:len(tx)-(len(executed)-i-1)]
+				}
+			}
+		}
+		lock.Unlock()
+		if tt.beginErr != nil {
+			if len(tx) != 1 {
+				t.Errorf("%s: expected no queries after the failed begin, got %v", tt.name, tx)
+			}
+			continue
+		}
+		if len(tx) != 4 || tx[3] != "commit" {
+			t.Errorf("%s: expected the transaction of two queries, got %v", tt.name, tx)
+			continue
+		}
+		inTx := []string{tx[1], tx[2]}
+		sort.Strings(inTx)
+		if !reflect.DeepEqual(inTx, []string{"select rows", "select sizes"}) {
+			t.Errorf("%s: expected the queries of the transaction, got %v", tt.name, tx)
+		}
+	}
+}
+
+func TestStatementTimeoutMetric(t *testing.T) {
+	tests := []struct {
+		cfgYAML     string
+		want        float64
+		wantMissing bool
+	}{
+		{`a: {host: a, statementTimeout: 1s, queryFiles: [queries.yaml]}`, 1, false},
+		{`a: {host: a, statementTimeout: 1500ms, queryFiles: [queries.yaml]}`, 1.5, false},
+		{`a: {host: a, queryFiles: [queries.yaml]}`, 0, false},
+		// not read back from the pgbouncer and the like
+		{`a: {host: a, isNotPg: true, statementTimeout: 1s, queryFiles: [queries.yaml]}`, 0, true},
+	}
+
+	for _, tt := range tests {
+		mfs := scrape(t, tt.cfgYAML, Options{}, "select value", map[string]interface{}{"value": 1.0})
+		got := metricValue(mfs, "pg_exporter_statement_timeout_seconds")
+		if tt.wantMissing {
+			if !math.IsNaN(got) {
+				t.Errorf("%s: expected no statement timeout metric, got %v", tt.cfgYAML, got)
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected statement timeout %v, got %v", tt.cfgYAML, tt.want, got)
+		}
+	}
+}
+
+func TestAbortOnConversionError(t *testing.T) {
+	rows := []map[string]interface{}{
+		{"query": "select 1", "calls": 1.0},
+		{"query": "select 2", "calls": "not a number"},
+		{"query": "select 3", "calls": 3.0},
+	}
+
+	tests := []struct {
+		abort       bool
+		wantQueries []string
+	}{
+		// the bad row does not suppress the metrics of the good ones
+		{false, []string{"select 1", "select 3"}},
+		{true, []string{"select 1"}},
+	}
+
+	for _, tt := range tests {
+		mfs := scrape(t, `a: {host: a, queryFiles: [labels.yaml]}`, Options{AbortOnConversionError: tt.abort}, "select statements", rows...)
+
+		var queries []string
+		if mf := findMetric(mfs, "pg_statements_calls"); mf != nil {
+			for _, m := range mf.Metric {
+				for _, lp := range m.Label {
+					if lp.GetName() == "query" {
+						queries = append(queries, lp.GetValue())
+					}
+				}
+			}
+		}
+		sort.Strings(queries)
+		if !reflect.DeepEqual(queries, tt.wantQueries) {
+			t.Errorf("abort %v: expected the metrics of %v, got %v", tt.abort, tt.wantQueries, queries)
+		}
+		if got := metricValue(mfs, "pg_exporter_value_conversion_errors_total"); got != 1 {
+			t.Errorf("abort %v: expected a conversion error, got %v", tt.abort, got)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package remotewrite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/adjust/postgresql_exporter/pkg/samples"
+)
+
+// ContentType describes the content type of the remote write request
+const ContentType = "application/x-protobuf"
+
+const (
+	protocolVersion = "0.1.0"
+	nameLabel       = "__name__"
+
+	// Field numbers of the remote write protobuf messages
+	writeRequestTimeseries = 1
+	timeseriesLabels       = 1
+	timeseriesSamples      = 2
+	labelName              = 1
+	labelValue             = 2
+	sampleValue            = 1
+	sampleTimestamp        = 2
+
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+
+	maxErrorBody = 512 // Maximum length of the response body reported in the error
+)
+
+// Client pushes the metrics of the gatherer to the endpoint of the Prometheus remote write protocol
+type Client struct {
+	url     string
+	headers http.Header
+	labels  map[string]string
+	client  *http.Client
+}
+
+// label describes the label of the time series
+type label struct {
+	name, value string
+}
+
+// series describes the time series with a single sample
+type series struct {
+	labels    []label
+	value     float64
+	timestamp int64
+}
+
+// New creates the client pushing to the url
+func New(url string, timeout time.Duration) *Client {
+	return &Client{
+		url:     url,
+		headers: make(http.Header),
+		labels:  make(map[string]string),
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// Header adds the header to the requests, e.g. Authorization
+func (c *Client) Header(name, value string) *Client {
+	c.headers.Add(name, value)
+	return c
+}
+
+// Label adds the label to all the pushed series, overriding the label of the metrics with the same name
+func (c *Client) Label(name, value string) *Client {
+	c.labels[name] = value
+	return c
+}
+
+// Push gathers the metrics and sends them, the samples without the timestamp are stamped with the current time
+func (c *Client) Push(gatherer prometheus.Gatherer) error {
+	metricFamilies, gatherErr := gatherer.Gather()
+	if gatherErr != nil {
+		if len(metricFamilies) == 0 {
+			return fmt.Errorf("could not gather metrics: %v", gatherErr)
+		}
+		// push what was gathered, the errors are of the particular metrics
+		gatherErr = fmt.Errorf("could not gather some of the metrics: %v", gatherErr)
+	}
+
+	body := snappy.Encode(nil, Encode(metricFamilies, c.labels, time.Now()))
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not create request: %v", err)
+	}
+	for name, values := range c.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", ContentType)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", protocolVersion)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return gatherErr
+}
+
+// Encode converts the metric families into the uncompressed protobuf WriteRequest of the remote write protocol.
+// The labels are added to each series, the samples without the timestamp are stamped with now
+func Encode(metricFamilies []*dto.MetricFamily, labels map[string]string, now time.Time) []byte {
+	buf := proto.NewBuffer(nil)
+	msg := proto.NewBuffer(nil)
+	for _, s := range toSeries(metricFamilies, labels, now) {
+		msg.Reset()
+		encodeSeries(msg, s)
+		encodeBytes(buf, writeRequestTimeseries, msg.Bytes())
+	}
+
+	return buf.Bytes()
+}
+
+// toSeries flattens the metric families into the series, the summaries and histograms
+// are split into the series of the quantiles or buckets, sum and count, as in the text format
+func toSeries(metricFamilies []*dto.MetricFamily, labels map[string]string, now time.Time) []series {
+	var res []series
+	for _, mf := range metricFamilies {
+		for _, m := range mf.Metric {
+			timestamp := now.UnixNano() / int64(time.Millisecond)
+			if m.TimestampMs != nil {
+				timestamp = m.GetTimestampMs()
+			}
+			samples.Flatten(mf, m, func(s samples.Sample) {
+				var extra []label
+				if s.LabelName != "" {
+					extra = append(extra, label{s.LabelName, s.LabelValue})
+				}
+				res = append(res, series{
+					labels:    seriesLabels(s.Name, m.Label, labels, extra...),
+					value:     s.Value,
+					timestamp: timestamp,
+				})
+			})
+		}
+	}
+
+	return res
+}
+
+// seriesLabels merges the labels of the series, sorted by name as the protocol requires
+func seriesLabels(name string, metricLabels []*dto.LabelPair, labels map[string]string, extra ...label) []label {
+	merged := map[string]string{nameLabel: name}
+	for _, lp := range metricLabels {
+		merged[lp.GetName()] = lp.GetValue()
+	}
+	for _, l := range extra {
+		merged[l.name] = l.value
+	}
+	for n, v := range labels {
+		merged[n] = v
+	}
+
+	res := make([]label, 0, len(merged))
+	for n, v := range merged {
+		res = append(res, label{name: n, value: v})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].name < res[j].name })
+
+	return res
+}
+
+func encodeSeries(buf *proto.Buffer, s series) {
+	msg := proto.NewBuffer(nil)
+	for _, l := range s.labels {
+		msg.Reset()
+		encodeBytes(msg, labelName, []byte(l.name))
+		encodeBytes(msg, labelValue, []byte(l.value))
+		encodeBytes(buf, timeseriesLabels, msg.Bytes())
+	}
+
+	msg.Reset()
+	msg.EncodeVarint(sampleValue<<3 | wireFixed64)
+	msg.EncodeFixed64(math.Float64bits(s.value))
+	msg.EncodeVarint(sampleTimestamp<<3 | wireVarint)
+	msg.EncodeVarint(uint64(s.timestamp))
+	encodeBytes(buf, timeseriesSamples, msg.Bytes())
+}
+
+// encodeBytes encodes the length delimited field
+func encodeBytes(buf *proto.Buffer, field uint64, value []byte) {
+	buf.EncodeVarint(field<<3 | wireBytes)
+	buf.EncodeRawBytes(value)
+}
@@ -0,0 +1,282 @@
+package remotewrite
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func labelPair(name, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)}
+}
+
+// decode parses the WriteRequest back into the series, failing on the fields the encoder does not write
+func decode(data []byte) ([]series, error) {
+	var res []series
+	for len(data) > 0 {
+		msg, rest, err := decodeBytes(data, writeRequestTimeseries)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode timeseries: %v", err)
+		}
+		data = rest
+
+		s, err := decodeSeries(msg)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+
+	return res, nil
+}
+
+func decodeSeries(data []byte) (series, error) {
+	var s series
+	for len(data) > 0 {
+		if msg, rest, err := decodeBytes(data, timeseriesLabels); err == nil {
+			name, msg, err := decodeBytes(msg, labelName)
+			if err != nil {
+				return s, fmt.Errorf("could not decode label name: %v", err)
+			}
+			value, _, err := decodeBytes(msg, labelValue)
+			if err != nil {
+				return s, fmt.Errorf("could not decode label value: %v", err)
+			}
+			s.labels = append(s.labels, label{name: string(name), value: string(value)})
+			data = rest
+			continue
+		}
+
+		msg, rest, err := decodeBytes(data, timeseriesSamples)
+		if err != nil {
+			return s, fmt.Errorf("could not decode sample: %v", err)
+		}
+		data = rest
+
+		key, n := proto.DecodeVarint(msg)
+		if key != sampleValue<<3|wireFixed64 || len(msg) < n+8 {
+			return s, fmt.Errorf("unexpected sample value key %d", key)
+		}
+		s.value = math.Float64frombits(binary.LittleEndian.Uint64(msg[n:]))
+		msg = msg[n+8:]
+
+		key, n = proto.DecodeVarint(msg)
+		if key != sampleTimestamp<<3|wireVarint {
+			return s, fmt.Errorf("unexpected sample timestamp key %d", key)
+		}
+		timestamp, m := proto.DecodeVarint(msg[n:])
+		if m == 0 {
+			return s, fmt.Errorf("could not decode sample timestamp")
+		}
+		s.timestamp = int64(timestamp)
+	}
+
+	return s, nil
+}
+
+// decodeBytes decodes the length delimited field of the number, returning its value and the rest of the data
+func decodeBytes(data []byte, field uint64) ([]byte, []byte, error) {
+	key, n := proto.DecodeVarint(data)
+	if n == 0 || key != field<<3|wireBytes {
+		return nil, nil, fmt.Errorf("unexpected key %d", key)
+	}
+	length, m := proto.DecodeVarint(data[n:])
+	if m == 0 || uint64(len(data)-n-m) < length {
+		return nil, nil, fmt.Errorf("invalid length of field %d", field)
+	}
+	data = data[n+m:]
+
+	return data[:length], data[length:], nil
+}
+
+func TestEncode(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	tests := []struct {
+		name   string
+		mf     *dto.MetricFamily
+		labels map[string]string
+		want   []series
+	}{
+		{
+			"gauge",
+			&dto.MetricFamily{
+				Name: proto.String("pg_up"),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{Label: []*dto.LabelPair{labelPair("instance", "a")}, Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+				},
+			},
+			nil,
+			[]series{{labels: []label{{"__name__", "pg_up"}, {"instance", "a"}}, value: 1, timestamp: nowMs}},
+		},
+		{
+			"timestamp",
+			&dto.MetricFamily{
+				Name: proto.String("pg_stat_calls"),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{Counter: &dto.Counter{Value: proto.Float64(12.5)}, TimestampMs: proto.Int64(1500000000000)},
+				},
+			},
+			nil,
+			[]series{{labels: []label{{"__name__", "pg_stat_calls"}}, value: 12.5, timestamp: 1500000000000}},
+		},
+		{
+			// the labels are sorted by name
+			"client labels",
+			&dto.MetricFamily{
+				Name: proto.String("pg_up"),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					{Label: []*dto.LabelPair{labelPair("instance", "a"), labelPair("job", "db")}, Gauge: &dto.Gauge{Value: proto.Float64(0)}},
+				},
+			},
+			map[string]string{"job": "pg_exporter", "az": "eu-1"},
+			[]series{{labels: []label{{"__name__", "pg_up"}, {"az", "eu-1"}, {"instance", "a"}, {"job", "pg_exporter"}}, value: 0, timestamp: nowMs}},
+		},
+		{
+			"summary",
+			&dto.MetricFamily{
+				Name: proto.String("pg_query_duration"),
+				Type: dto.MetricType_SUMMARY.Enum(),
+				Metric: []*dto.Metric{
+					{Summary: &dto.Summary{
+						SampleCount: proto.Uint64(3),
+						SampleSum:   proto.Float64(4.5),
+						Quantile:    []*dto.Quantile{{Quantile: proto.Float64(0.5), Value: proto.Float64(1.5)}},
+					}},
+				},
+			},
+			nil,
+			[]series{
+				{labels: []label{{"__name__", "pg_query_duration"}, {"quantile", "0.5"}}, value: 1.5, timestamp: nowMs},
+				{labels: []label{{"__name__", "pg_query_duration_sum"}}, value: 4.5, timestamp: nowMs},
+				{labels: []label{{"__name__", "pg_query_duration_count"}}, value: 3, timestamp: nowMs},
+			},
+		},
+		{
+			"infinity",
+			&dto.MetricFamily{
+				Name:   proto.String("pg_value"),
+				Type:   dto.MetricType_UNTYPED.Enum(),
+				Metric: []*dto.Metric{{Untyped: &dto.Untyped{Value: proto.Float64(math.Inf(-1))}}},
+			},
+			nil,
+			[]series{{labels: []label{{"__name__", "pg_value"}}, value: math.Inf(-1), timestamp: nowMs}},
+		},
+		{
+			"no metrics",
+			&dto.MetricFamily{Name: proto.String("pg_up"), Type: dto.MetricType_GAUGE.Enum()},
+			nil,
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := decode(Encode([]*dto.MetricFamily{tt.mf}, tt.labels, now))
+		if err != nil {
+			t.Errorf("%s: could not decode: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestEncodeNaN(t *testing.T) {
+	mf := &dto.MetricFamily{
+		Name:   proto.String("pg_value"),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(math.NaN())}}},
+	}
+
+	got, err := decode(Encode([]*dto.MetricFamily{mf}, nil, time.Now()))
+	if err != nil {
+		t.Fatalf("could not decode: %v", err)
+	}
+	if len(got) != 1 || !math.IsNaN(got[0].value) {
+		t.Errorf("expected a single NaN sample, got %v", got)
+	}
+}
+
+func TestPush(t *testing.T) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "pg_up", Help: "whether the database is up"})
+	gauge.Set(1)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(gauge)
+
+	tests := []struct {
+		name    string
+		status  int
+		wantErr string
+	}{
+		{"accepted", http.StatusNoContent, ""},
+		{"rejected", http.StatusBadRequest, "unexpected status 400 Bad Request: out of order sample"},
+	}
+
+	for _, tt := range tests {
+		var (
+			got    []series
+			header http.Header
+			err    error
+		)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header = r.Header
+			body, _ := ioutil.ReadAll(r.Body)
+			data, dErr := snappy.Decode(nil, body)
+			if dErr == nil {
+				got, dErr = decode(data)
+			}
+			err = dErr
+
+			w.WriteHeader(tt.status)
+			if tt.status != http.StatusNoContent {
+				fmt.Fprintln(w, "out of order sample")
+			}
+		}))
+
+		pushErr := New(srv.URL, 5*time.Second).Header("Authorization", "Bearer secret").Label("instance", "exporter").Push(registry)
+		srv.Close()
+
+		if tt.wantErr == "" && pushErr != nil {
+			t.Errorf("%s: could not push: %v", tt.name, pushErr)
+		}
+		if tt.wantErr != "" && (pushErr == nil || !strings.Contains(pushErr.Error(), tt.wantErr)) {
+			t.Errorf("%s: expected error %q, got %v", tt.name, tt.wantErr, pushErr)
+		}
+		if err != nil {
+			t.Errorf("%s: could not decode request: %v", tt.name, err)
+		}
+
+		wantHeader := map[string]string{
+			"Authorization":                     "Bearer secret",
+			"Content-Type":                      ContentType,
+			"Content-Encoding":                  "snappy",
+			"X-Prometheus-Remote-Write-Version": protocolVersion,
+		}
+		for name, want := range wantHeader {
+			if got := header.Get(name); got != want {
+				t.Errorf("%s: expected header %s %q, got %q", tt.name, name, want, got)
+			}
+		}
+
+		wantLabels := []label{{"__name__", "pg_up"}, {"instance", "exporter"}}
+		if len(got) != 1 || !reflect.DeepEqual(got[0].labels, wantLabels) || got[0].value != 1 {
+			t.Errorf("%s: expected a single pg_up sample of 1, got %v", tt.name, got)
+		}
+	}
+}
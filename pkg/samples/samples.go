@@ -0,0 +1,67 @@
+// Package samples flattens the metric families into the samples of the text exposition format,
+// shared by the encoders of the formats built on it
+package samples
+
+import (
+	"math"
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Sample describes the sample of the metric, the summaries and histograms are split into the samples
+// of the quantiles or buckets, sum and count
+type Sample struct {
+	Name       string
+	LabelName  string // Name of the label added to the labels of the metric, e.g. "quantile" or "le", empty if none
+	LabelValue string
+	Value      float64
+}
+
+// Flatten calls fn for each sample of the metric of the family, in the order of the text format
+func Flatten(mf *dto.MetricFamily, m *dto.Metric, fn func(Sample)) {
+	name := mf.GetName()
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		fn(Sample{Name: name, Value: m.GetCounter().GetValue()})
+	case dto.MetricType_GAUGE:
+		fn(Sample{Name: name, Value: m.GetGauge().GetValue()})
+	case dto.MetricType_SUMMARY:
+		summary := m.GetSummary()
+		for _, q := range summary.Quantile {
+			fn(Sample{Name: name, LabelName: "quantile", LabelValue: FormatFloat(q.GetQuantile()), Value: q.GetValue()})
+		}
+		fn(Sample{Name: name + "_sum", Value: summary.GetSampleSum()})
+		fn(Sample{Name: name + "_count", Value: float64(summary.GetSampleCount())})
+	case dto.MetricType_HISTOGRAM:
+		histogram := m.GetHistogram()
+		infSeen := false
+		for _, b := range histogram.Bucket {
+			if math.IsInf(b.GetUpperBound(), +1) {
+				infSeen = true
+			}
+			fn(Sample{Name: name + "_bucket", LabelName: "le", LabelValue: FormatFloat(b.GetUpperBound()), Value: float64(b.GetCumulativeCount())})
+		}
+		if !infSeen {
+			fn(Sample{Name: name + "_bucket", LabelName: "le", LabelValue: "+Inf", Value: float64(histogram.GetSampleCount())})
+		}
+		fn(Sample{Name: name + "_sum", Value: histogram.GetSampleSum()})
+		fn(Sample{Name: name + "_count", Value: float64(histogram.GetSampleCount())})
+	default:
+		fn(Sample{Name: name, Value: m.GetUntyped().GetValue()})
+	}
+}
+
+// FormatFloat formats the value as the text format does, the infinities and NaN included
+func FormatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, +1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
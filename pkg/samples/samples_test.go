@@ -0,0 +1,131 @@
+package samples
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestFormatFloat(t *testing.T) {
+	tests := []struct {
+		value float64
+		want  string
+	}{
+		{0, "0"},
+		{1.5, "1.5"},
+		{-2, "-2"},
+		{1e21, "1e+21"},
+		{math.Inf(+1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+		{math.NaN(), "NaN"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatFloat(tt.value); got != tt.want {
+			t.Errorf("FormatFloat(%v) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	tests := []struct {
+		name string
+		mf   *dto.MetricFamily
+		want []Sample
+	}{
+		{
+			name: "counter",
+			mf: &dto.MetricFamily{
+				Name:   proto.String("requests_total"),
+				Type:   dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(3)}}},
+			},
+			want: []Sample{{Name: "requests_total", Value: 3}},
+		},
+		{
+			name: "gauge",
+			mf: &dto.MetricFamily{
+				Name:   proto.String("connections"),
+				Type:   dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(2)}}},
+			},
+			want: []Sample{{Name: "connections", Value: 2}},
+		},
+		{
+			name: "summary",
+			mf: &dto.MetricFamily{
+				Name: proto.String("duration"),
+				Type: dto.MetricType_SUMMARY.Enum(),
+				Metric: []*dto.Metric{{Summary: &dto.Summary{
+					SampleCount: proto.Uint64(4),
+					SampleSum:   proto.Float64(10),
+					Quantile:    []*dto.Quantile{{Quantile: proto.Float64(0.5), Value: proto.Float64(2)}},
+				}}},
+			},
+			want: []Sample{
+				{Name: "duration", LabelName: "quantile", LabelValue: "0.5", Value: 2},
+				{Name: "duration_sum", Value: 10},
+				{Name: "duration_count", Value: 4},
+			},
+		},
+		{
+			name: "histogram without +Inf bucket",
+			mf: &dto.MetricFamily{
+				Name: proto.String("latency"),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{{Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(5),
+					SampleSum:   proto.Float64(1.5),
+					Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(3)}},
+				}}},
+			},
+			want: []Sample{
+				{Name: "latency_bucket", LabelName: "le", LabelValue: "0.1", Value: 3},
+				{Name: "latency_bucket", LabelName: "le", LabelValue: "+Inf", Value: 5},
+				{Name: "latency_sum", Value: 1.5},
+				{Name: "latency_count", Value: 5},
+			},
+		},
+		{
+			name: "histogram with +Inf bucket",
+			mf: &dto.MetricFamily{
+				Name: proto.String("latency"),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{{Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(5),
+					SampleSum:   proto.Float64(1.5),
+					Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(5)}},
+				}}},
+			},
+			want: []Sample{
+				{Name: "latency_bucket", LabelName: "le", LabelValue: "+Inf", Value: 5},
+				{Name: "latency_sum", Value: 1.5},
+				{Name: "latency_count", Value: 5},
+			},
+		},
+		{
+			name: "untyped",
+			mf: &dto.MetricFamily{
+				Name:   proto.String("value"),
+				Type:   dto.MetricType_UNTYPED.Enum(),
+				Metric: []*dto.Metric{{Untyped: &dto.Untyped{Value: proto.Float64(7)}}},
+			},
+			want: []Sample{{Name: "value", Value: 7}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []Sample
+			Flatten(tt.mf, tt.mf.Metric[0], func(s Sample) {
+				got = append(got, s)
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Flatten() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}